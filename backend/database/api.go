@@ -32,6 +32,10 @@ func (api *DatabaseAPI) RegisterRoutes(r *gin.Engine) {
 		dbGroup.GET("/services/:id", api.GetServiceTraffic) // 直接使用GetServiceTraffic
 		dbGroup.GET("/services/:id/traffic", api.GetServiceTraffic)
 		dbGroup.DELETE("/services/:id", api.DeleteService)
+		dbGroup.GET("/services/:id/ip-history", api.GetServiceIPHistory)
+		dbGroup.GET("/services/:id/node-history", api.GetServiceNodeHistory)
+		dbGroup.POST("/services/merge", api.MergeServices)
+		dbGroup.POST("/services/:id/reassign", api.ReassignHistory)
 
 		// 流量统计
 		dbGroup.GET("/traffic/history", api.GetTrafficHistory)
@@ -44,15 +48,47 @@ func (api *DatabaseAPI) RegisterRoutes(r *gin.Engine) {
 		// 端口和用户详情
 		dbGroup.GET("/port-detail/:service_id/:tag", api.GetPortDetail)
 		dbGroup.GET("/user-detail/:service_id/:email", api.GetUserDetail)
+		dbGroup.GET("/port-hourly/:service_id/:tag", api.GetPortHourly)
+		dbGroup.GET("/user-hourly/:service_id/:email", api.GetUserHourly)
+		dbGroup.GET("/user-online/:service_id/:email", api.GetUserOnline)
+		dbGroup.GET("/outbound-detail/:service_id/:tag", api.GetOutboundDetail)
+		dbGroup.GET("/services/:id/outbounds", api.GetServiceOutbounds)
+		dbGroup.GET("/services/:id/online", api.GetServiceOnline)
+		dbGroup.GET("/hy2-quotas", api.GetHy2Quotas)
+		dbGroup.GET("/hy2-quotas/actions", api.GetHy2QuotaActions)
+		dbGroup.PUT("/hy2-quotas/:service_id/:email", api.SetHy2Quota)
+		dbGroup.DELETE("/hy2-quotas/:service_id/:email", api.DeleteHy2Quota)
+		dbGroup.POST("/hy2-quotas/:service_id/:email/lift", api.LiftHy2Quota)
+		dbGroup.GET("/inbound/:service_id/:tag/users", api.GetInboundUsers)
 
 		// 自定义名称管理
 		dbGroup.PUT("/services/:id/custom-name", api.UpdateServiceCustomName)
 		dbGroup.PUT("/inbound/:service_id/:tag/custom-name", api.UpdateInboundCustomName)
 		dbGroup.PUT("/client/:service_id/:email/custom-name", api.UpdateClientCustomName)
+		dbGroup.PUT("/outbound/:service_id/:tag/custom-name", api.UpdateOutboundCustomName)
+		dbGroup.PUT("/inbound/:service_id/:tag/remote-id", api.UpdateInboundRemoteID)
 
 		// 下载历史数据
 		dbGroup.GET("/download/port-history/:service_id/:tag", api.DownloadPortHistory)
 		dbGroup.GET("/download/user-history/:service_id/:email", api.DownloadUserHistory)
+		dbGroup.POST("/import/port-history/:service_id/:tag", api.ImportPortHistory)
+		dbGroup.POST("/import/user-history/:service_id/:email", api.ImportUserHistory)
+
+		// 上报token管理
+		dbGroup.GET("/services/:id/tokens", api.GetIngestTokens)
+		dbGroup.POST("/services/:id/tokens", api.CreateIngestToken)
+		dbGroup.DELETE("/tokens/:token_id", api.RevokeIngestToken)
+
+		// 原始上报数据归档与回放
+		dbGroup.GET("/payloads", api.GetPayloads)
+		dbGroup.GET("/payloads/:id", api.GetPayload)
+		dbGroup.POST("/payloads/replay", api.ReplayPayloads)
+
+		// 异常流量隔离区
+		dbGroup.GET("/quarantine", api.GetQuarantine)
+		dbGroup.POST("/quarantine/:id/approve", api.ApproveQuarantine)
+		dbGroup.POST("/quarantine/:id/discard", api.DiscardQuarantine)
+		dbGroup.PUT("/services/:id/sample-threshold", api.UpdateServiceSampleThreshold)
 	}
 }
 
@@ -137,6 +173,61 @@ func (api *DatabaseAPI) DeleteService(c *gin.Context) {
 	})
 }
 
+// 获取服务合并前使用过的节点标识
+func (api *DatabaseAPI) GetServiceNodeHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+
+	history, err := api.db.GetServiceNodeHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取节点标识历史失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取节点标识历史成功",
+		"data":    history,
+	})
+}
+
+// 获取服务使用过的IP
+func (api *DatabaseAPI) GetServiceIPHistory(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+
+	history, err := api.db.GetServiceIPHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取IP历史失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取IP历史成功",
+		"data":    history,
+	})
+}
+
 // 获取流量历史记录
 func (api *DatabaseAPI) GetTrafficHistory(c *gin.Context) {
 	// 获取查询参数
@@ -438,6 +529,7 @@ func (api *DatabaseAPI) GetPortDetail(c *gin.Context) {
 		"last_seen":    lastSeen,
 		"is_active":    isActive,
 		"custom_name":  customName.String,
+		"rate":         api.db.recordRate(serviceID, inboundKind, tag),
 	}
 
 	// 获取days参数，默认7天
@@ -506,9 +598,20 @@ func (api *DatabaseAPI) GetPortDetail(c *gin.Context) {
 		history[i] = item
 	}
 
+	// 该入站下产生流量的用户
+	users, err := api.db.GetInboundUsers(serviceID, tag, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取入站用户失败: " + err.Error(),
+		})
+		return
+	}
+
 	result := gin.H{
 		"port_info": portInfo,
 		"history":   history,
+		"users":     users,
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -531,17 +634,17 @@ func (api *DatabaseAPI) GetUserDetail(c *gin.Context) {
 		return
 	}
 
+	var recordID int
 	var ip string
 	var userEmail string
-	var inboundTag string
 	var customName sql.NullString
 	var lastSeen string
 	var err error
 	userQuery := `
 		SELECT 
+			ct.id,
 			s.ip_address AS ip,
 			ct.email,
-			'' as inbound_tag,
 			ct.last_updated as last_seen,
 			ct.custom_name
 		FROM client_traffics ct
@@ -549,7 +652,7 @@ func (api *DatabaseAPI) GetUserDetail(c *gin.Context) {
 		WHERE ct.service_id = ? AND ct.email = ?
 	`
 	err = api.db.db.QueryRow(userQuery, serviceID, email).Scan(
-		&ip, &userEmail, &inboundTag, &lastSeen, &customName,
+		&recordID, &ip, &userEmail, &lastSeen, &customName,
 	)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
@@ -582,17 +685,40 @@ func (api *DatabaseAPI) GetUserDetail(c *gin.Context) {
 		totalDown = currentDown
 	}
 
+	// 用户所属的入站
+	inbounds, err := api.db.getClientInbounds(recordID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询用户入站失败: " + err.Error(),
+		})
+		return
+	}
+
 	userInfo := map[string]interface{}{
 		"ip":           ip,
 		"email":        userEmail,
-		"inbound_tag":  inboundTag,
+		"inbound_tag":  clientInboundTags(inbounds),
+		"inbounds":     inbounds,
 		"total_up":     totalUp,
 		"total_down":   totalDown,
 		"current_up":   currentUp,
 		"current_down": currentDown,
 		"last_seen":    lastSeen,
 		"custom_name":  customName.String,
+		"rate":         api.db.recordRate(serviceIDInt, clientKind, email),
+	}
+
+	// 套餐信息（配额、到期时间等）
+	plan, err := api.db.getClientPlan(recordID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询套餐信息失败: " + err.Error(),
+		})
+		return
 	}
+	userInfo["plan"] = plan
 
 	// 获取days参数，默认7天
 	days := 7
@@ -1,10 +1,14 @@
 package database
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -158,6 +162,66 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// 同步签名的有效时间窗口
+const syncSignatureWindow = 5 * time.Minute
+
+// 计算同步签名：内部同步任务用它声明上报的节点，签名密钥与JWT密钥相同
+// 签名包含请求ID和请求体的哈希，截获的签名不能用于其他数据
+func syncSignature(host string, nodeID string, requestID string, body []byte, timestamp int64) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("sync:" + strconv.FormatInt(timestamp, 10) + "\n" + host + "\n" + nodeID + "\n" + requestID + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 为同步上报生成签名，返回时间戳和签名
+func SignSyncNode(host string, nodeID string, requestID string, body []byte) (string, string) {
+	timestamp := time.Now().Unix()
+	return strconv.FormatInt(timestamp, 10), syncSignature(host, nodeID, requestID, body, timestamp)
+}
+
+// 有效期内已使用过的签名，同一个签名只能使用一次（防止重放）
+var (
+	usedSyncSignaturesMu sync.Mutex
+	usedSyncSignatures   = map[string]time.Time{}
+)
+
+// 记录签名已使用，签名在有效期内已经使用过时返回false
+func markSyncSignatureUsed(signature string, now time.Time) bool {
+	usedSyncSignaturesMu.Lock()
+	defer usedSyncSignaturesMu.Unlock()
+	for sig, expires := range usedSyncSignatures {
+		if now.After(expires) {
+			delete(usedSyncSignatures, sig)
+		}
+	}
+	if _, ok := usedSyncSignatures[signature]; ok {
+		return false
+	}
+	// 时间戳最多可以比当前时间晚一个窗口，保留两个窗口的时间
+	usedSyncSignatures[signature] = now.Add(2 * syncSignatureWindow)
+	return true
+}
+
+// 校验同步上报的签名，每个签名只能使用一次
+func VerifySyncNode(host string, nodeID string, requestID string, body []byte, timestamp string, signature string) bool {
+	if host == "" || signature == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	diff := time.Since(time.Unix(ts, 0))
+	if diff > syncSignatureWindow || diff < -syncSignatureWindow {
+		return false
+	}
+	if !hmac.Equal([]byte(syncSignature(host, nodeID, requestID, body, ts)), []byte(signature)) {
+		return false
+	}
+	return markSyncSignatureUsed(signature, time.Now())
+}
+
 // 验证token接口
 func HandleVerifyToken(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
@@ -0,0 +1,295 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 入站下的一个用户及其流量
+type InboundUser struct {
+	Email      string    `json:"email"`
+	CustomName string    `json:"custom_name"`
+	Enable     bool      `json:"enable"`
+	Up         int64     `json:"up"`   // 统计周期内的上传
+	Down       int64     `json:"down"` // 统计周期内的下载
+	Total      int64     `json:"total"`
+	LastSeen   time.Time `json:"last_seen"`
+	// 用户所属的入站数，大于1时流量是该用户在所有入站上的合计（3x-ui只按用户统计）
+	InboundCount int `json:"inbound_count"`
+}
+
+// 用户所属的一个入站
+type ClientInbound struct {
+	RemoteInboundID int    `json:"remote_inbound_id"`
+	Tag             string `json:"tag"` // 尚未对应到入站标签时为空
+	CustomName      string `json:"custom_name"`
+}
+
+// 记录用户出现在某个3x-ui入站上
+func linkClientInbound(tx *sql.Tx, recordID int, serviceID int, remoteInboundID int, at time.Time) error {
+	if remoteInboundID <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO client_inbounds (client_traffic_id, service_id, remote_inbound_id, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(client_traffic_id, remote_inbound_id) DO UPDATE SET last_seen = MAX(last_seen, excluded.last_seen)
+	`, recordID, serviceID, remoteInboundID, at, at)
+	return err
+}
+
+// 3x-ui推送的入站只有标签，用户只有入站ID，两者的对应关系需要推断：
+// 一次推送中尚未对应的入站里只有一个有流量，且有流量的用户所属的未对应入站ID也只有一个时，认为二者是同一个入站。
+// 推断不出来的可以通过 PUT /inbound/:service_id/:tag/remote-id 手动指定。
+func learnInboundRemoteIDs(tx *sql.Tx, serviceID int, data *TrafficData) error {
+	tags := map[string]bool{}
+	for _, t := range data.InboundTraffics {
+		if t.IsInbound && (t.Up > 0 || t.Down > 0) {
+			tags[t.Tag] = true
+		}
+	}
+	ids := map[int]bool{}
+	for _, t := range data.ClientTraffics {
+		if t.InboundID > 0 && (t.Up > 0 || t.Down > 0) {
+			ids[t.InboundID] = true
+		}
+	}
+	if len(tags) == 0 || len(ids) == 0 {
+		return nil
+	}
+
+	var unmappedTags []string
+	for tag := range tags {
+		var remoteID int
+		err := tx.QueryRow(`SELECT remote_id FROM inbound_traffics WHERE service_id = ? AND tag = ?`, serviceID, tag).Scan(&remoteID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if remoteID == 0 {
+			unmappedTags = append(unmappedTags, tag)
+		}
+	}
+	var unmappedIDs []int
+	for id := range ids {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM inbound_traffics WHERE service_id = ? AND remote_id = ?`, serviceID, id).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			unmappedIDs = append(unmappedIDs, id)
+		}
+	}
+	if len(unmappedTags) != 1 || len(unmappedIDs) != 1 {
+		return nil
+	}
+	_, err := tx.Exec(`UPDATE inbound_traffics SET remote_id = ? WHERE service_id = ? AND tag = ? AND remote_id = 0`,
+		unmappedIDs[0], serviceID, unmappedTags[0])
+	return err
+}
+
+// 手动指定入站对应的3x-ui入站ID，0表示取消对应；同一服务中其他入站的相同ID会被清除
+func (d *Database) SetInboundRemoteID(serviceID int, tag string, remoteID int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if remoteID > 0 {
+		if _, err := tx.Exec(`UPDATE inbound_traffics SET remote_id = 0 WHERE service_id = ? AND remote_id = ? AND tag != ?`, serviceID, remoteID, tag); err != nil {
+			return err
+		}
+	}
+	result, err := tx.Exec(`UPDATE inbound_traffics SET remote_id = ? WHERE service_id = ? AND tag = ?`, remoteID, serviceID, tag)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// 获取入站下的用户，按最近days天的流量排序
+func (d *Database) GetInboundUsers(serviceID int, tag string, days int) ([]InboundUser, error) {
+	rows, err := d.db.Query(`
+		SELECT ct.email, ct.custom_name, ct.enable, ci.last_seen,
+			(SELECT COUNT(*) FROM client_inbounds x WHERE x.client_traffic_id = ct.id),
+			COALESCE(SUM(h.daily_up), 0), COALESCE(SUM(h.daily_down), 0)
+		FROM inbound_traffics it
+		JOIN client_inbounds ci ON ci.service_id = it.service_id AND ci.remote_inbound_id = it.remote_id
+		JOIN client_traffics ct ON ct.id = ci.client_traffic_id
+		LEFT JOIN client_traffic_history h ON h.client_traffic_id = ct.id
+			AND h.date >= DATE('now', ? || ' days', 'localtime') AND h.date <= DATE('now', 'localtime')
+		WHERE it.service_id = ? AND it.tag = ? AND it.remote_id > 0 AND ct.status = 'active'
+		GROUP BY ct.id
+		ORDER BY COALESCE(SUM(h.daily_up), 0) + COALESCE(SUM(h.daily_down), 0) DESC, ct.email
+	`, fmt.Sprintf("-%d", days-1), serviceID, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]InboundUser, 0)
+	for rows.Next() {
+		var user InboundUser
+		var customName sql.NullString
+		if err := rows.Scan(&user.Email, &customName, &user.Enable, &user.LastSeen, &user.InboundCount, &user.Up, &user.Down); err != nil {
+			return nil, err
+		}
+		user.CustomName = customName.String
+		user.Total = user.Up + user.Down
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// 获取用户所属的入站
+func (d *Database) getClientInbounds(recordID int) ([]ClientInbound, error) {
+	rows, err := d.db.Query(`
+		SELECT ci.remote_inbound_id, COALESCE(it.tag, ''), COALESCE(it.custom_name, '')
+		FROM client_inbounds ci
+		LEFT JOIN inbound_traffics it ON it.service_id = ci.service_id AND it.remote_id = ci.remote_inbound_id
+		WHERE ci.client_traffic_id = ?
+		ORDER BY ci.remote_inbound_id
+	`, recordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inbounds := make([]ClientInbound, 0)
+	for rows.Next() {
+		var inbound ClientInbound
+		if err := rows.Scan(&inbound.RemoteInboundID, &inbound.Tag, &inbound.CustomName); err != nil {
+			return nil, err
+		}
+		inbounds = append(inbounds, inbound)
+	}
+	return inbounds, nil
+}
+
+// 用户所属入站的标签，多个时以逗号分隔
+func clientInboundTags(inbounds []ClientInbound) string {
+	var tags []string
+	for _, inbound := range inbounds {
+		if inbound.Tag != "" {
+			tags = append(tags, inbound.Tag)
+		}
+	}
+	return strings.Join(tags, ",")
+}
+
+// 合并服务时迁移记录上的关联数据（fromID与toID相同表示整条记录迁移到目标服务）
+func moveRecordLinks(tx *sql.Tx, kind trafficKind, fromID int, toID int, toServiceID int) error {
+	switch kind.name {
+	case clientKind.name:
+		if _, err := tx.Exec(`
+			UPDATE OR IGNORE client_inbounds SET client_traffic_id = ?, service_id = ? WHERE client_traffic_id = ?
+		`, toID, toServiceID, fromID); err != nil {
+			return err
+		}
+		if fromID != toID {
+			_, err := tx.Exec(`DELETE FROM client_inbounds WHERE client_traffic_id = ?`, fromID)
+			return err
+		}
+	case inboundKind.name:
+		if fromID != toID {
+			_, err := tx.Exec(`
+				UPDATE inbound_traffics SET remote_id = (SELECT remote_id FROM inbound_traffics WHERE id = ?)
+				WHERE id = ? AND remote_id = 0
+			`, fromID, toID)
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取入站下的用户列表
+func (api *DatabaseAPI) GetInboundUsers(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	days := 7
+	if d := c.Query("days"); d != "" {
+		if v, err := strconv.Atoi(d); err == nil && v > 0 && v <= 90 {
+			days = v
+		}
+	}
+
+	users, err := api.db.GetInboundUsers(serviceID, c.Param("tag"), days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取入站用户失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取入站用户成功",
+		"data": gin.H{
+			"days":  days,
+			"users": users,
+		},
+	})
+}
+
+// 手动指定入站对应的3x-ui入站ID
+func (api *DatabaseAPI) UpdateInboundRemoteID(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	var request struct {
+		RemoteID *int `json:"remote_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.RemoteID == nil || *request.RemoteID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: remote_id 必须为非负整数",
+		})
+		return
+	}
+
+	tag := c.Param("tag")
+	err = api.db.SetInboundRemoteID(serviceID, tag, *request.RemoteID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "入站不存在",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "更新入站ID失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "入站ID更新成功",
+		"data": gin.H{
+			"service_id": serviceID,
+			"tag":        tag,
+			"remote_id":  *request.RemoteID,
+		},
+	})
+}
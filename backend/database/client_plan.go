@@ -0,0 +1,113 @@
+package database
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// client_traffics 上保存的套餐字段（迁移时自动添加）
+var clientPlanColumns = [][2]string{
+	{"enable", "INTEGER NOT NULL DEFAULT 1"},
+	{"expiry_time", "INTEGER NOT NULL DEFAULT 0"},
+	{"total_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"reset_days", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+const clientPlanSelect = "enable, expiry_time, total_bytes, reset_days"
+
+// 用户套餐信息，取自3x-ui推送的 clientTraffics
+type ClientPlan struct {
+	Enable bool `json:"enable"`
+	// 到期时间（毫秒时间戳），0表示永不过期，负数表示首次使用后的有效时长
+	ExpiryTime int64 `json:"expiry_time"`
+	// 流量配额（字节），0表示不限
+	TotalBytes int64 `json:"total_bytes"`
+	// 自动重置周期（天），0表示不重置
+	ResetDays int64 `json:"reset_days"`
+
+	// 以下为计算值：当前周期已用流量、剩余流量、使用百分比、距到期天数，不适用时为null
+	UsedBytes       int64    `json:"used_bytes"`
+	RemainingBytes  *int64   `json:"remaining_bytes"`
+	PercentUsed     *float64 `json:"percent_used"`
+	DaysUntilExpiry *int     `json:"days_until_expiry"`
+}
+
+func (p *ClientPlan) scanDest() []interface{} {
+	return []interface{}{&p.Enable, &p.ExpiryTime, &p.TotalBytes, &p.ResetDays}
+}
+
+// 用推送中的套餐字段覆盖记录上的值
+func updateClientPlan(tx *sql.Tx, recordID int, traffic ClientTraffic) error {
+	_, err := tx.Exec(`
+		UPDATE client_traffics SET enable = ?, expiry_time = ?, total_bytes = ?, reset_days = ?
+		WHERE id = ?
+	`, traffic.Enable, traffic.ExpiryTime, traffic.Total, traffic.Reset, recordID)
+	return err
+}
+
+// 读取单个用户的套餐信息并计算使用情况
+func (d *Database) getClientPlan(recordID int, now time.Time) (ClientPlan, error) {
+	var plan ClientPlan
+	err := d.db.QueryRow(`SELECT `+clientPlanSelect+` FROM client_traffics WHERE id = ?`, recordID).Scan(plan.scanDest()...)
+	if err != nil {
+		return plan, err
+	}
+	used, err := d.clientPlanUsage("ct.id = ?", recordID)
+	if err != nil {
+		return plan, err
+	}
+	fillClientPlanUsage(&plan, used[recordID], now)
+	return plan, nil
+}
+
+// 按条件统计用户当前周期的已用流量，返回 记录ID -> 已用字节数（没有流量的用户不在结果中）
+//
+// 推送的流量是增量，已用流量由历史表累加得到；设置了重置周期时只统计当前周期
+// （3x-ui 重置时会把到期时间顺延一个周期，所以周期起点为到期时间减去周期天数）
+func (d *Database) clientPlanUsage(where string, args ...interface{}) (map[int]int64, error) {
+	rows, err := d.db.Query(`
+		SELECT ct.id, COALESCE(SUM(h.daily_up + h.daily_down), 0)
+		FROM client_traffics ct
+		JOIN client_traffic_history h ON h.client_traffic_id = ct.id
+		WHERE `+where+` AND h.date >= CASE
+			WHEN ct.reset_days > 0 AND ct.expiry_time > 0
+			THEN DATE(ct.expiry_time / 1000, 'unixepoch', 'localtime', '-' || ct.reset_days || ' days')
+			ELSE '' END
+		GROUP BY ct.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	used := make(map[int]int64)
+	for rows.Next() {
+		var recordID int
+		var bytes int64
+		if err := rows.Scan(&recordID, &bytes); err != nil {
+			return nil, err
+		}
+		used[recordID] = bytes
+	}
+	return used, rows.Err()
+}
+
+// 根据已用流量计算剩余配额、使用百分比和距到期天数
+func fillClientPlanUsage(plan *ClientPlan, usedBytes int64, now time.Time) {
+	plan.UsedBytes = usedBytes
+	if plan.TotalBytes > 0 {
+		remaining := plan.TotalBytes - plan.UsedBytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		percent := math.Round(float64(plan.UsedBytes)*10000/float64(plan.TotalBytes)) / 100
+		plan.RemainingBytes = &remaining
+		plan.PercentUsed = &percent
+	}
+	// 负数到期时间要等用户首次使用后才开始计时，无法计算剩余天数
+	if plan.ExpiryTime > 0 {
+		days := int(math.Ceil(time.UnixMilli(plan.ExpiryTime).Sub(now).Hours() / 24))
+		plan.DaysUntilExpiry = &days
+	}
+}
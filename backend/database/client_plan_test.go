@@ -0,0 +1,117 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFillClientPlanUsage(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name          string
+		plan          ClientPlan
+		used          int64
+		wantRemaining *int64
+		wantPercent   *float64
+		wantDays      *int
+	}{
+		{name: "不限流量永不过期", plan: ClientPlan{}, used: 100},
+		{name: "使用了四分之一", plan: ClientPlan{TotalBytes: 400}, used: 100, wantRemaining: ptr[int64](300), wantPercent: ptr(25.0)},
+		{name: "百分比保留两位小数", plan: ClientPlan{TotalBytes: 3}, used: 1, wantRemaining: ptr[int64](2), wantPercent: ptr(33.33)},
+		{name: "超出配额剩余为0", plan: ClientPlan{TotalBytes: 100}, used: 150, wantRemaining: ptr[int64](0), wantPercent: ptr(150.0)},
+		{name: "还剩不到一天按一天计", plan: ClientPlan{ExpiryTime: now.Add(time.Hour).UnixMilli()}, wantDays: ptr(1)},
+		{name: "还剩十天", plan: ClientPlan{ExpiryTime: now.AddDate(0, 0, 10).UnixMilli()}, wantDays: ptr(10)},
+		{name: "已过期", plan: ClientPlan{ExpiryTime: now.AddDate(0, 0, -2).UnixMilli()}, wantDays: ptr(-2)},
+		{name: "首次使用后计时", plan: ClientPlan{ExpiryTime: -86400000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := tt.plan
+			fillClientPlanUsage(&plan, tt.used, now)
+			if plan.UsedBytes != tt.used {
+				t.Errorf("已用 = %d, 期望 %d", plan.UsedBytes, tt.used)
+			}
+			if !equalPtr(plan.RemainingBytes, tt.wantRemaining) {
+				t.Errorf("剩余 = %v, 期望 %v", deref(plan.RemainingBytes), deref(tt.wantRemaining))
+			}
+			if !equalPtr(plan.PercentUsed, tt.wantPercent) {
+				t.Errorf("百分比 = %v, 期望 %v", deref(plan.PercentUsed), deref(tt.wantPercent))
+			}
+			if !equalPtr(plan.DaysUntilExpiry, tt.wantDays) {
+				t.Errorf("剩余天数 = %v, 期望 %v", deref(plan.DaysUntilExpiry), deref(tt.wantDays))
+			}
+		})
+	}
+}
+
+func TestClientPlanUsage(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		expiry   time.Time
+		reset    int64
+		wantUsed int64
+	}{
+		{name: "不重置时统计全部历史", wantUsed: 111},
+		{name: "设置重置周期但没有到期时间", reset: 30, wantUsed: 111},
+		// 周期起点为到期时间前30天，即5天前：只统计今天和5天前的流量
+		{name: "只统计当前周期", expiry: now.AddDate(0, 0, 25), reset: 30, wantUsed: 11},
+		{name: "周期从今天开始", expiry: now.AddDate(0, 0, 30), reset: 30, wantUsed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			var expiry int64
+			if !tt.expiry.IsZero() {
+				expiry = tt.expiry.UnixMilli()
+			}
+			var serviceID int
+			for _, push := range []struct {
+				daysAgo int
+				up      int64
+			}{{40, 100}, {5, 10}, {0, 1}} {
+				data := &TrafficData{ClientTraffics: []ClientTraffic{{Email: "a@b", Enable: true, Up: push.up, ExpiryTime: expiry, Total: 1000, Reset: tt.reset}}}
+				serviceID = pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: now.AddDate(0, 0, -push.daysAgo)}, data)
+			}
+			// 另一个服务的同名用户不影响统计
+			other := &TrafficData{ClientTraffics: []ClientTraffic{{Email: "a@b", Enable: true, Up: 5000}}}
+			pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.2"}, other)
+
+			used, err := d.clientPlanUsage("ct.service_id = ?", serviceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(used) != 1 {
+				t.Fatalf("结果 = %v, 期望 1 个用户", used)
+			}
+			for recordID, bytes := range used {
+				if bytes != tt.wantUsed {
+					t.Errorf("已用 = %d, 期望 %d", bytes, tt.wantUsed)
+				}
+				plan, err := d.getClientPlan(recordID, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if plan.UsedBytes != tt.wantUsed || plan.TotalBytes != 1000 || plan.ResetDays != tt.reset {
+					t.Errorf("套餐 = %+v", plan)
+				}
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func deref[T any](p *T) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
@@ -1,9 +1,15 @@
 package database
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,13 +20,49 @@ import (
 
 // 数据库结构体
 type Database struct {
-	db *sql.DB
+	db      *sql.DB
+	path    string
+	archive payloadArchiveConfig
+	// 相同内容的推送在该时间窗口内视为重复推送
+	dedupWindow time.Duration
+	quarantine  quarantineConfig
+	// 每小时流量的保留时间
+	hourlyRetention time.Duration
+	// 实时速率（仅内存）
+	rates *rateTracker
+	// 学习阈值缓存
+	thresholds *learnedThresholds
 }
 
+// 重复推送（相同请求ID或时间窗口内内容完全相同），数据已被忽略
+var ErrDuplicatePush = errors.New("重复推送，已忽略")
+
+// 请求ID的去重记录保留时间
+const requestIDRetention = 24 * time.Hour
+
 // 流量数据结构体
 type TrafficData struct {
 	ClientTraffics  []ClientTraffic  `json:"clientTraffics"`
 	InboundTraffics []InboundTraffic `json:"inboundTraffics"`
+	// 在线用户及其设备数（hy2 的 /online），为空表示本次上报不包含在线信息
+	OnlineUsers map[string]int `json:"onlineUsers,omitempty"`
+	// 上报来源（hy2为入站标签），同一服务有多个来源时，各来源分别替换自己的在线用户、分别计算速率
+	Source string `json:"source,omitempty"`
+}
+
+// 是否包含非零的流量（只有心跳或在线信息的推送返回false）
+func (t *TrafficData) hasTraffic() bool {
+	for _, in := range t.InboundTraffics {
+		if in.Up > 0 || in.Down > 0 {
+			return true
+		}
+	}
+	for _, c := range t.ClientTraffics {
+		if c.Up > 0 || c.Down > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // 客户端流量结构体
@@ -48,10 +90,13 @@ type InboundTraffic struct {
 // 服务信息结构体
 type Service struct {
 	ID        int       `json:"id"`
+	NodeID    string    `json:"node_id"`
 	IPAddress string    `json:"ip_address"`
 	FirstSeen time.Time `json:"first_seen"`
 	LastSeen  time.Time `json:"last_seen"`
 	Status    string    `json:"status"`
+	// 被丢弃的重复推送次数
+	DedupCount int64 `json:"dedup_count"`
 }
 
 // 入站流量记录结构体
@@ -65,18 +110,87 @@ type InboundTrafficRecord struct {
 	Down        int64     `json:"down"`
 	LastUpdated time.Time `json:"last_updated"`
 	Status      string    `json:"status"`
+	RemoteID    int       `json:"remote_id"` // 3x-ui中的入站ID，0表示尚未对应
+	Rate        Rate      `json:"rate"`
 }
 
-// 客户端流量记录结构体
-type ClientTrafficRecord struct {
+// 出站流量记录结构体（direct、blocked、WARP等出站标签）
+type OutboundTrafficRecord struct {
 	ID          int       `json:"id"`
 	ServiceID   int       `json:"service_id"`
-	Email       string    `json:"email"`
+	Tag         string    `json:"tag"`
 	CustomName  string    `json:"custom_name"`
 	Up          int64     `json:"up"`
 	Down        int64     `json:"down"`
 	LastUpdated time.Time `json:"last_updated"`
 	Status      string    `json:"status"`
+	Rate        Rate      `json:"rate"`
+}
+
+// 客户端流量记录结构体
+type ClientTrafficRecord struct {
+	ID          int        `json:"id"`
+	ServiceID   int        `json:"service_id"`
+	Email       string     `json:"email"`
+	CustomName  string     `json:"custom_name"`
+	Up          int64      `json:"up"`
+	Down        int64      `json:"down"`
+	LastUpdated time.Time  `json:"last_updated"`
+	Status      string     `json:"status"`
+	Plan        ClientPlan `json:"plan"`
+	Rate        Rate       `json:"rate"`
+}
+
+// 流量记录类型（入站端口、客户端或出站），用于通用地操作记录表和每日历史表
+type trafficKind struct {
+	name         string // inbound / client
+	table        string // 记录表
+	historyTable string // 每日历史表
+	idColumn     string // 历史表中关联记录表的列
+	keyColumn    string // 记录的业务键（tag / email）
+	hourlyTable  string // 每小时流量表，为空表示不按小时统计
+}
+
+var (
+	inboundKind  = trafficKind{"inbound", "inbound_traffics", "inbound_traffic_history", "inbound_traffic_id", "tag", "inbound_traffic_hourly"}
+	clientKind   = trafficKind{"client", "client_traffics", "client_traffic_history", "client_traffic_id", "email", "client_traffic_hourly"}
+	outboundKind = trafficKind{"outbound", "outbound_traffics", "outbound_traffic_history", "outbound_traffic_id", "tag", ""}
+)
+
+// 按名称查找记录类型
+func kindByName(name string) (trafficKind, bool) {
+	for _, kind := range []trafficKind{inboundKind, clientKind, outboundKind} {
+		if kind.name == name {
+			return kind, true
+		}
+	}
+	return trafficKind{}, false
+}
+
+// 流量数据来源
+type TrafficSource struct {
+	ClientIP  string
+	NodeID    string // 节点标识，设置后优先按节点标识匹配服务，IP仅作为可变属性记录
+	UserAgent string
+	ServiceID int // 由上报token绑定的服务ID，为0时按IP查找或创建服务
+	// 数据接收时间，决定写入哪一天的历史，为空时使用当前时间
+	ReceivedAt time.Time
+	// 回放归档数据时不更新服务的当前IP，也不做重复推送检测
+	Replay bool
+	// 可选的请求ID/序列号，相同请求ID的推送只入库一次
+	RequestID string
+}
+
+// Xray采集配置结构体
+// 通过Xray的gRPC StatsService定时拉取流量，直接写入本地数据库
+type XrayConfig struct {
+	ID      int    `json:"id"`
+	NodeID  string `json:"node_id"`
+	APIHost string `json:"api_host"`
+	APIPort string `json:"api_port"`
+	// 采集间隔和超时（秒），0表示使用默认值
+	IntervalSeconds int `json:"interval_seconds"`
+	TimeoutSeconds  int `json:"timeout_seconds"`
 }
 
 // HY2配置结构体
@@ -84,15 +198,64 @@ type ClientTrafficRecord struct {
 
 type Hy2Config struct {
 	ID                int    `json:"id"`
+	NodeID            string `json:"node_id"`
 	SourceAPIPassword string `json:"source_api_password"`
 	SourceAPIHost     string `json:"source_api_host"`
 	SourceAPIPort     string `json:"source_api_port"`
 	TargetAPIURL      string `json:"target_api_url"`
+	// 同步方式：local 直接写入本地数据库，forward 推送到 TargetAPIURL（其他面板）
+	SyncMode string `json:"sync_mode"`
+	// 同步间隔和超时（秒），0表示使用默认值
+	IntervalSeconds int `json:"interval_seconds"`
+	TimeoutSeconds  int `json:"timeout_seconds"`
+	// hy2流量统计API的完整地址（如 https://hy2.example.com:8443/stats），为空时使用 http://主机:端口
+	SourceAPIURL string `json:"source_api_url"`
+	// HTTPS时校验服务端证书的CA（PEM）和/或证书SHA-256指纹，只填指纹时不校验证书链
+	TLSCA        string `json:"tls_ca"`
+	TLSPinSHA256 string `json:"tls_pin_sha256"`
+	// 客户端证书和私钥（PEM），hy2统计API前的反向代理要求双向认证时使用
+	TLSClientCert string `json:"tls_client_cert"`
+	TLSClientKey  string `json:"tls_client_key"`
+	// 显示名称
+	Name string `json:"name"`
+	// 上报的入站标签，同一主机上有多个hy2时用于区分
+	InboundTag string `json:"inbound_tag"`
+	// 停用的配置不会同步
+	Enabled bool `json:"enabled"`
+}
+
+// hy2默认的入站标签
+const Hy2DefaultInboundTag = "hysteria2"
+
+// 解析hy2配置，未指定enabled时默认启用（兼容不带该字段的旧客户端）
+func (cfg *Hy2Config) UnmarshalJSON(data []byte) error {
+	type plain Hy2Config
+	p := plain{Enabled: true}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*cfg = Hy2Config(p)
+	return nil
+}
+
+// hy2流量统计API的根地址（不以/结尾）
+func (cfg *Hy2Config) BaseURL() string {
+	if cfg.SourceAPIURL != "" {
+		return strings.TrimRight(cfg.SourceAPIURL, "/")
+	}
+	return "http://" + net.JoinHostPort(cfg.SourceAPIHost, cfg.SourceAPIPort)
 }
 
+// hy2同步方式
+const (
+	Hy2SyncLocal   = "local"
+	Hy2SyncForward = "forward"
+)
+
 // 打开数据库连接
 func OpenDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// 多个连接同时写入时等待锁释放，而不是立即返回 database is locked
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("打开数据库失败: %v", err)
 	}
@@ -132,7 +295,7 @@ func OpenDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("初始化数据库失败: %v", err)
 	}
 
-	return &Database{db: db}, nil
+	return &Database{db: db, path: dbPath, quarantine: defaultQuarantineConfig, rates: newRateTracker(), thresholds: newLearnedThresholds()}, nil
 }
 
 // 关闭数据库连接
@@ -148,10 +311,11 @@ func initDatabase(db *sql.DB) error {
 	-- 创建时间: 2024-01-01
 	-- 描述: 存储X-UI服务的流量数据，包括入站流量和客户端流量
 
-	-- 1. 服务表 - 记录每个IP对应的X-UI服务
+	-- 1. 服务表 - 记录每个节点对应的X-UI服务，有节点标识时按节点标识区分，否则按IP区分
 	CREATE TABLE IF NOT EXISTS services (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		ip_address TEXT NOT NULL UNIQUE,
+		ip_address TEXT NOT NULL,
+		node_id TEXT,
 		custom_name TEXT,
 		first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -218,22 +382,433 @@ func initDatabase(db *sql.DB) error {
 		target_api_url TEXT NOT NULL DEFAULT ''
 	);
 
+	-- 7. 上报token表 - 每个token绑定一个服务，只保存哈希
+	CREATE TABLE IF NOT EXISTS ingest_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_id INTEGER NOT NULL,
+		name TEXT,
+		token_hash TEXT NOT NULL UNIQUE,
+		token_prefix TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+	);
+
+	-- 8. 服务IP历史表 - 记录节点使用过的IP
+	CREATE TABLE IF NOT EXISTS service_ip_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_id INTEGER NOT NULL,
+		ip_address TEXT NOT NULL,
+		first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE,
+		UNIQUE(service_id, ip_address)
+	);
+
+	-- 9. 原始上报数据归档表 - 用于排查和回放，按条数和时间限制大小
+	CREATE TABLE IF NOT EXISTS ingest_payloads (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		received_at TIMESTAMP NOT NULL,
+		client_ip TEXT NOT NULL DEFAULT '',
+		node_id TEXT,
+		service_id INTEGER,
+		user_agent TEXT,
+		headers TEXT,
+		body TEXT NOT NULL DEFAULT '',
+		format TEXT NOT NULL DEFAULT 'traffic',
+		body_size INTEGER NOT NULL DEFAULT 0,
+		outcome TEXT NOT NULL,
+		error TEXT
+	);
+
+	-- 10. 推送去重表 - 记录请求ID和内容指纹
+	CREATE TABLE IF NOT EXISTS ingest_dedup (
+		service_id INTEGER NOT NULL,
+		dedup_key TEXT NOT NULL,
+		received_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (service_id, dedup_key)
+	);
+
+
+	-- 11. 异常流量隔离表 - 超过阈值的单次上报样本，待人工确认后写入历史或丢弃
+	CREATE TABLE IF NOT EXISTS traffic_quarantine (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		record_key TEXT NOT NULL,
+		up INTEGER NOT NULL,
+		down INTEGER NOT NULL,
+		threshold INTEGER NOT NULL,
+		reason TEXT,
+		received_at TIMESTAMP NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		resolved_at TIMESTAMP,
+		FOREIGN KEY (service_id) REFERENCES services(id)
+	);
+
+	-- 12. Xray采集配置表
+	CREATE TABLE IF NOT EXISTS xray_config (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL DEFAULT '',
+		api_host TEXT NOT NULL DEFAULT '',
+		api_port TEXT NOT NULL DEFAULT ''
+	);
+
+	-- 13. 出站流量表 - 记录每个出站标签（direct、blocked、WARP等）
+	CREATE TABLE IF NOT EXISTS outbound_traffics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		custom_name TEXT,
+		last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		status TEXT DEFAULT 'active'
+	);
+
+	-- 14. 出站流量历史记录表 - 每日流量统计
+	CREATE TABLE IF NOT EXISTS outbound_traffic_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		outbound_traffic_id INTEGER NOT NULL,
+		service_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		date DATE NOT NULL,
+		daily_up BIGINT DEFAULT 0,
+		daily_down BIGINT DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (outbound_traffic_id) REFERENCES outbound_traffics(id) ON DELETE CASCADE,
+		FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE,
+		UNIQUE(outbound_traffic_id, date)
+	);
+
+	-- 15. 用户与入站关联表 - 同一用户可以属于多个入站，remote_inbound_id 为3x-ui中的入站ID
+	CREATE TABLE IF NOT EXISTS client_inbounds (
+		client_traffic_id INTEGER NOT NULL,
+		service_id INTEGER NOT NULL,
+		remote_inbound_id INTEGER NOT NULL,
+		first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (client_traffic_id, remote_inbound_id),
+		FOREIGN KEY (client_traffic_id) REFERENCES client_traffics(id) ON DELETE CASCADE
+	);
+
+	-- 16. 入站每小时流量表 - hour 为本地时间的整点（YYYY-MM-DD HH:00）
+	CREATE TABLE IF NOT EXISTS inbound_traffic_hourly (
+		inbound_traffic_id INTEGER NOT NULL,
+		service_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		hour TEXT NOT NULL,
+		up BIGINT DEFAULT 0,
+		down BIGINT DEFAULT 0,
+		PRIMARY KEY (inbound_traffic_id, hour),
+		FOREIGN KEY (inbound_traffic_id) REFERENCES inbound_traffics(id) ON DELETE CASCADE
+	);
+
+	-- 17. 用户每小时流量表
+	CREATE TABLE IF NOT EXISTS client_traffic_hourly (
+		client_traffic_id INTEGER NOT NULL,
+		service_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		hour TEXT NOT NULL,
+		up BIGINT DEFAULT 0,
+		down BIGINT DEFAULT 0,
+		PRIMARY KEY (client_traffic_id, hour),
+		FOREIGN KEY (client_traffic_id) REFERENCES client_traffics(id) ON DELETE CASCADE
+	);
+
+	-- 18. 用户当前在线设备数 - 每次上报在线信息时替换同一来源（如同一服务的某个hy2）的记录
+	CREATE TABLE IF NOT EXISTS client_online (
+		service_id INTEGER NOT NULL,
+		source TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL,
+		devices INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (service_id, source, email)
+	);
+
+	-- 19. 用户在线设备数采样（与每小时流量保留相同的时间）
+	CREATE TABLE IF NOT EXISTS client_online_samples (
+		service_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		devices INTEGER NOT NULL,
+		sampled_at TIMESTAMP NOT NULL,
+		UNIQUE(service_id, email, sampled_at)
+	);
+
+	-- 20. 用户每日同时在线设备数峰值
+	CREATE TABLE IF NOT EXISTS client_online_daily (
+		service_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		date TEXT NOT NULL,
+		peak_devices INTEGER NOT NULL DEFAULT 0,
+		peak_at TIMESTAMP,
+		PRIMARY KEY (service_id, email, date)
+	);
+
+	-- 21. hy2用户流量配额 - 每月 reset_day 日重置，lifted_period 为管理员解除限制的周期起始日期
+	CREATE TABLE IF NOT EXISTS hy2_quota_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		quota_bytes BIGINT NOT NULL,
+		reset_day INTEGER NOT NULL DEFAULT 1,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		lifted_period TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(service_id, email)
+	);
+
+	-- 22. 超出配额的踢下线记录 - 每条规则每个周期一条，持续踢下线时累加次数
+	CREATE TABLE IF NOT EXISTS hy2_quota_actions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rule_id INTEGER NOT NULL,
+		service_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		period_start TEXT NOT NULL,
+		used_bytes BIGINT NOT NULL DEFAULT 0,
+		quota_bytes BIGINT NOT NULL DEFAULT 0,
+		first_kick_at TIMESTAMP NOT NULL,
+		last_kick_at TIMESTAMP NOT NULL,
+		kick_count INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		lifted_at TIMESTAMP,
+		UNIQUE(rule_id, period_start)
+	);
+
+	-- 23. hy2累计流量游标 - source 为hy2服务端地址（host:port），只在流量写入成功后更新
+	CREATE TABLE IF NOT EXISTS hy2_counters (
+		source TEXT NOT NULL,
+		email TEXT NOT NULL,
+		tx BIGINT NOT NULL DEFAULT 0,
+		rx BIGINT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (source, email)
+	);
+
+	-- 24. 服务节点标识历史表 - 合并服务时未保留的节点标识，带该标识的推送仍写入合并后的服务
+	CREATE TABLE IF NOT EXISTS service_node_history (
+		node_id TEXT PRIMARY KEY,
+		service_id INTEGER NOT NULL,
+		first_seen TIMESTAMP,
+		last_seen TIMESTAMP,
+		FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+	);
+
+	-- 25. hy2转发待确认的推送 - 目标面板确认前原样重发（请求ID不变），确认后才保存其中的累计值游标
+	CREATE TABLE IF NOT EXISTS hy2_forward_pending (
+		source TEXT PRIMARY KEY,
+		request_id TEXT NOT NULL,
+		body TEXT NOT NULL,
+		counters TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+
+	-- 26. Xray累计流量游标 - source 为Xray API地址（host:port），name 为Xray计数器名称，只在流量写入成功后更新
+	CREATE TABLE IF NOT EXISTS xray_counters (
+		source TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value BIGINT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (source, name)
+	);
 
 	-- 创建索引
-	CREATE INDEX IF NOT EXISTS idx_services_ip ON services(ip_address);
 	CREATE INDEX IF NOT EXISTS idx_inbound_traffics_service_tag ON inbound_traffics(service_id, tag);
 	CREATE INDEX IF NOT EXISTS idx_client_traffics_service_email ON client_traffics(service_id, email);
 	CREATE INDEX IF NOT EXISTS idx_inbound_history_date ON inbound_traffic_history(date);
 	CREATE INDEX IF NOT EXISTS idx_client_history_date ON client_traffic_history(date);
+	CREATE INDEX IF NOT EXISTS idx_ingest_tokens_service ON ingest_tokens(service_id);
+	CREATE INDEX IF NOT EXISTS idx_ingest_payloads_received ON ingest_payloads(received_at);
+	CREATE INDEX IF NOT EXISTS idx_traffic_quarantine_status ON traffic_quarantine(status, service_id);
+	CREATE INDEX IF NOT EXISTS idx_outbound_traffics_service_tag ON outbound_traffics(service_id, tag);
+	CREATE INDEX IF NOT EXISTS idx_outbound_history_date ON outbound_traffic_history(date);
+	CREATE INDEX IF NOT EXISTS idx_client_inbounds_service ON client_inbounds(service_id, remote_inbound_id);
+	CREATE INDEX IF NOT EXISTS idx_inbound_hourly_hour ON inbound_traffic_hourly(hour);
+	CREATE INDEX IF NOT EXISTS idx_client_hourly_hour ON client_traffic_hourly(hour);
+	CREATE INDEX IF NOT EXISTS idx_client_online_samples_time ON client_online_samples(sampled_at);
 	`
 
 	// 执行SQL语句
-	_, err := db.Exec(schemaSQL)
+	if _, err := db.Exec(schemaSQL); err != nil {
+		return err
+	}
+
+	// 升级旧版本数据库
+	return migrateDatabase(db)
+}
+
+// 升级旧版本数据库表结构
+func migrateDatabase(db *sql.DB) error {
+	// 旧版本services表的ip_address带UNIQUE约束，需要重建表才能让多个节点共用一个IP
+	var servicesSQL string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'services'`).Scan(&servicesSQL); err != nil {
+		return err
+	}
+	if strings.Contains(servicesSQL, "ip_address TEXT NOT NULL UNIQUE") {
+		if err := rebuildServicesTable(db); err != nil {
+			return fmt.Errorf("重建服务表失败: %v", err)
+		}
+	}
+
+	// 旧版本client_online的主键不含来源，需要重建（当前在线状态，下次同步即可恢复）
+	var onlineSQL string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'client_online'`).Scan(&onlineSQL); err != nil {
+		return err
+	}
+	if !strings.Contains(onlineSQL, "source TEXT") {
+		if err := rebuildClientOnlineTable(db); err != nil {
+			return fmt.Errorf("重建在线用户表失败: %v", err)
+		}
+	}
+
+	if err := addColumnIfMissing(db, "hy2_config", "node_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "hy2_config", "sync_mode", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	for _, column := range []string{"source_api_url", "tls_ca", "tls_pin_sha256", "tls_client_cert", "tls_client_key", "name"} {
+		if err := addColumnIfMissing(db, "hy2_config", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	if err := addColumnIfMissing(db, "hy2_config", "inbound_tag", "TEXT NOT NULL DEFAULT '"+Hy2DefaultInboundTag+"'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "hy2_config", "enabled", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	for _, table := range []string{"hy2_config", "xray_config"} {
+		if err := addColumnIfMissing(db, table, "interval_seconds", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(db, table, "timeout_seconds", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	if err := migrateHy2SyncMode(db); err != nil {
+		return fmt.Errorf("迁移hy2同步方式失败: %v", err)
+	}
+	if err := addColumnIfMissing(db, "services", "dedup_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "services", "sample_threshold_bytes", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "inbound_traffics", "remote_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	for _, column := range clientPlanColumns {
+		if err := addColumnIfMissing(db, "client_traffics", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_services_ip ON services(ip_address);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_services_node_id ON services(node_id) WHERE node_id IS NOT NULL AND node_id != '';
+		CREATE INDEX IF NOT EXISTS idx_service_ip_history_service ON service_ip_history(service_id);
+	`)
 	return err
 }
 
+// 重建services表（去掉ip_address的UNIQUE约束并增加node_id列），保留原有ID
+func rebuildServicesTable(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE services_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ip_address TEXT NOT NULL,
+			node_id TEXT,
+			custom_name TEXT,
+			first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			status TEXT DEFAULT 'active'
+		);
+		INSERT INTO services_new (id, ip_address, custom_name, first_seen, last_seen, status)
+			SELECT id, ip_address, custom_name, first_seen, last_seen, status FROM services;
+		INSERT OR IGNORE INTO service_ip_history (service_id, ip_address, first_seen, last_seen)
+			SELECT id, ip_address, first_seen, last_seen FROM services;
+		DROP TABLE services;
+		ALTER TABLE services_new RENAME TO services;
+	`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 重建client_online表（主键增加source列），原有记录的来源为空
+func rebuildClientOnlineTable(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE client_online_new (
+			service_id INTEGER NOT NULL,
+			source TEXT NOT NULL DEFAULT '',
+			email TEXT NOT NULL,
+			devices INTEGER NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (service_id, source, email)
+		);
+		INSERT INTO client_online_new (service_id, email, devices, updated_at)
+			SELECT service_id, email, devices, updated_at FROM client_online;
+		DROP TABLE client_online;
+		ALTER TABLE client_online_new RENAME TO client_online;
+	`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 如果表中不存在该列则添加
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		return fmt.Errorf("添加列 %s.%s 失败: %v", table, column, err)
+	}
+	return nil
+}
+
 // 处理流量数据
-func (d *Database) ProcessTrafficData(clientIP string, userAgent string, requestBody string, trafficData *TrafficData) error {
+func (d *Database) ProcessTrafficData(src TrafficSource, requestBody string, trafficData *TrafficData) error {
+	// 负数流量一律拒绝，不能写入历史
+	if err := ValidateTrafficData(trafficData); err != nil {
+		return err
+	}
+
 	// 开始事务
 	tx, err := d.db.Begin()
 	if err != nil {
@@ -241,63 +816,318 @@ func (d *Database) ProcessTrafficData(clientIP string, userAgent string, request
 	}
 	defer tx.Rollback()
 
+	acc := newTrafficAccumulator()
+	err = d.applyTrafficData(tx, src, requestBody, trafficData, acc)
+	if err != nil && err != ErrDuplicatePush {
+		return err
+	}
+	if ferr := acc.flush(tx); ferr != nil {
+		return fmt.Errorf("写入流量历史失败: %v", ferr)
+	}
+
+	// 提交事务
+	if cerr := tx.Commit(); cerr != nil {
+		return cerr
+	}
+	d.rates.record(acc.observations)
+	return err
+}
+
+// 在事务中处理一次上报，流量增量累加到acc中，由调用方统一写入历史
+// 重复推送时只更新活跃时间和去重计数并返回ErrDuplicatePush
+func (d *Database) applyTrafficData(tx *sql.Tx, src TrafficSource, requestBody string, trafficData *TrafficData, acc *trafficAccumulator) error {
+	at := src.ReceivedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
 	// 1. 获取或创建服务记录
-	serviceID, err := d.getOrCreateService(tx, clientIP)
+	serviceID, err := d.resolveService(tx, src, at)
 	if err != nil {
 		return fmt.Errorf("获取或创建服务失败: %v", err)
 	}
 
+	// 重复推送（3x-ui重试、代理重发）只更新活跃时间和去重计数，不累加流量
+	if !src.Replay {
+		duplicate, err := d.checkDuplicatePush(tx, serviceID, src.RequestID, requestBody, trafficData.hasTraffic(), at)
+		if err != nil {
+			return fmt.Errorf("检测重复推送失败: %v", err)
+		}
+		if duplicate {
+			if err := d.updateServiceLastSeen(tx, serviceID, at); err != nil {
+				return fmt.Errorf("更新服务最后活跃时间失败: %v", err)
+			}
+			return ErrDuplicatePush
+		}
+	}
+
+	// 记录节点当前IP（IP变化时更新服务的当前IP并写入IP历史）
+	if !src.Replay {
+		err = d.updateServiceIP(tx, serviceID, src.ClientIP)
+		if err != nil {
+			return fmt.Errorf("更新服务IP失败: %v", err)
+		}
+	}
+
+	// 超过阈值的样本进入隔离区而不是历史
+	guard, err := d.newSampleGuard(tx, serviceID)
+	if err != nil {
+		return fmt.Errorf("读取异常流量阈值失败: %v", err)
+	}
+
 	// 2. 处理入站流量数据并记录有流量的端口
-	err = d.processInboundTraffics(tx, serviceID, trafficData.InboundTraffics)
+	err = d.processInboundTraffics(tx, guard, acc, serviceID, trafficData.InboundTraffics, at)
 	if err != nil {
 		return fmt.Errorf("处理入站流量失败: %v", err)
 	}
 
+	// 处理出站流量数据（direct、blocked、WARP等）
+	err = d.processOutboundTraffics(tx, guard, acc, serviceID, trafficData.InboundTraffics, at)
+	if err != nil {
+		return fmt.Errorf("处理出站流量失败: %v", err)
+	}
+
 	// 3. 处理客户端流量数据
-	err = d.processClientTraffics(tx, serviceID, trafficData.ClientTraffics)
+	err = d.processClientTraffics(tx, guard, acc, serviceID, trafficData.ClientTraffics, at)
 	if err != nil {
 		return fmt.Errorf("处理客户端流量失败: %v", err)
 	}
 
+	// 记录在线用户（hy2同步时附带）
+	if trafficData.OnlineUsers != nil {
+		if err := updateOnlineUsers(tx, serviceID, trafficData.Source, trafficData.OnlineUsers, at, !src.Replay); err != nil {
+			return fmt.Errorf("记录在线用户失败: %v", err)
+		}
+	}
+
+	// 根据本次上报推断3x-ui入站ID与入站标签的对应关系
+	if err := learnInboundRemoteIDs(tx, serviceID, trafficData); err != nil {
+		return fmt.Errorf("关联用户入站失败: %v", err)
+	}
+
 	// 4. 只要有数据包发来就更新节点最后活跃时间（包括心跳数据）
-	err = d.updateServiceLastSeen(tx, serviceID)
+	err = d.updateServiceLastSeen(tx, serviceID, at)
 	if err != nil {
 		return fmt.Errorf("更新服务最后活跃时间失败: %v", err)
 	}
 
-	// 提交事务
-	return tx.Commit()
+	// 回放的旧数据不参与实时速率计算
+	if !src.Replay {
+		acc.observe(serviceID, trafficData.Source, at)
+	}
+	return nil
 }
 
-// 获取或创建服务记录
-func (d *Database) getOrCreateService(tx *sql.Tx, ipAddress string) (int, error) {
+// 确定本次上报写入的服务：token绑定的服务优先，否则按IP查找或创建
+func (d *Database) resolveService(tx *sql.Tx, src TrafficSource, at time.Time) (int, error) {
+	if src.ServiceID > 0 {
+		var serviceID int
+		err := tx.QueryRow("SELECT id FROM services WHERE id = ?", src.ServiceID).Scan(&serviceID)
+		if err != nil {
+			return 0, fmt.Errorf("token绑定的服务不存在: %v", err)
+		}
+		return serviceID, nil
+	}
+	return d.getOrCreateService(tx, src.NodeID, src.ClientIP, at)
+}
+
+// 可执行单行查询的对象（*sql.DB 或 *sql.Tx）
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// 查找节点对应的服务，不存在时返回0
+func lookupService(q queryRower, nodeID string, ipAddress string) (int, error) {
 	var serviceID int
+	if nodeID != "" {
+		err := q.QueryRow("SELECT id FROM services WHERE node_id = ?", nodeID).Scan(&serviceID)
+		if err != sql.ErrNoRows {
+			return serviceID, err
+		}
+		// 合并服务时未保留的节点标识
+		err = q.QueryRow("SELECT service_id FROM service_node_history WHERE node_id = ?", nodeID).Scan(&serviceID)
+		if err != sql.ErrNoRows {
+			return serviceID, err
+		}
+		// 旧版本按IP创建的服务，首次带节点标识上报时由该节点接管
+		err = q.QueryRow(`
+			SELECT id FROM services WHERE ip_address = ? AND (node_id IS NULL OR node_id = '')
+			ORDER BY id LIMIT 1
+		`, ipAddress).Scan(&serviceID)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return serviceID, err
+	}
 
-	// 先尝试查找现有服务
-	err := tx.QueryRow("SELECT id FROM services WHERE ip_address = ?", ipAddress).Scan(&serviceID)
+	// 未带节点标识时优先匹配按IP区分的服务，其次匹配当前IP相同的节点
+	err := q.QueryRow(`
+		SELECT id FROM services WHERE ip_address = ?
+		ORDER BY CASE WHEN node_id IS NULL OR node_id = '' THEN 0 ELSE 1 END, last_seen DESC
+		LIMIT 1
+	`, ipAddress).Scan(&serviceID)
 	if err == sql.ErrNoRows {
-		now := time.Now()
-		result, err := tx.Exec(`
-			INSERT INTO services (ip_address, custom_name, first_seen, last_seen, status)
-			VALUES (?, ?, ?, ?, 'active')
-		`, ipAddress, "", now, now)
-		if err != nil {
-			return 0, err
-		}
-		serviceID64, err := result.LastInsertId()
-		if err != nil {
-			return 0, err
+		return 0, nil
+	}
+	return serviceID, err
+}
+
+// 获取或创建服务记录
+func (d *Database) getOrCreateService(tx *sql.Tx, nodeID string, ipAddress string, now time.Time) (int, error) {
+	// 先尝试查找现有服务
+	serviceID, err := lookupService(tx, nodeID, ipAddress)
+	if err != nil {
+		return 0, err
+	}
+	if serviceID > 0 {
+		if nodeID != "" {
+			_, err := tx.Exec(`UPDATE services SET node_id = ? WHERE id = ? AND (node_id IS NULL OR node_id = '')`, nodeID, serviceID)
+			if err != nil {
+				return 0, err
+			}
 		}
-		serviceID = int(serviceID64)
-	} else if err != nil {
+		return serviceID, nil
+	}
+
+	var nodeIDValue interface{}
+	if nodeID != "" {
+		nodeIDValue = nodeID
+	}
+	result, err := tx.Exec(`
+		INSERT INTO services (ip_address, node_id, custom_name, first_seen, last_seen, status)
+		VALUES (?, ?, ?, ?, ?, 'active')
+	`, ipAddress, nodeIDValue, "", now, now)
+	if err != nil {
 		return 0, err
 	}
+	serviceID64, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(serviceID64), nil
+}
+
+// 检测重复推送：带请求ID时按请求ID去重，否则按内容指纹在时间窗口内去重。
+// 没有流量的推送（空闲节点的心跳）内容总是相同，不按内容指纹去重
+func (d *Database) checkDuplicatePush(tx *sql.Tx, serviceID int, requestID string, requestBody string, hasTraffic bool, at time.Time) (bool, error) {
+	var key string
+	var since time.Time
+	if requestID != "" {
+		key = "req:" + requestID
+		since = at.Add(-requestIDRetention)
+	} else if d.dedupWindow > 0 && hasTraffic {
+		sum := sha256.Sum256([]byte(requestBody))
+		key = "sha:" + hex.EncodeToString(sum[:])
+		since = at.Add(-d.dedupWindow)
+	} else {
+		return false, nil
+	}
+
+	// 清理过期的去重记录
+	if _, err := tx.Exec(`DELETE FROM ingest_dedup WHERE service_id = ? AND received_at < ?`, serviceID, at.Add(-requestIDRetention)); err != nil {
+		return false, err
+	}
+
+	var count int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM ingest_dedup WHERE service_id = ? AND dedup_key = ? AND received_at >= ?
+	`, serviceID, key, since).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		_, err := tx.Exec(`UPDATE services SET dedup_count = dedup_count + 1 WHERE id = ?`, serviceID)
+		return true, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO ingest_dedup (service_id, dedup_key, received_at) VALUES (?, ?, ?)
+		ON CONFLICT(service_id, dedup_key) DO UPDATE SET received_at = excluded.received_at
+	`, serviceID, key, at)
+	return false, err
+}
+
+// 设置内容指纹去重的时间窗口，为0时只按请求ID去重
+func (d *Database) SetDedupWindow(window time.Duration) {
+	d.dedupWindow = window
+}
+
+// 更新服务当前IP并记录IP历史
+func (d *Database) updateServiceIP(tx *sql.Tx, serviceID int, ipAddress string) error {
+	if ipAddress == "" {
+		return nil
+	}
+	now := time.Now()
+	_, err := tx.Exec(`UPDATE services SET ip_address = ? WHERE id = ? AND ip_address != ?`, ipAddress, serviceID, ipAddress)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO service_ip_history (service_id, ip_address, first_seen, last_seen)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(service_id, ip_address) DO UPDATE SET last_seen = excluded.last_seen
+	`, serviceID, ipAddress, now, now)
+	return err
+}
+
+// 获取服务合并前使用过的节点标识
+func (d *Database) GetServiceNodeHistory(serviceID int) ([]map[string]interface{}, error) {
+	rows, err := d.db.Query(`
+		SELECT node_id, first_seen, last_seen
+		FROM service_node_history WHERE service_id = ?
+		ORDER BY last_seen DESC
+	`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return serviceID, nil
+	results := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var nodeID string
+		var firstSeen, lastSeen sql.NullTime
+		if err := rows.Scan(&nodeID, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		results = append(results, map[string]interface{}{
+			"node_id":    nodeID,
+			"first_seen": firstSeen.Time,
+			"last_seen":  lastSeen.Time,
+		})
+	}
+	return results, nil
+}
+
+// 获取服务使用过的IP
+func (d *Database) GetServiceIPHistory(serviceID int) ([]map[string]interface{}, error) {
+	rows, err := d.db.Query(`
+		SELECT ip_address, first_seen, last_seen
+		FROM service_ip_history WHERE service_id = ?
+		ORDER BY last_seen DESC
+	`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var ipAddress string
+		var firstSeen, lastSeen time.Time
+		if err := rows.Scan(&ipAddress, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		results = append(results, map[string]interface{}{
+			"ip":         ipAddress,
+			"first_seen": firstSeen,
+			"last_seen":  lastSeen,
+		})
+	}
+	return results, nil
 }
 
 // 处理入站流量数据
-func (d *Database) processInboundTraffics(tx *sql.Tx, serviceID int, inboundTraffics []InboundTraffic) error {
+func (d *Database) processInboundTraffics(tx *sql.Tx, guard *sampleGuard, acc *trafficAccumulator, serviceID int, inboundTraffics []InboundTraffic, at time.Time) error {
 	var activePorts []string
 	for _, traffic := range inboundTraffics {
 		if !traffic.IsInbound {
@@ -311,8 +1141,7 @@ func (d *Database) processInboundTraffics(tx *sql.Tx, serviceID int, inboundTraf
 		var recordID int
 		err := tx.QueryRow(`SELECT id FROM inbound_traffics WHERE service_id = ? AND tag = ?`, serviceID, traffic.Tag).Scan(&recordID)
 		if err == sql.ErrNoRows {
-			now := time.Now()
-			result, err := tx.Exec(`INSERT INTO inbound_traffics (service_id, tag, port, last_updated, status) VALUES (?, ?, ?, ?, 'active')`, serviceID, traffic.Tag, port, now)
+			result, err := tx.Exec(`INSERT INTO inbound_traffics (service_id, tag, port, last_updated, status) VALUES (?, ?, ?, ?, 'active')`, serviceID, traffic.Tag, port, at)
 			if err != nil {
 				return err
 			}
@@ -321,23 +1150,16 @@ func (d *Database) processInboundTraffics(tx *sql.Tx, serviceID int, inboundTraf
 		} else if err != nil {
 			return err
 		}
-		// upsert 到历史表，写入 date 用 localtime
+		// 累加到历史，异常样本进入隔离区
 		if traffic.Up > 0 || traffic.Down > 0 {
-			_, err := tx.Exec(`
-				INSERT INTO inbound_traffic_history (inbound_traffic_id, service_id, tag, date, daily_up, daily_down, created_at)
-				VALUES (?, ?, ?, DATE('now', 'localtime'), ?, ?, ?)
-				ON CONFLICT(inbound_traffic_id, date) DO UPDATE SET
-					daily_up = daily_up + excluded.daily_up,
-					daily_down = daily_down + excluded.daily_down
-			`, recordID, serviceID, traffic.Tag, traffic.Up, traffic.Down, time.Now())
+			quarantined, err := d.quarantineSample(tx, guard, inboundKind, recordID, serviceID, traffic.Tag, traffic.Up, traffic.Down, at)
 			if err != nil {
 				return err
 			}
-			// 新增：有流量时更新 last_updated
-			_, err = tx.Exec(`UPDATE inbound_traffics SET last_updated = ? WHERE id = ?`, time.Now(), recordID)
-			if err != nil {
-				return err
+			if quarantined {
+				continue
 			}
+			acc.add(inboundKind, recordID, serviceID, traffic.Tag, traffic.Up, traffic.Down, at)
 		}
 	}
 	if len(activePorts) > 0 {
@@ -346,14 +1168,46 @@ func (d *Database) processInboundTraffics(tx *sql.Tx, serviceID int, inboundTraf
 	return nil
 }
 
+// 处理出站流量数据（3x-ui上报的inboundTraffics中IsOutbound为true的条目）
+func (d *Database) processOutboundTraffics(tx *sql.Tx, guard *sampleGuard, acc *trafficAccumulator, serviceID int, traffics []InboundTraffic, at time.Time) error {
+	for _, traffic := range traffics {
+		if !traffic.IsOutbound {
+			continue
+		}
+		var recordID int
+		err := tx.QueryRow(`SELECT id FROM outbound_traffics WHERE service_id = ? AND tag = ?`, serviceID, traffic.Tag).Scan(&recordID)
+		if err == sql.ErrNoRows {
+			result, err := tx.Exec(`INSERT INTO outbound_traffics (service_id, tag, last_updated, status) VALUES (?, ?, ?, 'active')`, serviceID, traffic.Tag, at)
+			if err != nil {
+				return err
+			}
+			recordID64, _ := result.LastInsertId()
+			recordID = int(recordID64)
+		} else if err != nil {
+			return err
+		}
+		// 累加到历史，异常样本进入隔离区
+		if traffic.Up > 0 || traffic.Down > 0 {
+			quarantined, err := d.quarantineSample(tx, guard, outboundKind, recordID, serviceID, traffic.Tag, traffic.Up, traffic.Down, at)
+			if err != nil {
+				return err
+			}
+			if quarantined {
+				continue
+			}
+			acc.add(outboundKind, recordID, serviceID, traffic.Tag, traffic.Up, traffic.Down, at)
+		}
+	}
+	return nil
+}
+
 // 处理客户端流量数据
-func (d *Database) processClientTraffics(tx *sql.Tx, serviceID int, clientTraffics []ClientTraffic) error {
+func (d *Database) processClientTraffics(tx *sql.Tx, guard *sampleGuard, acc *trafficAccumulator, serviceID int, clientTraffics []ClientTraffic, at time.Time) error {
 	for _, traffic := range clientTraffics {
 		var recordID int
 		err := tx.QueryRow(`SELECT id FROM client_traffics WHERE service_id = ? AND email = ?`, serviceID, traffic.Email).Scan(&recordID)
 		if err == sql.ErrNoRows {
-			now := time.Now()
-			result, err := tx.Exec(`INSERT INTO client_traffics (service_id, email, last_updated, status) VALUES (?, ?, ?, 'active')`, serviceID, traffic.Email, now)
+			result, err := tx.Exec(`INSERT INTO client_traffics (service_id, email, last_updated, status) VALUES (?, ?, ?, 'active')`, serviceID, traffic.Email, at)
 			if err != nil {
 				return err
 			}
@@ -362,36 +1216,56 @@ func (d *Database) processClientTraffics(tx *sql.Tx, serviceID int, clientTraffi
 		} else if err != nil {
 			return err
 		}
-		// upsert 到历史表，写入 date 用 localtime
+		// 每次推送都同步用户的套餐信息（启用状态、到期时间、流量配额等）
+		if err := updateClientPlan(tx, recordID, traffic); err != nil {
+			return err
+		}
+		if err := linkClientInbound(tx, recordID, serviceID, traffic.InboundID, at); err != nil {
+			return err
+		}
+		// 累加到历史，异常样本进入隔离区
 		if traffic.Up > 0 || traffic.Down > 0 {
-			_, err := tx.Exec(`
-				INSERT INTO client_traffic_history (client_traffic_id, service_id, email, date, daily_up, daily_down, created_at)
-				VALUES (?, ?, ?, DATE('now', 'localtime'), ?, ?, ?)
-				ON CONFLICT(client_traffic_id, date) DO UPDATE SET
-					daily_up = daily_up + excluded.daily_up,
-					daily_down = daily_down + excluded.daily_down
-			`, recordID, serviceID, traffic.Email, traffic.Up, traffic.Down, time.Now())
+			quarantined, err := d.quarantineSample(tx, guard, clientKind, recordID, serviceID, traffic.Email, traffic.Up, traffic.Down, at)
 			if err != nil {
 				return err
 			}
-			// 新增：有流量时更新 last_updated
-			_, err = tx.Exec(`UPDATE client_traffics SET last_updated = ? WHERE id = ?`, time.Now(), recordID)
-			if err != nil {
-				return err
+			if quarantined {
+				continue
 			}
+			acc.add(clientKind, recordID, serviceID, traffic.Email, traffic.Up, traffic.Down, at)
 		}
 	}
 	return nil
 }
 
-// 更新服务最后活跃时间
-func (d *Database) updateServiceLastSeen(tx *sql.Tx, serviceID int) error {
-	now := time.Now()
+// 将一次上报的流量累加到记录的每日历史（hourly为true时同时写入每小时流量），写入 date 用接收时间的 localtime，并更新记录的 last_updated
+func addTrafficHistory(tx *sql.Tx, kind trafficKind, recordID int, serviceID int, key string, up int64, down int64, at time.Time, hourly bool) error {
+	_, err := tx.Exec(`
+		INSERT INTO `+kind.historyTable+` (`+kind.idColumn+`, service_id, `+kind.keyColumn+`, date, daily_up, daily_down, created_at)
+		VALUES (?, ?, ?, DATE(?, 'unixepoch', 'localtime'), ?, ?, ?)
+		ON CONFLICT(`+kind.idColumn+`, date) DO UPDATE SET
+			daily_up = daily_up + excluded.daily_up,
+			daily_down = daily_down + excluded.daily_down
+	`, recordID, serviceID, key, at.Unix(), up, down, at)
+	if err != nil {
+		return err
+	}
+	if hourly {
+		if err := addTrafficHourly(tx, kind, recordID, serviceID, key, up, down, at); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE `+kind.table+` SET last_updated = ? WHERE id = ? AND last_updated < ?`, at, recordID, at)
+	return err
+}
+
+// 更新服务最后活跃时间（回放旧数据时不会回退）
+func (d *Database) updateServiceLastSeen(tx *sql.Tx, serviceID int, at time.Time) error {
 	_, err := tx.Exec(`
 		UPDATE services 
 		SET last_seen = ? 
-		WHERE id = ?
-	`, now, serviceID)
+		WHERE id = ? AND (last_seen IS NULL OR last_seen < ?)
+	`, at, serviceID, at)
 	return err
 }
 
@@ -428,7 +1302,9 @@ func (d *Database) GetServiceSummary() ([]map[string]interface{}, error) {
 		SELECT
 			s.id,
 			s.ip_address,
+			s.node_id,
 			s.custom_name,
+			s.dedup_count,
 			s.last_seen,
 			CASE 
 				WHEN (strftime('%s', 'now') - strftime('%s', s.last_seen)) <= 30 THEN 'active'
@@ -461,24 +1337,27 @@ func (d *Database) GetServiceSummary() ([]map[string]interface{}, error) {
 	for rows.Next() {
 		var id int
 		var ipAddress, lastSeen, status string
-		var customName sql.NullString
+		var nodeID, customName sql.NullString
 		var inboundCount, clientCount int
-		var todayInboundUp, todayInboundDown int64
+		var dedupCount, todayInboundUp, todayInboundDown int64
 
-		err := rows.Scan(&id, &ipAddress, &customName, &lastSeen, &status, &inboundCount, &clientCount, &todayInboundUp, &todayInboundDown)
+		err := rows.Scan(&id, &ipAddress, &nodeID, &customName, &dedupCount, &lastSeen, &status, &inboundCount, &clientCount, &todayInboundUp, &todayInboundDown)
 		if err != nil {
 			return nil, err
 		}
 		result := map[string]interface{}{
 			"id":                 id,
 			"ip":                 ipAddress,
+			"node_id":            nodeID.String,
 			"custom_name":        customName.String,
 			"last_seen":          lastSeen,
 			"status":             status,
 			"inbound_count":      inboundCount,
 			"client_count":       clientCount,
+			"dedup_count":        dedupCount,
 			"today_inbound_up":   todayInboundUp,
 			"today_inbound_down": todayInboundDown,
+			"rate":               d.ServiceRate(id),
 		}
 		results = append(results, result)
 	}
@@ -490,16 +1369,17 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 	// 获取服务基本信息
 	var service Service
 	var rawIPAddress string
-	var customName sql.NullString
+	var nodeID, customName sql.NullString
 	err := d.db.QueryRow(`
-		SELECT id, ip_address, custom_name, first_seen, last_seen, status
+		SELECT id, ip_address, node_id, custom_name, first_seen, last_seen, status, dedup_count
 		FROM services WHERE id = ?
-	`, serviceID).Scan(&service.ID, &rawIPAddress, &customName,
-		&service.FirstSeen, &service.LastSeen, &service.Status)
+	`, serviceID).Scan(&service.ID, &rawIPAddress, &nodeID, &customName,
+		&service.FirstSeen, &service.LastSeen, &service.Status, &service.DedupCount)
 	if err != nil {
 		return nil, err
 	}
 	service.IPAddress = rawIPAddress
+	service.NodeID = nodeID.String
 
 	// 批量查询所有入站端口的今日流量
 	inboundTrafficMap := make(map[int]struct{ Up, Down int64 })
@@ -521,7 +1401,7 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 
 	// 获取入站流量（基础信息）
 	inboundRows, err := d.db.Query(`
-		SELECT id, service_id, tag, port, custom_name, last_updated, status
+		SELECT id, service_id, tag, port, custom_name, last_updated, status, remote_id
 		FROM inbound_traffics WHERE service_id = ? AND status = 'active'
 		ORDER BY tag
 	`, serviceID)
@@ -535,7 +1415,7 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 		var record InboundTrafficRecord
 		var customName sql.NullString
 		err := inboundRows.Scan(&record.ID, &record.ServiceID, &record.Tag, &record.Port, &customName,
-			&record.LastUpdated, &record.Status)
+			&record.LastUpdated, &record.Status, &record.RemoteID)
 		if err != nil {
 			return nil, err
 		}
@@ -548,6 +1428,7 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 			record.Up = 0
 			record.Down = 0
 		}
+		record.Rate = d.recordRate(serviceID, inboundKind, record.Tag)
 		inboundTraffics = append(inboundTraffics, record)
 	}
 
@@ -571,7 +1452,7 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 
 	// 获取客户端流量（基础信息）
 	clientRows, err := d.db.Query(`
-		SELECT id, service_id, email, custom_name, last_updated, status
+		SELECT id, service_id, email, custom_name, last_updated, status, `+clientPlanSelect+`
 		FROM client_traffics WHERE service_id = ? AND status = 'active'
 		ORDER BY email
 	`, serviceID)
@@ -584,7 +1465,8 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 	for clientRows.Next() {
 		var record ClientTrafficRecord
 		var customName sql.NullString
-		err := clientRows.Scan(&record.ID, &record.ServiceID, &record.Email, &customName, &record.LastUpdated, &record.Status)
+		dest := append([]interface{}{&record.ID, &record.ServiceID, &record.Email, &customName, &record.LastUpdated, &record.Status}, record.Plan.scanDest()...)
+		err := clientRows.Scan(dest...)
 		if err != nil {
 			return nil, err
 		}
@@ -597,13 +1479,30 @@ func (d *Database) GetServiceTraffic(serviceID int) (map[string]interface{}, err
 			record.Up = 0
 			record.Down = 0
 		}
+		record.Rate = d.recordRate(serviceID, clientKind, record.Email)
 		clientTraffics = append(clientTraffics, record)
 	}
+	// 套餐已用流量按服务一次查出
+	planUsage, err := d.clientPlanUsage("ct.service_id = ? AND ct.status = 'active'", serviceID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range clientTraffics {
+		fillClientPlanUsage(&clientTraffics[i].Plan, planUsage[clientTraffics[i].ID], now)
+	}
+
+	outboundTraffics, err := d.getOutboundTraffics(serviceID)
+	if err != nil {
+		return nil, err
+	}
 
 	result := map[string]interface{}{
-		"service":          service,
-		"inbound_traffics": inboundTraffics,
-		"client_traffics":  clientTraffics,
+		"service":           service,
+		"rate":              d.ServiceRate(serviceID),
+		"inbound_traffics":  inboundTraffics,
+		"client_traffics":   clientTraffics,
+		"outbound_traffics": outboundTraffics,
 	}
 	return result, nil
 }
@@ -624,26 +1523,96 @@ func (d *Database) DeleteService(serviceID int) error {
 		return fmt.Errorf("删除历史记录失败: %v", err)
 	}
 
+	// 删除每小时流量
+	for _, table := range []string{inboundKind.hourlyTable, clientKind.hourlyTable} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE service_id = ?", serviceID); err != nil {
+			return fmt.Errorf("删除每小时流量失败: %v", err)
+		}
+	}
+
+	// 删除在线记录
+	for _, table := range []string{"client_online", "client_online_samples", "client_online_daily"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE service_id = ?", serviceID); err != nil {
+			return fmt.Errorf("删除在线记录失败: %v", err)
+		}
+	}
+
+	// 删除hy2配额规则和踢下线记录
+	for _, table := range []string{"hy2_quota_rules", "hy2_quota_actions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE service_id = ?", serviceID); err != nil {
+			return fmt.Errorf("删除hy2配额失败: %v", err)
+		}
+	}
+
 	// 删除入站流量记录
 	_, err = tx.Exec("DELETE FROM inbound_traffics WHERE service_id = ?", serviceID)
 	if err != nil {
 		return fmt.Errorf("删除入站流量记录失败: %v", err)
 	}
 
+	// 删除用户与入站的关联
+	_, err = tx.Exec("DELETE FROM client_inbounds WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除用户入站关联失败: %v", err)
+	}
+
 	// 删除客户端流量记录
 	_, err = tx.Exec("DELETE FROM client_traffics WHERE service_id = ?", serviceID)
 	if err != nil {
 		return fmt.Errorf("删除客户端流量记录失败: %v", err)
 	}
 
+	// 删除出站流量历史和记录
+	_, err = tx.Exec("DELETE FROM outbound_traffic_history WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除出站流量历史失败: %v", err)
+	}
+	_, err = tx.Exec("DELETE FROM outbound_traffics WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除出站流量记录失败: %v", err)
+	}
+
+	// 删除上报token
+	_, err = tx.Exec("DELETE FROM ingest_tokens WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除上报token失败: %v", err)
+	}
+
+	// 删除IP历史和节点标识历史
+	_, err = tx.Exec("DELETE FROM service_ip_history WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除IP历史失败: %v", err)
+	}
+	_, err = tx.Exec("DELETE FROM service_node_history WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除节点标识历史失败: %v", err)
+	}
+
+	// 删除去重记录
+	_, err = tx.Exec("DELETE FROM ingest_dedup WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除去重记录失败: %v", err)
+	}
+
+	// 删除隔离区样本
+	_, err = tx.Exec("DELETE FROM traffic_quarantine WHERE service_id = ?", serviceID)
+	if err != nil {
+		return fmt.Errorf("删除隔离样本失败: %v", err)
+	}
+
 	// 删除服务记录
 	_, err = tx.Exec("DELETE FROM services WHERE id = ?", serviceID)
 	if err != nil {
 		return fmt.Errorf("删除服务记录失败: %v", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.rates.forget(serviceID)
+	d.thresholds.reset()
 	log.Printf("服务ID %d 删除成功", serviceID)
-	return tx.Commit()
+	return nil
 }
 
 // 通用：处理每日流量统计
@@ -718,6 +1687,45 @@ func (d *Database) DailyTrafficSummary() error {
 	return tx.Commit()
 }
 
+// 旧版本的hy2配置都推送到目标地址：目标为本机的改为直接写入，其他的保持转发
+func migrateHy2SyncMode(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, target_api_url FROM hy2_config WHERE sync_mode = ''`)
+	if err != nil {
+		return err
+	}
+	modes := map[int]string{}
+	for rows.Next() {
+		var id int
+		var target string
+		if err := rows.Scan(&id, &target); err != nil {
+			rows.Close()
+			return err
+		}
+		modes[id] = Hy2SyncForward
+		if u, err := url.Parse(target); target == "" || (err == nil && isLoopbackHost(u.Hostname())) {
+			modes[id] = Hy2SyncLocal
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, mode := range modes {
+		if _, err := db.Exec(`UPDATE hy2_config SET sync_mode = ? WHERE id = ?`, mode, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // 创建/更新hy2配置表（支持多条配置）
 func (d *Database) InitHy2ConfigTable() error {
 	sql := `
@@ -735,7 +1743,7 @@ func (d *Database) InitHy2ConfigTable() error {
 
 // 获取全部hy2配置
 func (d *Database) GetAllHy2Configs() ([]Hy2Config, error) {
-	rows, err := d.db.Query(`SELECT id, source_api_password, source_api_host, source_api_port, target_api_url FROM hy2_config`)
+	rows, err := d.db.Query(`SELECT id, node_id, source_api_password, source_api_host, source_api_port, target_api_url, sync_mode, interval_seconds, timeout_seconds, source_api_url, tls_ca, tls_pin_sha256, tls_client_cert, tls_client_key, name, inbound_tag, enabled FROM hy2_config`)
 	if err != nil {
 		return nil, err
 	}
@@ -743,7 +1751,8 @@ func (d *Database) GetAllHy2Configs() ([]Hy2Config, error) {
 	var configs []Hy2Config
 	for rows.Next() {
 		var cfg Hy2Config
-		err := rows.Scan(&cfg.ID, &cfg.SourceAPIPassword, &cfg.SourceAPIHost, &cfg.SourceAPIPort, &cfg.TargetAPIURL)
+		err := rows.Scan(&cfg.ID, &cfg.NodeID, &cfg.SourceAPIPassword, &cfg.SourceAPIHost, &cfg.SourceAPIPort, &cfg.TargetAPIURL, &cfg.SyncMode, &cfg.IntervalSeconds, &cfg.TimeoutSeconds,
+			&cfg.SourceAPIURL, &cfg.TLSCA, &cfg.TLSPinSHA256, &cfg.TLSClientCert, &cfg.TLSClientKey, &cfg.Name, &cfg.InboundTag, &cfg.Enabled)
 		if err != nil {
 			return nil, err
 		}
@@ -754,15 +1763,19 @@ func (d *Database) GetAllHy2Configs() ([]Hy2Config, error) {
 
 // 新增hy2配置
 func (d *Database) AddHy2Config(cfg *Hy2Config) error {
-	_, err := d.db.Exec(`INSERT INTO hy2_config (source_api_password, source_api_host, source_api_port, target_api_url) VALUES (?, ?, ?, ?)`,
-		cfg.SourceAPIPassword, cfg.SourceAPIHost, cfg.SourceAPIPort, cfg.TargetAPIURL)
+	_, err := d.db.Exec(`INSERT INTO hy2_config (node_id, source_api_password, source_api_host, source_api_port, target_api_url, sync_mode, interval_seconds, timeout_seconds,
+		source_api_url, tls_ca, tls_pin_sha256, tls_client_cert, tls_client_key, name, inbound_tag, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cfg.NodeID, cfg.SourceAPIPassword, cfg.SourceAPIHost, cfg.SourceAPIPort, cfg.TargetAPIURL, cfg.SyncMode, cfg.IntervalSeconds, cfg.TimeoutSeconds,
+		cfg.SourceAPIURL, cfg.TLSCA, cfg.TLSPinSHA256, cfg.TLSClientCert, cfg.TLSClientKey, cfg.Name, cfg.InboundTag, cfg.Enabled)
 	return err
 }
 
 // 更新hy2配置
 func (d *Database) UpdateHy2Config(cfg *Hy2Config) error {
-	_, err := d.db.Exec(`UPDATE hy2_config SET source_api_password=?, source_api_host=?, source_api_port=?, target_api_url=? WHERE id=?`,
-		cfg.SourceAPIPassword, cfg.SourceAPIHost, cfg.SourceAPIPort, cfg.TargetAPIURL, cfg.ID)
+	_, err := d.db.Exec(`UPDATE hy2_config SET node_id=?, source_api_password=?, source_api_host=?, source_api_port=?, target_api_url=?, sync_mode=?, interval_seconds=?, timeout_seconds=?,
+		source_api_url=?, tls_ca=?, tls_pin_sha256=?, tls_client_cert=?, tls_client_key=?, name=?, inbound_tag=?, enabled=? WHERE id=?`,
+		cfg.NodeID, cfg.SourceAPIPassword, cfg.SourceAPIHost, cfg.SourceAPIPort, cfg.TargetAPIURL, cfg.SyncMode, cfg.IntervalSeconds, cfg.TimeoutSeconds,
+		cfg.SourceAPIURL, cfg.TLSCA, cfg.TLSPinSHA256, cfg.TLSClientCert, cfg.TLSClientKey, cfg.Name, cfg.InboundTag, cfg.Enabled, cfg.ID)
 	return err
 }
 
@@ -777,3 +1790,55 @@ func (d *Database) DeleteAllHy2Configs() error {
 	_, err := d.db.Exec("DELETE FROM hy2_config")
 	return err
 }
+
+// 获取全部Xray采集配置
+func (d *Database) GetAllXrayConfigs() ([]XrayConfig, error) {
+	rows, err := d.db.Query(`SELECT id, node_id, api_host, api_port, interval_seconds, timeout_seconds FROM xray_config ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	configs := make([]XrayConfig, 0)
+	for rows.Next() {
+		var cfg XrayConfig
+		if err := rows.Scan(&cfg.ID, &cfg.NodeID, &cfg.APIHost, &cfg.APIPort, &cfg.IntervalSeconds, &cfg.TimeoutSeconds); err != nil {
+			return nil, err
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// 新增Xray采集配置
+func (d *Database) AddXrayConfig(cfg *XrayConfig) error {
+	result, err := d.db.Exec(`INSERT INTO xray_config (node_id, api_host, api_port, interval_seconds, timeout_seconds) VALUES (?, ?, ?, ?, ?)`,
+		cfg.NodeID, cfg.APIHost, cfg.APIPort, cfg.IntervalSeconds, cfg.TimeoutSeconds)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	cfg.ID = int(id)
+	return nil
+}
+
+// 更新Xray采集配置
+func (d *Database) UpdateXrayConfig(cfg *XrayConfig) error {
+	result, err := d.db.Exec(`UPDATE xray_config SET node_id=?, api_host=?, api_port=?, interval_seconds=?, timeout_seconds=? WHERE id=?`,
+		cfg.NodeID, cfg.APIHost, cfg.APIPort, cfg.IntervalSeconds, cfg.TimeoutSeconds, cfg.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// 删除Xray采集配置
+func (d *Database) DeleteXrayConfig(id int) error {
+	_, err := d.db.Exec(`DELETE FROM xray_config WHERE id=?`, id)
+	return err
+}
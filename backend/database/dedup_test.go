@@ -0,0 +1,78 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckDuplicatePush(t *testing.T) {
+	now := time.Now()
+	traffic := `{"inboundTraffics":[{"Tag":"in-1","Up":1}]}`
+	heartbeat := `{"inboundTraffics":[{"Tag":"in-1"}]}`
+	type push struct {
+		requestID  string
+		body       string
+		hasTraffic bool
+		at         time.Time
+	}
+	tests := []struct {
+		name   string
+		window time.Duration
+		first  push
+		second push
+		want   bool
+	}{
+		{name: "请求ID相同", window: 5 * time.Second, first: push{"r1", traffic, true, now}, second: push{"r1", heartbeat, false, now.Add(time.Hour)}, want: true},
+		{name: "请求ID不同内容相同", window: 5 * time.Second, first: push{"r1", traffic, true, now}, second: push{"r2", traffic, true, now}},
+		{name: "请求ID超过保留时间", window: 5 * time.Second, first: push{"r1", traffic, true, now}, second: push{"r1", traffic, true, now.Add(requestIDRetention + time.Second)}},
+		{name: "窗口内内容相同", window: 5 * time.Second, first: push{"", traffic, true, now}, second: push{"", traffic, true, now.Add(4 * time.Second)}, want: true},
+		{name: "超过窗口内容相同", window: 5 * time.Second, first: push{"", traffic, true, now}, second: push{"", traffic, true, now.Add(6 * time.Second)}},
+		{name: "没有流量的心跳不按内容去重", window: 5 * time.Second, first: push{"", heartbeat, false, now}, second: push{"", heartbeat, false, now.Add(time.Second)}},
+		{name: "未启用内容去重", first: push{"", traffic, true, now}, second: push{"", traffic, true, now}},
+		{name: "带请求ID的推送不参与内容去重", window: 5 * time.Second, first: push{"r1", traffic, true, now}, second: push{"", traffic, true, now}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			d.SetDedupWindow(tt.window)
+			serviceID := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 0, 0))
+
+			check := func(p push) bool {
+				tx, err := d.db.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer tx.Commit()
+				duplicate, err := d.checkDuplicatePush(tx, serviceID, p.requestID, p.body, p.hasTraffic, p.at)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return duplicate
+			}
+			if check(tt.first) {
+				t.Fatalf("第一次推送被当作重复推送")
+			}
+			if got := check(tt.second); got != tt.want {
+				t.Errorf("重复 = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 空闲节点连续发送的相同心跳都会更新活跃时间，也不计入重复次数
+func TestIdenticalHeartbeatsAreNotDuplicates(t *testing.T) {
+	d := openTestDatabase(t)
+	d.SetDedupWindow(time.Minute)
+	src := TrafficSource{ClientIP: "10.0.0.1"}
+	for i := 0; i < 3; i++ {
+		if err := d.ProcessTrafficData(src, `{}`, inboundData("in-1", 0, 0)); err != nil {
+			t.Fatalf("第%d次心跳: %v", i+1, err)
+		}
+	}
+	if err := d.ProcessTrafficData(src, `{"up":1}`, inboundData("in-1", 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ProcessTrafficData(src, `{"up":1}`, inboundData("in-1", 1, 0)); err != ErrDuplicatePush {
+		t.Errorf("窗口内相同的流量推送 err = %v, 期望 ErrDuplicatePush", err)
+	}
+}
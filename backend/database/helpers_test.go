@@ -0,0 +1,39 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 在临时目录中创建测试数据库
+func openTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	d, err := OpenDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("打开数据库失败: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// 以3x-ui推送的格式写入一次流量，返回写入的服务ID
+func pushTestTraffic(t *testing.T, d *Database, src TrafficSource, data *TrafficData) int {
+	t.Helper()
+	if src.ReceivedAt.IsZero() {
+		src.ReceivedAt = time.Now()
+	}
+	if err := d.ProcessTrafficData(src, "", data); err != nil {
+		t.Fatalf("写入流量失败: %v", err)
+	}
+	serviceID, err := lookupService(d.db, src.NodeID, src.ClientIP)
+	if err != nil || serviceID == 0 {
+		t.Fatalf("找不到写入的服务: %v", err)
+	}
+	return serviceID
+}
+
+// 入站流量
+func inboundData(tag string, up int64, down int64) *TrafficData {
+	return &TrafficData{InboundTraffics: []InboundTraffic{{IsInbound: true, Tag: tag, Up: up, Down: down}}}
+}
@@ -0,0 +1,336 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CSV导入参数或内容错误
+var ErrInvalidImport = errors.New("导入数据无效")
+
+// 单个CSV最多导入的行数
+const maxImportRows = 10000
+
+// CSV导入模式
+const (
+	ImportModeMerge   = "merge"   // 累加到已有的当日流量
+	ImportModeReplace = "replace" // 用文件中的值覆盖当日流量（文件中没有的日期不受影响）
+)
+
+// 导入文件中的一天
+type importRow struct {
+	date string
+	up   int64
+	down int64
+}
+
+// 导入前后某一天的对比
+type ImportDiff struct {
+	Date    string `json:"date"`
+	Action  string `json:"action"` // insert / update / unchanged
+	OldUp   int64  `json:"old_up"`
+	OldDown int64  `json:"old_down"`
+	NewUp   int64  `json:"new_up"`
+	NewDown int64  `json:"new_down"`
+}
+
+// 导入结果
+type ImportReport struct {
+	Mode      string       `json:"mode"`
+	DryRun    bool         `json:"dry_run"`
+	Rows      int          `json:"rows"`
+	Inserted  int          `json:"inserted"`
+	Updated   int          `json:"updated"`
+	Unchanged int          `json:"unchanged"`
+	Diff      []ImportDiff `json:"diff"`
+}
+
+// 解析历史CSV，支持两种格式：
+//
+//	下载的格式：日期,上传流量(Bytes),下载流量(Bytes),总流量(Bytes),...（其余列忽略）
+//	通用格式：  date,up,down[,total]（列名不区分大小写，顺序不限，也可以写 daily_up/daily_down）
+func parseHistoryCSV(data []byte) ([]importRow, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // Excel保存的UTF-8 BOM
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: 文件为空", ErrInvalidImport)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	dateCol, upCol, downCol, totalCol := -1, -1, -1, -1
+	if strings.TrimSpace(header[0]) == "日期" && len(header) >= 3 {
+		dateCol, upCol, downCol = 0, 1, 2
+		if len(header) >= 4 {
+			totalCol = 3
+		}
+	} else {
+		for i, name := range header {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "date":
+				dateCol = i
+			case "up", "daily_up":
+				upCol = i
+			case "down", "daily_down":
+				downCol = i
+			case "total", "total_daily":
+				totalCol = i
+			}
+		}
+	}
+	if dateCol < 0 || upCol < 0 || downCol < 0 {
+		return nil, fmt.Errorf("%w: 无法识别表头，应为下载的CSV格式或 date,up,down", ErrInvalidImport)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	seen := map[string]int{}
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: 第%d行: %v", ErrInvalidImport, line, err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		field := func(col int) string {
+			if col < len(record) {
+				return strings.TrimSpace(record[col])
+			}
+			return ""
+		}
+
+		date := field(dateCol)
+		// 下载的CSV中日期可能带有时间部分（如 2024-01-01T00:00:00Z）
+		if t, err := time.Parse(time.RFC3339, date); err == nil && len(date) > 10 {
+			date = t.Format("2006-01-02")
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("%w: 第%d行: 日期格式错误 %q，应为YYYY-MM-DD", ErrInvalidImport, line, date)
+		}
+		if date > today {
+			return nil, fmt.Errorf("%w: 第%d行: 日期 %s 晚于今天", ErrInvalidImport, line, date)
+		}
+		if prev, ok := seen[date]; ok {
+			return nil, fmt.Errorf("%w: 第%d行: 日期 %s 与第%d行重复", ErrInvalidImport, line, date, prev)
+		}
+		seen[date] = line
+
+		up, err := strconv.ParseInt(field(upCol), 10, 64)
+		if err != nil || up < 0 {
+			return nil, fmt.Errorf("%w: 第%d行: 上传流量必须为非负整数", ErrInvalidImport, line)
+		}
+		down, err := strconv.ParseInt(field(downCol), 10, 64)
+		if err != nil || down < 0 {
+			return nil, fmt.Errorf("%w: 第%d行: 下载流量必须为非负整数", ErrInvalidImport, line)
+		}
+		if totalCol >= 0 && field(totalCol) != "" {
+			total, err := strconv.ParseInt(field(totalCol), 10, 64)
+			if err != nil || total != up+down {
+				return nil, fmt.Errorf("%w: 第%d行: 总流量与上传、下载之和不一致", ErrInvalidImport, line)
+			}
+		}
+
+		rows = append(rows, importRow{date: date, up: up, down: down})
+		if len(rows) > maxImportRows {
+			return nil, fmt.Errorf("%w: 最多导入%d行", ErrInvalidImport, maxImportRows)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: 没有数据行", ErrInvalidImport)
+	}
+	return rows, nil
+}
+
+// 将CSV导入端口或用户的每日历史；dryRun为true时只返回对比结果，不写入。
+// 导入只影响每日历史，不会生成每小时流量
+func (d *Database) ImportHistoryCSV(kind trafficKind, serviceID int, key string, data []byte, mode string, dryRun bool) (*ImportReport, error) {
+	if mode == "" {
+		mode = ImportModeMerge
+	}
+	if mode != ImportModeMerge && mode != ImportModeReplace {
+		return nil, fmt.Errorf("%w: 不支持的导入模式 %s", ErrInvalidImport, mode)
+	}
+	rows, err := parseHistoryCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT id FROM services WHERE id = ?", serviceID).Scan(&exists); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: 服务不存在", ErrInvalidImport)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// 记录不存在时（恢复已删除的端口/用户）按导入创建
+	recordID := 0
+	err = tx.QueryRow("SELECT id FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", serviceID, key).Scan(&recordID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if recordID == 0 && !dryRun {
+		if recordID, err = d.ensureTrafficRecord(tx, kind, serviceID, key, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ImportReport{Mode: mode, DryRun: dryRun, Rows: len(rows), Diff: make([]ImportDiff, 0, len(rows))}
+	for _, row := range rows {
+		diff := ImportDiff{Date: row.date}
+		found := false
+		if recordID > 0 {
+			err := tx.QueryRow("SELECT daily_up, daily_down FROM "+kind.historyTable+" WHERE "+kind.idColumn+" = ? AND date = ?",
+				recordID, row.date).Scan(&diff.OldUp, &diff.OldDown)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			found = err == nil
+		}
+		diff.NewUp, diff.NewDown = row.up, row.down
+		if mode == ImportModeMerge {
+			diff.NewUp, diff.NewDown = diff.OldUp+row.up, diff.OldDown+row.down
+		}
+		switch {
+		case !found:
+			diff.Action = "insert"
+			report.Inserted++
+		case diff.NewUp == diff.OldUp && diff.NewDown == diff.OldDown:
+			diff.Action = "unchanged"
+			report.Unchanged++
+		default:
+			diff.Action = "update"
+			report.Updated++
+		}
+		report.Diff = append(report.Diff, diff)
+
+		if dryRun || diff.Action == "unchanged" {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO `+kind.historyTable+` (`+kind.idColumn+`, service_id, `+kind.keyColumn+`, date, daily_up, daily_down, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(`+kind.idColumn+`, date) DO UPDATE SET
+				daily_up = excluded.daily_up,
+				daily_down = excluded.daily_down
+		`, recordID, serviceID, key, row.date, diff.NewUp, diff.NewDown, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.thresholds.reset()
+	return report, nil
+}
+
+// 读取上传的CSV：multipart表单的file字段，或直接作为请求体
+func readImportFile(c *gin.Context) ([]byte, error) {
+	const maxSize = 5 << 20
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("缺少file字段: %v", err)
+		}
+		if fileHeader.Size > maxSize {
+			return nil, fmt.Errorf("文件不能超过5MB")
+		}
+		f, err := fileHeader.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("文件不能超过5MB")
+	}
+	return data, nil
+}
+
+func (api *DatabaseAPI) importHistory(c *gin.Context, kind trafficKind, key string) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	data, err := readImportFile(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "读取CSV失败: " + err.Error(),
+		})
+		return
+	}
+	// 默认只预览，commit=true 时才写入
+	dryRun := c.Query("commit") != "true"
+
+	report, err := api.db.ImportHistoryCSV(kind, serviceID, key, data, c.Query("mode"), dryRun)
+	if errors.Is(err, ErrInvalidImport) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "导入历史数据失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "导入预览成功，确认无误后加上 commit=true 写入"
+	if !dryRun {
+		message = "历史数据导入成功"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": message,
+		"data":    report,
+	})
+}
+
+// 导入端口历史数据
+func (api *DatabaseAPI) ImportPortHistory(c *gin.Context) {
+	api.importHistory(c, inboundKind, c.Param("tag"))
+}
+
+// 导入用户历史数据
+func (api *DatabaseAPI) ImportUserHistory(c *gin.Context) {
+	api.importHistory(c, clientKind, c.Param("email"))
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []importRow
+		wantErr string // 错误信息中应包含的内容，为空表示应解析成功
+	}{
+		{
+			name: "下载的格式",
+			csv:  "日期,上传流量(Bytes),下载流量(Bytes),总流量(Bytes),上传流量,下载流量\n2024-01-01,100,200,300,100 B,200 B\n2024-01-02,1,2,3,1 B,2 B\n",
+			want: []importRow{{date: "2024-01-01", up: 100, down: 200}, {date: "2024-01-02", up: 1, down: 2}},
+		},
+		{
+			name: "带BOM和带时间的日期",
+			csv:  "\xef\xbb\xbf日期,上传流量(Bytes),下载流量(Bytes)\n2024-01-01T00:00:00Z,5,6\n",
+			want: []importRow{{date: "2024-01-01", up: 5, down: 6}},
+		},
+		{
+			name: "通用格式，列顺序不限",
+			csv:  "Down, Date, UP\n20,2024-02-01,10\n",
+			want: []importRow{{date: "2024-02-01", up: 10, down: 20}},
+		},
+		{
+			name: "daily列名和空行",
+			csv:  "date,daily_up,daily_down,total_daily\n2024-03-01,1,1,2\n\n2024-03-02,0,0,\n",
+			want: []importRow{{date: "2024-03-01", up: 1, down: 1}, {date: "2024-03-02"}},
+		},
+		{name: "空文件", csv: "", wantErr: "文件为空"},
+		{name: "无法识别表头", csv: "day,rx,tx\n2024-01-01,1,2\n", wantErr: "无法识别表头"},
+		{name: "没有数据行", csv: "date,up,down\n", wantErr: "没有数据行"},
+		{name: "日期格式错误", csv: "date,up,down\n01/02/2024,1,2\n", wantErr: "第2行: 日期格式错误"},
+		{name: "日期晚于今天", csv: "date,up,down\n2999-01-01,1,2\n", wantErr: "晚于今天"},
+		{name: "日期重复", csv: "date,up,down\n2024-01-01,1,2\n2024-01-01,3,4\n", wantErr: "第3行: 日期 2024-01-01 与第2行重复"},
+		{name: "负数流量", csv: "date,up,down\n2024-01-01,-1,2\n", wantErr: "上传流量必须为非负整数"},
+		{name: "下载不是整数", csv: "date,up,down\n2024-01-01,1,2.5\n", wantErr: "下载流量必须为非负整数"},
+		{name: "总流量不一致", csv: "date,up,down,total\n2024-01-01,1,2,4\n", wantErr: "总流量与上传、下载之和不一致"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseHistoryCSV([]byte(tt.csv))
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidImport) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, 期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("结果 = %+v, 期望 %+v", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHistoryCSVTooManyRows(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("date,up,down\n")
+	start := time.Date(1990, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i <= maxImportRows; i++ {
+		b.WriteString(start.AddDate(0, 0, i).Format("2006-01-02") + ",1,1\n")
+	}
+	if _, err := parseHistoryCSV([]byte(b.String())); err == nil || !strings.Contains(err.Error(), "最多导入") {
+		t.Errorf("err = %v, 期望超过行数限制", err)
+	}
+}
@@ -0,0 +1,263 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 每小时流量默认保留7天
+const defaultHourlyRetention = 7 * 24 * time.Hour
+
+// 每小时流量查询最多跨越的时间
+const maxHourlyRange = 31 * 24 * time.Hour
+
+const hourLayout = "2006-01-02 15:00"
+
+// 每小时流量序列中的一个点
+type HourlyPoint struct {
+	Hour  string `json:"hour"` // 本地时间整点，YYYY-MM-DD HH:00
+	Up    int64  `json:"up"`
+	Down  int64  `json:"down"`
+	Total int64  `json:"total"`
+}
+
+// 设置每小时流量的保留时间
+func (d *Database) SetHourlyRetention(retention time.Duration) {
+	if retention <= 0 {
+		retention = defaultHourlyRetention
+	}
+	d.hourlyRetention = retention
+}
+
+func (d *Database) hourlyRetentionOrDefault() time.Duration {
+	if d.hourlyRetention <= 0 {
+		return defaultHourlyRetention
+	}
+	return d.hourlyRetention
+}
+
+// 将一次上报的流量累加到记录的每小时流量（与每日历史在同一事务中写入）
+func addTrafficHourly(tx *sql.Tx, kind trafficKind, recordID int, serviceID int, key string, up int64, down int64, at time.Time) error {
+	if kind.hourlyTable == "" {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO `+kind.hourlyTable+` (`+kind.idColumn+`, service_id, `+kind.keyColumn+`, hour, up, down)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(`+kind.idColumn+`, hour) DO UPDATE SET
+			up = up + excluded.up,
+			down = down + excluded.down
+	`, recordID, serviceID, key, at.Local().Format(hourLayout), up, down)
+	return err
+}
+
+// 删除超过保留时间的每小时流量，返回删除的行数
+func (d *Database) PruneHourlyTraffic() (int64, error) {
+	cutoff := truncateHour(time.Now().Add(-d.hourlyRetentionOrDefault())).Format(hourLayout)
+	var total int64
+	for _, kind := range []trafficKind{inboundKind, clientKind} {
+		result, err := d.db.Exec(`DELETE FROM `+kind.hourlyTable+` WHERE hour < ?`, cutoff)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// 合并服务或迁移历史时，把一条记录在日期范围内的每小时流量累加到另一条记录；日期为空表示不限
+func moveHourly(tx *sql.Tx, kind trafficKind, fromRecordID int, toRecordID int, toServiceID int, key string, startDate string, endDate string) error {
+	if kind.hourlyTable == "" {
+		return nil
+	}
+	where := kind.idColumn + " = ?"
+	args := []interface{}{fromRecordID}
+	if startDate != "" {
+		where += " AND hour >= ?"
+		args = append(args, startDate)
+	}
+	if endDate != "" {
+		where += " AND hour <= ?"
+		args = append(args, endDate+" 23:00")
+	}
+
+	insertArgs := append([]interface{}{toRecordID, toServiceID, key}, args...)
+	_, err := tx.Exec(`
+		INSERT INTO `+kind.hourlyTable+` (`+kind.idColumn+`, service_id, `+kind.keyColumn+`, hour, up, down)
+		SELECT ?, ?, ?, hour, up, down FROM `+kind.hourlyTable+` WHERE `+where+`
+		ON CONFLICT(`+kind.idColumn+`, hour) DO UPDATE SET
+			up = up + excluded.up,
+			down = down + excluded.down
+	`, insertArgs...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM "+kind.hourlyTable+" WHERE "+where, args...)
+	return err
+}
+
+// 取本地时间的整点（Truncate按UTC计算，不适用于非整点时区）
+func truncateHour(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+}
+
+// 查询记录在[start, end]范围内的每小时流量，没有数据的小时补0
+func (d *Database) GetHourlySeries(kind trafficKind, serviceID int, key string, start time.Time, end time.Time) ([]HourlyPoint, error) {
+	var recordID int
+	err := d.db.QueryRow("SELECT id FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", serviceID, key).Scan(&recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end = truncateHour(start), truncateHour(end)
+	rows, err := d.db.Query(`
+		SELECT hour, up, down FROM `+kind.hourlyTable+`
+		WHERE `+kind.idColumn+` = ? AND hour >= ? AND hour <= ?
+	`, recordID, start.Format(hourLayout), end.Format(hourLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string][2]int64)
+	for rows.Next() {
+		var hour string
+		var up, down int64
+		if err := rows.Scan(&hour, &up, &down); err != nil {
+			return nil, err
+		}
+		values[hour] = [2]int64{up, down}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	points := make([]HourlyPoint, 0)
+	for t := start; !t.After(end); t = t.Add(time.Hour) {
+		hour := t.Format(hourLayout)
+		v := values[hour]
+		points = append(points, HourlyPoint{Hour: hour, Up: v[0], Down: v[1], Total: v[0] + v[1]})
+	}
+	return points, nil
+}
+
+// 解析查询范围：start/end 支持 "YYYY-MM-DD HH:00" 或 "YYYY-MM-DD"，也可以只传 hours 表示最近若干小时（默认24）
+func parseHourlyRange(c *gin.Context) (time.Time, time.Time, error) {
+	parse := func(value string, endOfDay bool) (time.Time, error) {
+		if t, err := time.ParseInLocation(hourLayout, value, time.Local); err == nil {
+			return t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return t, fmt.Errorf("时间格式错误: %s", value)
+		}
+		if endOfDay {
+			t = t.Add(23 * time.Hour)
+		}
+		return t, nil
+	}
+
+	end := time.Now()
+	if v := c.Query("end"); v != "" {
+		t, err := parse(v, true)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end = t
+	}
+	hours := 24
+	if v := c.Query("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("hours 必须为正整数")
+		}
+		hours = n
+	}
+	start := end.Add(-time.Duration(hours-1) * time.Hour)
+	if v := c.Query("start"); v != "" {
+		t, err := parse(v, false)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = t
+	}
+	if start.After(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("开始时间晚于结束时间")
+	}
+	if end.Sub(start) > maxHourlyRange {
+		return time.Time{}, time.Time{}, fmt.Errorf("查询范围不能超过%d天", int(maxHourlyRange.Hours()/24))
+	}
+	return start, end, nil
+}
+
+func (api *DatabaseAPI) respondHourly(c *gin.Context, kind trafficKind, key string) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	start, end, err := parseHourlyRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	points, err := api.db.GetHourlySeries(kind, serviceID, key, start, end)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "记录不存在",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询每小时流量失败: " + err.Error(),
+		})
+		return
+	}
+
+	// 峰值小时
+	var peak *HourlyPoint
+	for i := range points {
+		if points[i].Total > 0 && (peak == nil || points[i].Total > peak.Total) {
+			peak = &points[i]
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取每小时流量成功",
+		"data": gin.H{
+			"start":          truncateHour(start).Format(hourLayout),
+			"end":            truncateHour(end).Format(hourLayout),
+			"retention_days": int(api.db.hourlyRetentionOrDefault().Hours() / 24),
+			"hourly":         points,
+			"peak":           peak,
+		},
+	})
+}
+
+// 获取端口的每小时流量
+func (api *DatabaseAPI) GetPortHourly(c *gin.Context) {
+	api.respondHourly(c, inboundKind, c.Param("tag"))
+}
+
+// 获取用户的每小时流量
+func (api *DatabaseAPI) GetUserHourly(c *gin.Context) {
+	api.respondHourly(c, clientKind, c.Param("email"))
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetHourlySeries(t *testing.T) {
+	d := openTestDatabase(t)
+	base := truncateHour(time.Now()).Add(-5 * time.Hour)
+	var serviceID int
+	for _, push := range []struct {
+		offset time.Duration
+		up     int64
+	}{
+		{0, 10},
+		{20 * time.Minute, 5}, // 同一小时内累加
+		{2*time.Hour + 59*time.Minute, 7},
+		{4 * time.Hour, 1},
+	} {
+		serviceID = pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: base.Add(push.offset)}, inboundData("in-1", push.up, 1))
+	}
+	// 只有日期的补录数据不写入每小时流量
+	batch, err := ParseIngestBatch([]byte(`{"records":[{"kind":"inbound","key":"in-1","up":1000,"date":"`+base.Format("2006-01-02")+`"}]}`), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.IngestBatch(TrafficSource{ClientIP: "10.0.0.1"}, "", batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// 查询范围不在整点时按所在的小时计算
+	points, err := d.GetHourlySeries(inboundKind, serviceID, "in-1", base.Add(-time.Hour+30*time.Minute), base.Add(4*time.Hour+10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantUp := []int64{0, 15, 0, 7, 0, 1}
+	if len(points) != len(wantUp) {
+		t.Fatalf("返回 %d 个点, 期望 %d", len(points), len(wantUp))
+	}
+	for i, p := range points {
+		if wantHour := base.Add(time.Duration(i-1) * time.Hour).Format(hourLayout); p.Hour != wantHour {
+			t.Errorf("第%d个点 = %s, 期望 %s", i, p.Hour, wantHour)
+		}
+		if p.Up != wantUp[i] || p.Total != p.Up+p.Down {
+			t.Errorf("%s: 上传 = %d, 合计 = %d, 期望上传 %d", p.Hour, p.Up, p.Total, wantUp[i])
+		}
+	}
+
+	if _, err := d.GetHourlySeries(inboundKind, serviceID, "missing", base, base); err == nil {
+		t.Errorf("不存在的入站应返回错误")
+	}
+}
+
+func TestPruneHourlyTraffic(t *testing.T) {
+	d := openTestDatabase(t)
+	d.SetHourlyRetention(48 * time.Hour)
+	now := time.Now()
+	for _, at := range []time.Time{now.Add(-72 * time.Hour), now.Add(-50 * time.Hour), now.Add(-47 * time.Hour), now} {
+		pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: at}, &TrafficData{
+			InboundTraffics: []InboundTraffic{{IsInbound: true, Tag: "in-1", Up: 1}},
+			ClientTraffics:  []ClientTraffic{{Email: "a@b", Up: 1}},
+		})
+	}
+	n, err := d.PruneHourlyTraffic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("删除 %d 行, 期望 4（入站和用户各2行）", n)
+	}
+	var left int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM inbound_traffic_hourly").Scan(&left); err != nil || left != 2 {
+		t.Errorf("剩余 %d 行 (%v), 期望 2", left, err)
+	}
+	// 每日历史不受影响
+	var days int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM inbound_traffic_history").Scan(&days); err != nil || days < 3 {
+		t.Errorf("每日历史剩余 %d 行 (%v)", days, err)
+	}
+}
+
+func TestParseHourlyRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	local := func(s string) time.Time {
+		v, err := time.ParseInLocation(hourLayout, s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name      string
+		query     string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   string
+	}{
+		{name: "整点范围", query: "start=2024-06-01 10:00&end=2024-06-01 20:00", wantStart: local("2024-06-01 10:00"), wantEnd: local("2024-06-01 20:00")},
+		{name: "日期范围包含结束日的全天", query: "start=2024-06-01&end=2024-06-02", wantStart: local("2024-06-01 00:00"), wantEnd: local("2024-06-02 23:00")},
+		{name: "结束时间加小时数", query: "end=2024-06-01 10:00&hours=3", wantStart: local("2024-06-01 08:00"), wantEnd: local("2024-06-01 10:00")},
+		{name: "开始晚于结束", query: "start=2024-06-02&end=2024-06-01", wantErr: "开始时间晚于结束时间"},
+		{name: "超过最大范围", query: "start=2024-01-01&end=2024-06-01", wantErr: "查询范围不能超过31天"},
+		{name: "小时数无效", query: "hours=0", wantErr: "hours 必须为正整数"},
+		{name: "时间格式错误", query: "start=yesterday", wantErr: "时间格式错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/?"+strings.ReplaceAll(tt.query, " ", "%20"), nil)
+			start, end, err := parseHourlyRange(c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, 期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("范围 = %v ~ %v, 期望 %v ~ %v", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
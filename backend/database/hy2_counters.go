@@ -0,0 +1,248 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hy2 /traffic 返回的单个用户的累计流量
+type Hy2Counter struct {
+	Tx int64 `json:"tx"`
+	Rx int64 `json:"rx"`
+}
+
+// 计数器游标的键：批量保存会重建hy2配置（ID变化），所以按hy2服务端地址区分；
+// 地址带路径时（同一反向代理后的多个hy2）加上路径
+func Hy2CounterSource(cfg *Hy2Config) string {
+	source := net.JoinHostPort(cfg.SourceAPIHost, cfg.SourceAPIPort)
+	if u, err := url.Parse(cfg.SourceAPIURL); err == nil && strings.Trim(u.Path, "/") != "" {
+		source += "/" + strings.Trim(u.Path, "/")
+	}
+	return source
+}
+
+// 根据上次保存的累计值计算增量。来源还没有游标（首次读取）时只记录基准，增量为0，
+// 不把hy2启动以来的累计值算作当天的流量（否则会触发异常流量隔离和配额踢下线）。
+// 以下情况说明hy2重启过（或被其他程序清零），此时增量为当前值：
+//   - 计数器变小
+//   - 上次读取时存在的用户这次不见了（hy2只在重启或清零时移除用户的计数器）
+//
+// hy2的统计API不提供启动时间，重启后上次的所有用户都在两次同步之间重新上线、
+// 且流量都超过了上次的累计值时无法识别，这段时间的流量会少计
+func hy2Deltas(q queryRower, source string, counters map[string]Hy2Counter) (map[string]Hy2Counter, error) {
+	// 上次保存游标时读到的用户：更新时间为最近一次保存时间的游标
+	var lastAt sql.NullTime
+	var lastUsers int
+	err := q.QueryRow(`
+		SELECT updated_at, COUNT(email) FROM hy2_counters
+		WHERE source = ? AND updated_at = (SELECT MAX(updated_at) FROM hy2_counters WHERE source = ?)
+		GROUP BY updated_at
+	`, source, source).Scan(&lastAt, &lastUsers)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	for user, cur := range counters {
+		if cur.Tx < 0 || cur.Rx < 0 {
+			return nil, fmt.Errorf("%w: hy2用户 %s 的流量为负数", ErrInvalidTrafficData, user)
+		}
+	}
+	if !lastAt.Valid {
+		deltas := make(map[string]Hy2Counter, len(counters))
+		for user := range counters {
+			deltas[user] = Hy2Counter{}
+		}
+		return deltas, nil
+	}
+
+	lasts := make(map[string]Hy2Counter, len(counters))
+	seen := 0
+	for user := range counters {
+		var last Hy2Counter
+		var updatedAt time.Time
+		err := q.QueryRow(`SELECT tx, rx, updated_at FROM hy2_counters WHERE source = ? AND email = ?`, source, user).Scan(&last.Tx, &last.Rx, &updatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if updatedAt.Equal(lastAt.Time) {
+			seen++
+		}
+		lasts[user] = last
+	}
+	restarted := seen < lastUsers
+
+	deltas := make(map[string]Hy2Counter, len(counters))
+	for user, cur := range counters {
+		last := lasts[user]
+		if restarted || cur.Tx < last.Tx || cur.Rx < last.Rx {
+			deltas[user] = cur
+			continue
+		}
+		deltas[user] = Hy2Counter{Tx: cur.Tx - last.Tx, Rx: cur.Rx - last.Rx}
+	}
+	return deltas, nil
+}
+
+// 保存本次读取的累计值，作为下次计算增量的起点
+func saveHy2Counters(tx *sql.Tx, source string, counters map[string]Hy2Counter, at time.Time) error {
+	for user, cur := range counters {
+		_, err := tx.Exec(`
+			INSERT INTO hy2_counters (source, email, tx, rx, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(source, email) DO UPDATE SET tx = excluded.tx, rx = excluded.rx, updated_at = excluded.updated_at
+		`, source, user, cur.Tx, cur.Rx, at)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将hy2用户的增量转换为上报格式：每个用户作为一个用户，入站tag为所有用户的合计
+func NewHy2TrafficData(deltas map[string]Hy2Counter, tag string) *TrafficData {
+	users := make([]string, 0, len(deltas))
+	for user := range deltas {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	data := &TrafficData{ClientTraffics: make([]ClientTraffic, 0, len(users))}
+	var totalTx, totalRx int64
+	for _, user := range users {
+		delta := deltas[user]
+		totalTx += delta.Tx
+		totalRx += delta.Rx
+		data.ClientTraffics = append(data.ClientTraffics, ClientTraffic{Email: user, Enable: true, Up: delta.Tx, Down: delta.Rx})
+	}
+	data.InboundTraffics = []InboundTraffic{{IsInbound: true, Tag: tag, Up: totalTx, Down: totalRx}}
+	data.Source = tag
+	return data
+}
+
+// 计算hy2累计值相对游标的增量（转发模式使用，目标面板确认后调用 CompleteHy2Forward 保存游标）
+func (d *Database) Hy2Deltas(source string, counters map[string]Hy2Counter) (map[string]Hy2Counter, error) {
+	return hy2Deltas(d.db, source, counters)
+}
+
+// 转发模式下已生成、尚未被目标面板确认的推送。
+// 推送可能已被目标面板写入但响应超时，所以确认前原样重发同一个请求体和请求ID，由目标面板按请求ID去重，
+// 不能用新的累计值重新计算增量（新的请求ID会让目标面板把重叠的流量再记一次，相同的请求ID又会丢掉新增的流量）
+type Hy2PendingForward struct {
+	RequestID string
+	Body      []byte
+	// 生成推送时读取的累计值，目标面板确认后作为新的游标
+	Counters  map[string]Hy2Counter
+	CreatedAt time.Time
+}
+
+// 读取来源待确认的推送，没有时返回nil
+func (d *Database) Hy2PendingForward(source string) (*Hy2PendingForward, error) {
+	var p Hy2PendingForward
+	var body, counters string
+	err := d.db.QueryRow(`SELECT request_id, body, counters, created_at FROM hy2_forward_pending WHERE source = ?`, source).Scan(&p.RequestID, &body, &counters, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(counters), &p.Counters); err != nil {
+		return nil, fmt.Errorf("解析待确认推送的累计值失败: %v", err)
+	}
+	p.Body = []byte(body)
+	return &p, nil
+}
+
+// 在发送前保存待确认的推送，每个来源同时只有一个
+func (d *Database) SaveHy2PendingForward(source string, p *Hy2PendingForward) error {
+	counters, err := json.Marshal(p.Counters)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`
+		INSERT INTO hy2_forward_pending (source, request_id, body, counters, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(source) DO UPDATE SET request_id = excluded.request_id, body = excluded.body,
+			counters = excluded.counters, created_at = excluded.created_at
+	`, source, p.RequestID, string(p.Body), string(counters), p.CreatedAt)
+	return err
+}
+
+// 目标面板确认后保存推送中的累计值游标，并删除待确认的推送
+func (d *Database) CompleteHy2Forward(source string, p *Hy2PendingForward, at time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveHy2Counters(tx, source, p.Counters, at); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM hy2_forward_pending WHERE source = ? AND request_id = ?`, source, p.RequestID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 保存hy2累计值游标
+func (d *Database) SaveHy2Counters(source string, counters map[string]Hy2Counter, at time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveHy2Counters(tx, source, counters, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 写入一次hy2同步：增量的计算、流量的写入和游标的更新在同一个事务中，
+// 写入失败时游标不变，下次同步会重新计算这部分流量
+func (d *Database) ProcessHy2Counters(src TrafficSource, source string, tag string, counters map[string]Hy2Counter, online map[string]int) (*TrafficData, error) {
+	at := src.ReceivedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	deltas, err := hy2Deltas(tx, source, counters)
+	if err != nil {
+		return nil, err
+	}
+	data := NewHy2TrafficData(deltas, tag)
+	data.OnlineUsers = online
+	if err := ValidateTrafficData(data); err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(data)
+
+	acc := newTrafficAccumulator()
+	if err := d.applyTrafficData(tx, src, string(body), data, acc); err != nil && err != ErrDuplicatePush {
+		return nil, err
+	}
+	if err := acc.flush(tx); err != nil {
+		return nil, fmt.Errorf("写入流量历史失败: %v", err)
+	}
+	if err := saveHy2Counters(tx, source, counters, at); err != nil {
+		return nil, fmt.Errorf("保存hy2计数器失败: %v", err)
+	}
+	// 从转发模式切换为本地写入时，未确认的推送中的流量已包含在本次增量中，不再重发
+	if _, err := tx.Exec(`DELETE FROM hy2_forward_pending WHERE source = ?`, source); err != nil {
+		return nil, fmt.Errorf("清除待确认的转发失败: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.rates.record(acc.observations)
+	return data, nil
+}
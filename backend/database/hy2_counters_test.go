@@ -0,0 +1,134 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHy2Deltas(t *testing.T) {
+	type counters = map[string]Hy2Counter
+	tests := []struct {
+		name  string
+		reads []counters // 依次读取的累计值，除最后一次外读取后都保存游标
+		want  counters   // 最后一次读取的增量
+	}{
+		{
+			name:  "首次读取只记录基准",
+			reads: []counters{{"a": {Tx: 100, Rx: 1000}}},
+			want:  counters{"a": {}},
+		},
+		{
+			name:  "累计值增长",
+			reads: []counters{{"a": {Tx: 100, Rx: 1000}}, {"a": {Tx: 150, Rx: 1200}}},
+			want:  counters{"a": {Tx: 50, Rx: 200}},
+		},
+		{
+			name:  "累计值不变",
+			reads: []counters{{"a": {Tx: 100, Rx: 1000}}, {"a": {Tx: 100, Rx: 1000}}},
+			want:  counters{"a": {}},
+		},
+		{
+			name:  "新用户",
+			reads: []counters{{"a": {Tx: 100}}, {"a": {Tx: 150}, "b": {Tx: 5, Rx: 7}}},
+			want:  counters{"a": {Tx: 50}, "b": {Tx: 5, Rx: 7}},
+		},
+		{
+			name:  "计数器变小视为重启",
+			reads: []counters{{"a": {Tx: 100, Rx: 1000}}, {"a": {Tx: 30, Rx: 2000}}},
+			want:  counters{"a": {Tx: 30, Rx: 2000}},
+		},
+		{
+			name:  "上次的用户消失视为重启",
+			reads: []counters{{"a": {Tx: 100}, "b": {Tx: 10}}, {"a": {Tx: 300}}},
+			want:  counters{"a": {Tx: 300}},
+		},
+		{
+			name:  "重启后不再重复计算",
+			reads: []counters{{"a": {Tx: 100}, "b": {Tx: 10}}, {"a": {Tx: 300}}, {"a": {Tx: 350}}},
+			want:  counters{"a": {Tx: 50}},
+		},
+		{
+			name:  "没有读到任何用户",
+			reads: []counters{{"a": {Tx: 100}}, {}},
+			want:  counters{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			at := time.Now()
+			var got counters
+			for i, read := range tt.reads {
+				deltas, err := d.Hy2Deltas("127.0.0.1:9999", read)
+				if err != nil {
+					t.Fatalf("第%d次读取: %v", i+1, err)
+				}
+				got = deltas
+				if i < len(tt.reads)-1 {
+					at = at.Add(10 * time.Second)
+					if err := d.SaveHy2Counters("127.0.0.1:9999", read, at); err != nil {
+						t.Fatalf("保存游标失败: %v", err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("增量 = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHy2DeltasSourcesAreIndependent(t *testing.T) {
+	d := openTestDatabase(t)
+	if err := d.SaveHy2Counters("host:1", map[string]Hy2Counter{"a": {Tx: 100}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveHy2Counters("host:2", map[string]Hy2Counter{"a": {Tx: 20}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	deltas, err := d.Hy2Deltas("host:2", map[string]Hy2Counter{"a": {Tx: 150}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deltas["a"].Tx != 130 {
+		t.Errorf("其他来源的游标不应影响增量: %v", deltas)
+	}
+}
+
+// 首次同步不把hy2启动以来的累计流量记为当天的流量，也不触发异常流量隔离
+func TestProcessHy2CountersFirstSync(t *testing.T) {
+	d := openTestDatabase(t)
+	const source = "10.0.0.5:9999"
+	src := TrafficSource{ClientIP: "10.0.0.5"}
+	read := func(tx int64) map[string]Hy2Counter { return map[string]Hy2Counter{"a@x": {Tx: tx}} }
+
+	data, err := d.ProcessHy2Counters(src, source, "hysteria2", read(50_000_000_000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.ClientTraffics[0].Up != 0 || data.InboundTraffics[0].Up != 0 {
+		t.Errorf("首次同步的增量 = %+v, 期望为0", data)
+	}
+	if _, err := d.ProcessHy2Counters(src, source, "hysteria2", read(50_000_000_300), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	serviceID, _ := lookupService(d.db, "", "10.0.0.5")
+	if up, _ := inboundHistoryTotal(t, d, serviceID, "hysteria2"); up != 300 {
+		t.Errorf("历史上传 = %d, 期望 300（首次同步只记录基准）", up)
+	}
+	if _, total, err := d.ListQuarantine(serviceID, "", 10, 0); err != nil || total != 0 {
+		t.Errorf("隔离的样本 = %d (%v), 期望没有", total, err)
+	}
+}
+
+func TestHy2DeltasRejectsNegative(t *testing.T) {
+	d := openTestDatabase(t)
+	_, err := d.Hy2Deltas("host:1", map[string]Hy2Counter{"a": {Tx: -1}})
+	if !errors.Is(err, ErrInvalidTrafficData) {
+		t.Errorf("err = %v, 期望 ErrInvalidTrafficData", err)
+	}
+}
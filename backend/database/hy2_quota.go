@@ -0,0 +1,488 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hy2配额参数错误
+var ErrInvalidHy2Quota = errors.New("hy2配额参数无效")
+
+// hy2用户的月流量配额
+type Hy2QuotaRule struct {
+	ID           int       `json:"id"`
+	ServiceID    int       `json:"service_id"`
+	Email        string    `json:"email"`
+	QuotaBytes   int64     `json:"quota_bytes"`
+	ResetDay     int       `json:"reset_day"` // 每月几号重置（1-28）
+	Enabled      bool      `json:"enabled"`
+	LiftedPeriod string    `json:"lifted_period"` // 管理员解除限制的周期起始日期，为空表示未解除
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// 以下为当前周期的使用情况
+	PeriodStart string `json:"period_start"`
+	UsedBytes   int64  `json:"used_bytes"`
+	Exceeded    bool   `json:"exceeded"` // 已超出配额
+	Lifted      bool   `json:"lifted"`   // 本周期已解除限制
+	Blocked     bool   `json:"blocked"`  // 超出配额且未解除，同步时会被踢下线
+}
+
+// 超出配额的踢下线记录
+type Hy2QuotaAction struct {
+	ID          int        `json:"id"`
+	RuleID      int        `json:"rule_id"`
+	ServiceID   int        `json:"service_id"`
+	Email       string     `json:"email"`
+	PeriodStart string     `json:"period_start"`
+	UsedBytes   int64      `json:"used_bytes"`
+	QuotaBytes  int64      `json:"quota_bytes"`
+	FirstKickAt time.Time  `json:"first_kick_at"`
+	LastKickAt  time.Time  `json:"last_kick_at"`
+	KickCount   int        `json:"kick_count"`
+	LastError   string     `json:"last_error"`
+	LiftedAt    *time.Time `json:"lifted_at"`
+}
+
+// 需要踢下线的用户
+type Hy2QuotaViolation struct {
+	RuleID      int
+	ServiceID   int
+	Email       string
+	PeriodStart string
+	UsedBytes   int64
+	QuotaBytes  int64
+}
+
+// 当前配额周期的起始日期：本月重置日已过则为本月重置日，否则为上月重置日
+func quotaPeriodStart(now time.Time, resetDay int) string {
+	now = now.Local()
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, time.Local)
+	if now.Day() < resetDay {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start.Format("2006-01-02")
+}
+
+// hy2配置对应的服务（与推送时确定服务的规则相同），服务尚未创建时返回0
+func (d *Database) Hy2ServiceID(cfg *Hy2Config) (int, error) {
+	return lookupService(d.db, cfg.NodeID, cfg.SourceAPIHost)
+}
+
+// 服务是否由某个hy2配置同步
+func (d *Database) isHy2Service(serviceID int) (bool, error) {
+	cfgs, err := d.GetAllHy2Configs()
+	if err != nil {
+		return false, err
+	}
+	for i := range cfgs {
+		id, err := d.Hy2ServiceID(&cfgs[i])
+		if err != nil {
+			return false, err
+		}
+		if id == serviceID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 用户在周期内的已用流量（按每日历史累加）
+func quotaUsedBytes(q queryRower, serviceID int, email string, periodStart string) (int64, error) {
+	var used int64
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(daily_up + daily_down), 0) FROM client_traffic_history
+		WHERE service_id = ? AND email = ? AND date >= ?
+	`, serviceID, email, periodStart).Scan(&used)
+	return used, err
+}
+
+func (d *Database) fillHy2QuotaUsage(rule *Hy2QuotaRule, now time.Time) error {
+	rule.PeriodStart = quotaPeriodStart(now, rule.ResetDay)
+	used, err := quotaUsedBytes(d.db, rule.ServiceID, rule.Email, rule.PeriodStart)
+	if err != nil {
+		return err
+	}
+	rule.UsedBytes = used
+	rule.Exceeded = used >= rule.QuotaBytes
+	rule.Lifted = rule.LiftedPeriod == rule.PeriodStart
+	rule.Blocked = rule.Enabled && rule.Exceeded && !rule.Lifted
+	return nil
+}
+
+const hy2QuotaRuleSelect = `id, service_id, email, quota_bytes, reset_day, enabled, lifted_period, created_at, updated_at`
+
+func scanHy2QuotaRule(scan func(dest ...interface{}) error) (Hy2QuotaRule, error) {
+	var r Hy2QuotaRule
+	err := scan(&r.ID, &r.ServiceID, &r.Email, &r.QuotaBytes, &r.ResetDay, &r.Enabled, &r.LiftedPeriod, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+// 获取配额规则及当前周期的使用情况，serviceID为0时返回全部
+func (d *Database) GetHy2QuotaRules(serviceID int) ([]Hy2QuotaRule, error) {
+	return d.hy2QuotaRulesAt(serviceID, time.Now())
+}
+
+// 配额规则及时间now所在周期的使用情况
+func (d *Database) hy2QuotaRulesAt(serviceID int, now time.Time) ([]Hy2QuotaRule, error) {
+	query := `SELECT ` + hy2QuotaRuleSelect + ` FROM hy2_quota_rules`
+	var args []interface{}
+	if serviceID > 0 {
+		query += " WHERE service_id = ?"
+		args = append(args, serviceID)
+	}
+	query += " ORDER BY service_id, email"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Hy2QuotaRule, 0)
+	for rows.Next() {
+		r, err := scanHy2QuotaRule(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		if err := d.fillHy2QuotaUsage(&rules[i], now); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// 新增或修改用户的配额规则（不影响本周期已解除的限制）
+func (d *Database) SetHy2QuotaRule(serviceID int, email string, quotaBytes int64, resetDay int, enabled bool) (*Hy2QuotaRule, error) {
+	if email == "" {
+		return nil, fmt.Errorf("%w: 用户不能为空", ErrInvalidHy2Quota)
+	}
+	if quotaBytes <= 0 {
+		return nil, fmt.Errorf("%w: quota_bytes 必须大于0", ErrInvalidHy2Quota)
+	}
+	if resetDay < 1 || resetDay > 28 {
+		return nil, fmt.Errorf("%w: reset_day 必须在1到28之间", ErrInvalidHy2Quota)
+	}
+	ok, err := d.isHy2Service(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: 该服务不是由hy2同步的节点", ErrInvalidHy2Quota)
+	}
+
+	now := time.Now()
+	_, err = d.db.Exec(`
+		INSERT INTO hy2_quota_rules (service_id, email, quota_bytes, reset_day, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(service_id, email) DO UPDATE SET
+			quota_bytes = excluded.quota_bytes,
+			reset_day = excluded.reset_day,
+			enabled = excluded.enabled,
+			updated_at = excluded.updated_at
+	`, serviceID, email, quotaBytes, resetDay, enabled, now, now)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := scanHy2QuotaRule(d.db.QueryRow(`SELECT `+hy2QuotaRuleSelect+` FROM hy2_quota_rules WHERE service_id = ? AND email = ?`, serviceID, email).Scan)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, d.fillHy2QuotaUsage(&rule, now)
+}
+
+// 删除用户的配额规则
+func (d *Database) DeleteHy2QuotaRule(serviceID int, email string) error {
+	result, err := d.db.Exec(`DELETE FROM hy2_quota_rules WHERE service_id = ? AND email = ?`, serviceID, email)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// 解除用户本周期的限制，到下一个重置日后重新按配额检查
+func (d *Database) LiftHy2Quota(serviceID int, email string) (*Hy2QuotaRule, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rule, err := scanHy2QuotaRule(tx.QueryRow(`SELECT `+hy2QuotaRuleSelect+` FROM hy2_quota_rules WHERE service_id = ? AND email = ?`, serviceID, email).Scan)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	period := quotaPeriodStart(now, rule.ResetDay)
+	if _, err := tx.Exec(`UPDATE hy2_quota_rules SET lifted_period = ?, updated_at = ? WHERE id = ?`, period, now, rule.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE hy2_quota_actions SET lifted_at = ? WHERE rule_id = ? AND period_start = ? AND lifted_at IS NULL`, now, rule.ID, period); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	rule.LiftedPeriod = period
+	rule.UpdatedAt = now
+	return &rule, d.fillHy2QuotaUsage(&rule, now)
+}
+
+// 服务中超出配额、需要踢下线的用户
+func (d *Database) Hy2QuotaViolations(serviceID int, now time.Time) ([]Hy2QuotaViolation, error) {
+	rules, err := d.hy2QuotaRulesAt(serviceID, now)
+	if err != nil {
+		return nil, err
+	}
+	var violations []Hy2QuotaViolation
+	for _, r := range rules {
+		if r.Blocked {
+			violations = append(violations, Hy2QuotaViolation{
+				RuleID:      r.ID,
+				ServiceID:   r.ServiceID,
+				Email:       r.Email,
+				PeriodStart: r.PeriodStart,
+				UsedBytes:   r.UsedBytes,
+				QuotaBytes:  r.QuotaBytes,
+			})
+		}
+	}
+	return violations, nil
+}
+
+// 记录一次踢下线，kickErr为调用hy2失败的原因
+func (d *Database) RecordHy2Kick(v Hy2QuotaViolation, kickErr error, at time.Time) error {
+	lastError := ""
+	if kickErr != nil {
+		lastError = kickErr.Error()
+	}
+	_, err := d.db.Exec(`
+		INSERT INTO hy2_quota_actions (rule_id, service_id, email, period_start, used_bytes, quota_bytes, first_kick_at, last_kick_at, kick_count, last_error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT(rule_id, period_start) DO UPDATE SET
+			used_bytes = excluded.used_bytes,
+			quota_bytes = excluded.quota_bytes,
+			last_kick_at = excluded.last_kick_at,
+			kick_count = kick_count + 1,
+			last_error = excluded.last_error
+	`, v.RuleID, v.ServiceID, v.Email, v.PeriodStart, v.UsedBytes, v.QuotaBytes, at, at, lastError)
+	return err
+}
+
+// 获取踢下线记录（按最近一次踢下线时间倒序），serviceID为0时返回全部
+func (d *Database) GetHy2QuotaActions(serviceID int, limit int) ([]Hy2QuotaAction, error) {
+	query := `
+		SELECT id, rule_id, service_id, email, period_start, used_bytes, quota_bytes,
+			first_kick_at, last_kick_at, kick_count, last_error, lifted_at
+		FROM hy2_quota_actions`
+	var args []interface{}
+	if serviceID > 0 {
+		query += " WHERE service_id = ?"
+		args = append(args, serviceID)
+	}
+	query += " ORDER BY last_kick_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := make([]Hy2QuotaAction, 0)
+	for rows.Next() {
+		var a Hy2QuotaAction
+		var liftedAt sql.NullTime
+		if err := rows.Scan(&a.ID, &a.RuleID, &a.ServiceID, &a.Email, &a.PeriodStart, &a.UsedBytes, &a.QuotaBytes,
+			&a.FirstKickAt, &a.LastKickAt, &a.KickCount, &a.LastError, &liftedAt); err != nil {
+			return nil, err
+		}
+		if liftedAt.Valid {
+			a.LiftedAt = &liftedAt.Time
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// 合并服务时迁移配额规则，目标服务已有同一用户的规则时保留目标的规则
+func moveHy2QuotaRules(tx *sql.Tx, sourceID int, targetID int) error {
+	if _, err := tx.Exec(`UPDATE OR IGNORE hy2_quota_rules SET service_id = ? WHERE service_id = ?`, targetID, sourceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM hy2_quota_rules WHERE service_id = ?`, sourceID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE hy2_quota_actions SET service_id = ? WHERE service_id = ?`, targetID, sourceID)
+	return err
+}
+
+// 获取hy2配额规则，可按 service_id 过滤
+func (api *DatabaseAPI) GetHy2Quotas(c *gin.Context) {
+	serviceID, _ := strconv.Atoi(c.Query("service_id"))
+	rules, err := api.db.GetHy2QuotaRules(serviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取配额规则失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取配额规则成功",
+		"data":    rules,
+	})
+}
+
+// 设置hy2用户的配额
+func (api *DatabaseAPI) SetHy2Quota(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	var request struct {
+		QuotaBytes int64 `json:"quota_bytes"`
+		ResetDay   int   `json:"reset_day"`
+		Enabled    *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	if request.ResetDay == 0 {
+		request.ResetDay = 1
+	}
+	enabled := request.Enabled == nil || *request.Enabled
+
+	rule, err := api.db.SetHy2QuotaRule(serviceID, c.Param("email"), request.QuotaBytes, request.ResetDay, enabled)
+	if errors.Is(err, ErrInvalidHy2Quota) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "设置配额失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "配额设置成功",
+		"data":    rule,
+	})
+}
+
+// 删除hy2用户的配额
+func (api *DatabaseAPI) DeleteHy2Quota(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	err = api.db.DeleteHy2QuotaRule(serviceID, c.Param("email"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "配额规则不存在",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "删除配额失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "配额已删除",
+	})
+}
+
+// 解除hy2用户本周期的限制
+func (api *DatabaseAPI) LiftHy2Quota(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	rule, err := api.db.LiftHy2Quota(serviceID, c.Param("email"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "配额规则不存在",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "解除限制失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "已解除本周期的限制",
+		"data":    rule,
+	})
+}
+
+// 获取踢下线记录，可按 service_id 过滤
+func (api *DatabaseAPI) GetHy2QuotaActions(c *gin.Context) {
+	serviceID, _ := strconv.Atoi(c.Query("service_id"))
+	limit := 100
+	if l := c.Query("limit"); l != "" {
+		if v, err := strconv.Atoi(l); err == nil && v > 0 && v <= 1000 {
+			limit = v
+		}
+	}
+	actions, err := api.db.GetHy2QuotaActions(serviceID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取踢下线记录失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取踢下线记录成功",
+		"data":    actions,
+	})
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	at := func(year int, month time.Month, day int, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name     string
+		now      time.Time
+		resetDay int
+		want     string
+	}{
+		{"重置日之后", at(2024, 3, 15, 12), 1, "2024-03-01"},
+		{"重置日当天零点", at(2024, 3, 1, 0), 1, "2024-03-01"},
+		{"闰年二月最后一天", at(2024, 2, 29, 23), 1, "2024-02-01"},
+		{"重置日之前回到上月", at(2024, 3, 10, 12), 15, "2024-02-15"},
+		{"从三月回到闰年二月28日", at(2024, 3, 27, 12), 28, "2024-02-28"},
+		{"从三月回到平年二月28日", at(2023, 3, 1, 12), 28, "2023-02-28"},
+		{"31日在本月重置日之后", at(2024, 3, 31, 12), 28, "2024-03-28"},
+		{"30日的月份", at(2024, 4, 30, 23), 28, "2024-04-28"},
+		{"一月回到上一年十二月", at(2024, 1, 15, 12), 20, "2023-12-20"},
+		{"年末", at(2024, 12, 31, 23), 28, "2024-12-28"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotaPeriodStart(tt.now, tt.resetDay); got != tt.want {
+				t.Errorf("quotaPeriodStart(%s, %d) = %s, 期望 %s", tt.now.Format(time.RFC3339), tt.resetDay, got, tt.want)
+			}
+		})
+	}
+}
+
+// 配额按周期统计，跨过重置日后重新计算，解除限制只对当前周期有效
+func TestHy2QuotaViolationsAcrossPeriods(t *testing.T) {
+	d := openTestDatabase(t)
+	if err := d.AddHy2Config(&Hy2Config{SourceAPIHost: "10.0.0.5", SourceAPIPort: "9999", InboundTag: "hysteria2", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2024, month, day, 12, 0, 0, 0, time.Local)
+	}
+	use := func(at time.Time, bytes int64) int {
+		data := &TrafficData{ClientTraffics: []ClientTraffic{{Email: "a@x", Up: bytes}}}
+		return pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.5", ReceivedAt: at}, data)
+	}
+
+	serviceID := use(day(1, 20), 400)
+	if _, err := d.SetHy2QuotaRule(serviceID, "a@x", 1000, 28, true); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		at         time.Time
+		use        int64
+		lift       bool // 解除该周期的限制
+		wantPeriod string
+		wantUsed   int64 // 为0表示不应超出配额
+	}{
+		{name: "未超出", at: day(1, 27), use: 500},
+		{name: "重置日当天开始新周期", at: day(1, 28), use: 200},
+		{name: "新周期内超出", at: day(2, 10), use: 900, wantPeriod: "2024-01-28", wantUsed: 1100},
+		{name: "解除后本周期不再限制", at: day(2, 20), use: 100, lift: true},
+		{name: "闰年二月28日重置后恢复检查", at: day(2, 28), use: 1000, wantPeriod: "2024-02-28", wantUsed: 1000},
+		{name: "三月28日之前仍是二月的周期", at: day(3, 27), use: 0, wantPeriod: "2024-02-28", wantUsed: 1000},
+		{name: "三月28日开始新周期", at: day(3, 28), use: 0},
+	}
+	for _, step := range steps {
+		if step.use > 0 {
+			use(step.at, step.use)
+		}
+		if step.lift {
+			if _, err := d.db.Exec(`UPDATE hy2_quota_rules SET lifted_period = ?`, quotaPeriodStart(step.at, 28)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		violations, err := d.Hy2QuotaViolations(serviceID, step.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step.wantUsed == 0 {
+			if len(violations) != 0 {
+				t.Errorf("%s: 超出配额 %+v, 期望没有", step.name, violations)
+			}
+			continue
+		}
+		if len(violations) != 1 {
+			t.Errorf("%s: 超出配额 %+v, 期望1个", step.name, violations)
+			continue
+		}
+		if v := violations[0]; v.PeriodStart != step.wantPeriod || v.UsedBytes != step.wantUsed || v.QuotaBytes != 1000 {
+			t.Errorf("%s: 周期 %s 已用 %d, 期望周期 %s 已用 %d", step.name, v.PeriodStart, v.UsedBytes, step.wantPeriod, step.wantUsed)
+		}
+	}
+}
+
+func TestSetHy2QuotaRuleInvalid(t *testing.T) {
+	d := openTestDatabase(t)
+	if err := d.AddHy2Config(&Hy2Config{SourceAPIHost: "10.0.0.5", SourceAPIPort: "9999", InboundTag: "hysteria2", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	hy2Service := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.5"}, inboundData("hysteria2", 1, 1))
+	otherService := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.6"}, inboundData("in-1", 1, 1))
+
+	tests := []struct {
+		name      string
+		serviceID int
+		email     string
+		quota     int64
+		resetDay  int
+	}{
+		{"用户为空", hy2Service, "", 1000, 1},
+		{"配额为0", hy2Service, "a@x", 0, 1},
+		{"重置日为0", hy2Service, "a@x", 1000, 0},
+		{"重置日为29（部分月份没有）", hy2Service, "a@x", 1000, 29},
+		{"不是hy2同步的服务", otherService, "a@x", 1000, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := d.SetHy2QuotaRule(tt.serviceID, tt.email, tt.quota, tt.resetDay, true); !errors.Is(err, ErrInvalidHy2Quota) {
+				t.Errorf("err = %v, 期望 ErrInvalidHy2Quota", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// 写入队列已满，调用方应稍后重试
+	ErrIngestQueueFull = errors.New("写入队列已满")
+	// 写入队列已关闭（服务正在退出）
+	ErrIngestQueueClosed = errors.New("写入队列已关闭")
+)
+
+// 待写入的一次上报
+type IngestJob struct {
+	Source TrafficSource
+	Body   string
+	Data   *TrafficData
+	// 对应的归档记录ID，处理完成后更新其处理结果，为0表示未归档
+	ArchiveID int64
+}
+
+// 单写入者的上报写入队列：请求处理只负责入队，由一个后台协程批量合并写入
+type IngestQueue struct {
+	db            *Database
+	jobs          chan *IngestJob
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// 创建写入队列，capacity为队列容量，batchSize为单个事务最多处理的上报数
+func NewIngestQueue(db *Database, capacity int, batchSize int, flushInterval time.Duration) *IngestQueue {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	return &IngestQueue{
+		db:            db,
+		jobs:          make(chan *IngestJob, capacity),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+}
+
+// 启动后台写入协程
+func (q *IngestQueue) Start() {
+	go q.run()
+}
+
+// 将上报加入队列，队列已满时立即返回ErrIngestQueueFull
+func (q *IngestQueue) Enqueue(job *IngestJob) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrIngestQueueClosed
+	}
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return ErrIngestQueueFull
+	}
+}
+
+// 当前排队的上报数
+func (q *IngestQueue) Len() int {
+	return len(q.jobs)
+}
+
+// 停止接收新的上报，写完队列中剩余的数据后返回
+func (q *IngestQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+func (q *IngestQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*IngestJob, 0, q.batchSize)
+	for {
+		select {
+		case job, ok := <-q.jobs:
+			if !ok {
+				q.writeBatch(batch)
+				log.Printf("写入队列已关闭，剩余数据已写入")
+				return
+			}
+			batch = append(batch, job)
+			if len(batch) >= q.batchSize {
+				q.writeBatch(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				q.writeBatch(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// 在一个事务中写入一批上报，同一记录同一天的增量合并为一次写入
+func (q *IngestQueue) writeBatch(batch []*IngestJob) {
+	if len(batch) == 0 {
+		return
+	}
+	outcomes := make([]string, len(batch))
+	errs := make([]string, len(batch))
+
+	if err := q.db.writeIngestBatch(batch, outcomes, errs); err != nil {
+		// 整批提交失败时逐条重试，避免一条异常数据拖累整批
+		log.Printf("批量写入流量数据失败（%d条），改为逐条写入: %v", len(batch), err)
+		for i, job := range batch {
+			outcomes[i], errs[i] = PayloadOutcomeOK, ""
+			err := q.db.ProcessTrafficData(job.Source, job.Body, job.Data)
+			switch {
+			case err == ErrDuplicatePush:
+				outcomes[i] = PayloadOutcomeDup
+			case errors.Is(err, ErrInvalidTrafficData):
+				outcomes[i], errs[i] = PayloadOutcomeInvalid, err.Error()
+			case err != nil:
+				outcomes[i], errs[i] = PayloadOutcomeError, err.Error()
+			}
+		}
+	}
+
+	for i, job := range batch {
+		if errs[i] != "" {
+			log.Printf("存储流量数据失败 - IP: %s, 节点: %s: %s", job.Source.ClientIP, job.Source.NodeID, errs[i])
+		}
+		if job.ArchiveID > 0 {
+			if err := q.db.UpdatePayloadOutcome(job.ArchiveID, outcomes[i], errs[i]); err != nil {
+				log.Printf("更新归档处理结果失败: %v", err)
+			}
+		}
+	}
+}
+
+// 回滚（整批或单次上报的保存点）后清空学习阈值缓存：缓存的值是在事务中读取的，可能属于已回滚的记录；
+// 推断的入站ID对应关系保存在入站记录中，随事务一起回滚
+func (d *Database) writeIngestBatch(batch []*IngestJob, outcomes []string, errs []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+			d.thresholds.reset()
+		}
+	}()
+
+	acc := newTrafficAccumulator()
+	for i, job := range batch {
+		// 每次上报使用单独的保存点，一次上报失败不影响同批次的其他上报
+		if _, err := tx.Exec("SAVEPOINT ingest_job"); err != nil {
+			return err
+		}
+		jobAcc := newTrafficAccumulator()
+		err := d.applyTrafficData(tx, job.Source, job.Body, job.Data, jobAcc)
+		switch {
+		case err == nil:
+			outcomes[i] = PayloadOutcomeOK
+		case err == ErrDuplicatePush:
+			outcomes[i] = PayloadOutcomeDup
+		case errors.Is(err, ErrInvalidTrafficData):
+			outcomes[i] = PayloadOutcomeInvalid
+			errs[i] = err.Error()
+		default:
+			outcomes[i] = PayloadOutcomeError
+			errs[i] = err.Error()
+		}
+		if errs[i] != "" {
+			if _, err := tx.Exec("ROLLBACK TO ingest_job"); err != nil {
+				return err
+			}
+			d.thresholds.reset()
+		} else {
+			acc.merge(jobAcc)
+		}
+		if _, err := tx.Exec("RELEASE ingest_job"); err != nil {
+			return err
+		}
+	}
+
+	if err := acc.flush(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	d.rates.record(acc.observations)
+	return nil
+}
+
+// 一条记录某一天的流量增量
+type trafficDelta struct {
+	kind      trafficKind
+	recordID  int
+	serviceID int
+	key       string
+	up        int64
+	down      int64
+	at        time.Time // 流量发生的时间（3x-ui推送为最近一次上报的接收时间）
+	dailyOnly bool      // 只知道日期的数据（通用上报接口按日期补录），不写入每小时流量
+}
+
+// 按（记录, 小时）合并流量增量，减少对历史表的写入次数
+type trafficAccumulator struct {
+	deltas map[string]*trafficDelta
+	order  []string
+	// 每次上报的增量，事务提交后用于计算实时速率
+	observations []rateObservation
+}
+
+func newTrafficAccumulator() *trafficAccumulator {
+	return &trafficAccumulator{deltas: make(map[string]*trafficDelta)}
+}
+
+func (a *trafficAccumulator) add(kind trafficKind, recordID int, serviceID int, key string, up int64, down int64, at time.Time) {
+	a.addDelta(&trafficDelta{kind: kind, recordID: recordID, serviceID: serviceID, key: key, up: up, down: down, at: at})
+}
+
+func (a *trafficAccumulator) addDelta(delta *trafficDelta) {
+	// 按小时合并，保证每小时流量表的归属正确（同一天的多个小时仍写入同一条每日历史）
+	k := delta.kind.name + "|" + delta.at.Local().Format("2006-01-02 15") + "|" + strconv.Itoa(delta.recordID)
+	if delta.dailyOnly {
+		k = delta.kind.name + "|" + delta.at.Local().Format("2006-01-02") + "|" + strconv.Itoa(delta.recordID) + "|daily"
+	}
+	existing, ok := a.deltas[k]
+	if !ok {
+		copied := *delta
+		a.deltas[k] = &copied
+		a.order = append(a.order, k)
+		return
+	}
+	existing.up += delta.up
+	existing.down += delta.down
+	if delta.at.After(existing.at) {
+		existing.at = delta.at
+	}
+}
+
+func (a *trafficAccumulator) merge(other *trafficAccumulator) {
+	for _, k := range other.order {
+		a.addDelta(other.deltas[k])
+	}
+	a.observations = append(a.observations, other.observations...)
+}
+
+// 记录本次上报的增量（acc中只能包含这一次上报的数据），服务整体速率按入站流量合计
+func (a *trafficAccumulator) observe(serviceID int, source string, at time.Time) {
+	obs := rateObservation{serviceID: serviceID, source: source, at: at, deltas: make(map[string][2]int64)}
+	var total [2]int64
+	for _, k := range a.order {
+		delta := a.deltas[k]
+		key := rateKey(delta.kind, delta.key)
+		v := obs.deltas[key]
+		obs.deltas[key] = [2]int64{v[0] + delta.up, v[1] + delta.down}
+		if delta.kind.name == inboundKind.name {
+			total[0] += delta.up
+			total[1] += delta.down
+		}
+	}
+	obs.deltas["service"] = total
+	a.observations = append(a.observations, obs)
+}
+
+// 将合并后的增量写入历史表
+func (a *trafficAccumulator) flush(tx *sql.Tx) error {
+	for _, k := range a.order {
+		delta := a.deltas[k]
+		if err := addTrafficHistory(tx, delta.kind, delta.recordID, delta.serviceID, delta.key, delta.up, delta.down, delta.at, !delta.dailyOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIngestQueue(t *testing.T) {
+	d := openTestDatabase(t)
+	d.EnablePayloadArchive(100, 0)
+	q := NewIngestQueue(d, 10, 3, time.Hour)
+	q.Start()
+
+	var archiveIDs []int64
+	for i := 0; i < 5; i++ {
+		rec := &PayloadRecord{ClientIP: "10.0.0.1", Body: "{}", Outcome: PayloadOutcomeQueued}
+		if err := d.ArchivePayload(rec); err != nil {
+			t.Fatal(err)
+		}
+		archiveIDs = append(archiveIDs, rec.ID)
+		job := &IngestJob{Source: TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: time.Now()}, Data: inboundData("in-1", 10, 1), ArchiveID: rec.ID}
+		if err := q.Enqueue(job); err != nil {
+			t.Fatalf("第%d次入队失败: %v", i+1, err)
+		}
+	}
+	// 关闭时写完剩余的数据（第二批不足batchSize，也不等flushInterval）
+	q.Close()
+	if err := q.Enqueue(&IngestJob{Data: inboundData("in-1", 1, 1)}); err != ErrIngestQueueClosed {
+		t.Errorf("关闭后入队 err = %v, 期望 ErrIngestQueueClosed", err)
+	}
+
+	serviceID, _ := lookupService(d.db, "", "10.0.0.1")
+	if up, down := inboundHistoryTotal(t, d, serviceID, "in-1"); up != 50 || down != 5 {
+		t.Errorf("写入流量 = %d/%d, 期望 50/5", up, down)
+	}
+	for _, id := range archiveIDs {
+		rec, err := d.GetPayload(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Outcome != PayloadOutcomeOK {
+			t.Errorf("归档%d的处理结果 = %s, 期望 %s", id, rec.Outcome, PayloadOutcomeOK)
+		}
+	}
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	d := openTestDatabase(t)
+	// 未启动的队列不会消费，容量满后立即拒绝
+	q := NewIngestQueue(d, 1, 1, time.Second)
+	if err := q.Enqueue(&IngestJob{Data: inboundData("in-1", 1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&IngestJob{Data: inboundData("in-1", 1, 1)}); err != ErrIngestQueueFull {
+		t.Errorf("队列已满时 err = %v, 期望 ErrIngestQueueFull", err)
+	}
+	if q.Len() != 1 {
+		t.Errorf("排队数 = %d, 期望 1", q.Len())
+	}
+}
+
+// 同一批次中一次上报失败只回滚它自己的保存点，其他上报照常写入
+func TestWriteIngestBatchSavepoint(t *testing.T) {
+	d := openTestDatabase(t)
+	now := time.Now()
+	batch := []*IngestJob{
+		{Source: TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: now, RequestID: "r1"}, Data: inboundData("in-1", 100, 0)},
+		// token绑定的服务不存在，写入失败
+		{Source: TrafficSource{ClientIP: "10.0.0.2", ServiceID: 999, ReceivedAt: now}, Data: inboundData("in-2", 7, 0)},
+		{Source: TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: now, RequestID: "r1"}, Data: inboundData("in-1", 100, 0)},
+		{Source: TrafficSource{ClientIP: "10.0.0.3", ReceivedAt: now}, Data: inboundData("in-1", 5, 0)},
+	}
+	d.thresholds.day = now.Format("2006-01-02")
+	d.thresholds.maxDaily["inbound|1"] = 1
+
+	outcomes := make([]string, len(batch))
+	errs := make([]string, len(batch))
+	if err := d.writeIngestBatch(batch, outcomes, errs); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{PayloadOutcomeOK, PayloadOutcomeError, PayloadOutcomeDup, PayloadOutcomeOK}
+	for i := range want {
+		if outcomes[i] != want[i] {
+			t.Errorf("第%d次上报的处理结果 = %s (%s), 期望 %s", i+1, outcomes[i], errs[i], want[i])
+		}
+	}
+
+	first, _ := lookupService(d.db, "", "10.0.0.1")
+	third, _ := lookupService(d.db, "", "10.0.0.3")
+	if up, _ := inboundHistoryTotal(t, d, first, "in-1"); up != 100 {
+		t.Errorf("第一次上报的流量 = %d, 期望 100（重复推送不累加）", up)
+	}
+	if up, _ := inboundHistoryTotal(t, d, third, "in-1"); up != 5 {
+		t.Errorf("失败之后的上报流量 = %d, 期望 5", up)
+	}
+	var n int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM inbound_traffics WHERE tag = 'in-2'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("失败的上报留下了 %d 条入站记录 (%v)", n, err)
+	}
+	if len(d.thresholds.maxDaily) != 0 {
+		t.Errorf("回滚后学习阈值缓存未清空: %v", d.thresholds.maxDaily)
+	}
+}
+
+func TestTrafficAccumulatorMerge(t *testing.T) {
+	base := time.Date(2024, 6, 15, 10, 5, 0, 0, time.Local)
+	a := newTrafficAccumulator()
+	a.add(inboundKind, 1, 1, "in-1", 10, 1, base)
+	a.add(inboundKind, 1, 1, "in-1", 20, 2, base.Add(30*time.Minute))
+
+	b := newTrafficAccumulator()
+	b.add(inboundKind, 1, 1, "in-1", 5, 0, base.Add(10*time.Minute))
+	b.add(inboundKind, 1, 1, "in-1", 7, 0, base.Add(time.Hour))
+	b.add(clientKind, 1, 1, "a@b", 3, 0, base)
+	b.addDelta(&trafficDelta{kind: inboundKind, recordID: 1, serviceID: 1, key: "in-1", up: 100, at: base, dailyOnly: true})
+	b.observe(1, "", base)
+	a.merge(b)
+
+	tests := []struct {
+		key    string
+		wantUp int64
+		wantAt time.Time
+	}{
+		{"inbound|2024-06-15 10|1", 35, base.Add(30 * time.Minute)},
+		{"inbound|2024-06-15 11|1", 7, base.Add(time.Hour)},
+		{"client|2024-06-15 10|1", 3, base},
+		{"inbound|2024-06-15|1|daily", 100, base},
+	}
+	if len(a.order) != len(tests) {
+		t.Fatalf("合并后 %d 条增量 %v, 期望 %d 条", len(a.order), a.order, len(tests))
+	}
+	for i, tt := range tests {
+		if a.order[i] != tt.key {
+			t.Errorf("第%d条增量 = %s, 期望 %s", i+1, a.order[i], tt.key)
+			continue
+		}
+		delta := a.deltas[tt.key]
+		if delta.up != tt.wantUp || !delta.at.Equal(tt.wantAt) {
+			t.Errorf("%s = %d@%v, 期望 %d@%v", tt.key, delta.up, delta.at, tt.wantUp, tt.wantAt)
+		}
+	}
+	if len(a.observations) != 1 || a.observations[0].deltas["service"] != [2]int64{112, 0} {
+		t.Errorf("速率观测 = %+v, 期望合并b的一次观测", a.observations)
+	}
+
+	// 合并复制增量，之后修改b不影响a
+	b.deltas["inbound|2024-06-15 11|1"].up = 1000
+	if a.deltas["inbound|2024-06-15 11|1"].up != 7 {
+		t.Errorf("合并后的增量与来源共享")
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上报token无效或已吊销
+var ErrInvalidIngestToken = errors.New("上报token无效或已吊销")
+
+// 最近使用时间的更新间隔：每次上报都更新会在写入队列之外多一次写操作
+const ingestTokenTouchInterval = time.Minute
+
+// 上报token记录结构体（不包含明文token）
+type IngestToken struct {
+	ID          int        `json:"id"`
+	ServiceID   int        `json:"service_id"`
+	Name        string     `json:"name"`
+	TokenPrefix string     `json:"token_prefix"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+// 计算token的哈希，数据库中只保存哈希值
+func hashIngestToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 为指定服务生成新的上报token，返回明文token（仅此一次可见）
+func (d *Database) CreateIngestToken(serviceID int, name string) (string, *IngestToken, error) {
+	var exists int
+	if err := d.db.QueryRow("SELECT id FROM services WHERE id = ?", serviceID).Scan(&exists); err != nil {
+		return "", nil, err
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(buf)
+	now := time.Now()
+	result, err := d.db.Exec(`
+		INSERT INTO ingest_tokens (service_id, name, token_hash, token_prefix, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, serviceID, name, hashIngestToken(token), token[:8], now)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &IngestToken{
+		ID:          int(id),
+		ServiceID:   serviceID,
+		Name:        name,
+		TokenPrefix: token[:8],
+		CreatedAt:   now,
+	}, nil
+}
+
+// 获取服务的全部上报token
+func (d *Database) ListIngestTokens(serviceID int) ([]IngestToken, error) {
+	rows, err := d.db.Query(`
+		SELECT id, service_id, name, token_prefix, created_at, last_used_at, revoked_at
+		FROM ingest_tokens WHERE service_id = ? ORDER BY id
+	`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]IngestToken, 0)
+	for rows.Next() {
+		var t IngestToken
+		var name sql.NullString
+		var lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.ServiceID, &name, &t.TokenPrefix, &t.CreatedAt, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		t.Name = name.String
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			t.RevokedAt = &revokedAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// 吊销上报token
+func (d *Database) RevokeIngestToken(tokenID int) error {
+	result, err := d.db.Exec(`UPDATE ingest_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now(), tokenID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// 校验上报token，返回其绑定的服务ID
+func (d *Database) ResolveIngestToken(token string) (int, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return 0, ErrInvalidIngestToken
+	}
+	var tokenID, serviceID int
+	var lastUsedAt sql.NullTime
+	err := d.db.QueryRow(`
+		SELECT id, service_id, last_used_at FROM ingest_tokens
+		WHERE token_hash = ? AND revoked_at IS NULL
+	`, hashIngestToken(token)).Scan(&tokenID, &serviceID, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidIngestToken
+	} else if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if !lastUsedAt.Valid || now.Sub(lastUsedAt.Time) >= ingestTokenTouchInterval {
+		if _, err := d.db.Exec(`UPDATE ingest_tokens SET last_used_at = ? WHERE id = ?`, now, tokenID); err != nil {
+			return 0, err
+		}
+	}
+	return serviceID, nil
+}
+
+// 判断节点对应的服务是否已启用token（启用后不再接受无token的上报）
+func (d *Database) ServiceRequiresToken(nodeID string, ipAddress string) (bool, error) {
+	serviceID, err := lookupService(d.db, nodeID, ipAddress)
+	if err != nil || serviceID == 0 {
+		return false, err
+	}
+	var count int
+	err = d.db.QueryRow(`
+		SELECT COUNT(id) FROM ingest_tokens WHERE service_id = ? AND revoked_at IS NULL
+	`, serviceID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// 获取服务的上报token列表
+func (api *DatabaseAPI) GetIngestTokens(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+
+	tokens, err := api.db.ListIngestTokens(serviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取上报token失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取上报token成功",
+		"data":    tokens,
+	})
+}
+
+// 为服务生成上报token
+func (api *DatabaseAPI) CreateIngestToken(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	token, record, err := api.db.CreateIngestToken(serviceID, request.Name)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "服务不存在",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "生成上报token失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "上报token生成成功，请妥善保存，token只显示一次",
+		"data": gin.H{
+			"token":  token,
+			"record": record,
+		},
+	})
+}
+
+// 吊销上报token
+func (api *DatabaseAPI) RevokeIngestToken(c *gin.Context) {
+	tokenID, err := strconv.Atoi(c.Param("token_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的tokenID",
+		})
+		return
+	}
+
+	err = api.db.RevokeIngestToken(tokenID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "token不存在或已吊销",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "吊销上报token失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "上报token已吊销",
+		"data": gin.H{
+			"revoked_token_id": tokenID,
+		},
+	})
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolveIngestToken(t *testing.T) {
+	d := openTestDatabase(t)
+	serviceID := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 1, 1))
+	token, _, err := d.CreateIngestToken(serviceID, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedRecord, err := d.CreateIngestToken(serviceID, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeIngestToken(revokedRecord.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    int
+		wantErr error
+	}{
+		{"有效token", token, serviceID, nil},
+		{"前后有空白", " " + token + "\n", serviceID, nil},
+		{"已吊销", revoked, 0, ErrInvalidIngestToken},
+		{"未知token", "0123456789abcdef", 0, ErrInvalidIngestToken},
+		{"空token", "  ", 0, ErrInvalidIngestToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.ResolveIngestToken(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("服务ID = %d, 期望 %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveIngestTokenTouchesLastUsedAtSparingly(t *testing.T) {
+	d := openTestDatabase(t)
+	serviceID := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 1, 1))
+	token, record, err := d.CreateIngestToken(serviceID, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastUsedAt := func() time.Time {
+		var at sql.NullTime
+		if err := d.db.QueryRow("SELECT last_used_at FROM ingest_tokens WHERE id = ?", record.ID).Scan(&at); err != nil {
+			t.Fatal(err)
+		}
+		return at.Time
+	}
+
+	if _, err := d.ResolveIngestToken(token); err != nil {
+		t.Fatal(err)
+	}
+	first := lastUsedAt()
+	if first.IsZero() {
+		t.Fatal("首次使用后应记录使用时间")
+	}
+	if _, err := d.ResolveIngestToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUsedAt(); !got.Equal(first) {
+		t.Errorf("一分钟内再次使用不应更新使用时间: %v -> %v", first, got)
+	}
+
+	old := time.Now().Add(-2 * ingestTokenTouchInterval)
+	if _, err := d.db.Exec("UPDATE ingest_tokens SET last_used_at = ? WHERE id = ?", old, record.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ResolveIngestToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUsedAt(); !got.After(old) {
+		t.Errorf("超过一分钟后应更新使用时间: %v", got)
+	}
+}
+
+func TestServiceRequiresToken(t *testing.T) {
+	d := openTestDatabase(t)
+	byIP := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 1, 1))
+	byNode := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.2", NodeID: "node-a"}, inboundData("in-1", 1, 1))
+	pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.3"}, inboundData("in-1", 1, 1))
+	if _, _, err := d.CreateIngestToken(byIP, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, nodeToken, err := d.CreateIngestToken(byNode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, nodeID string, ip string, want bool) {
+		t.Helper()
+		got, err := d.ServiceRequiresToken(nodeID, ip)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got != want {
+			t.Errorf("%s: ServiceRequiresToken = %v, 期望 %v", name, got, want)
+		}
+	}
+	check("按IP匹配的服务已有token", "", "10.0.0.1", true)
+	check("按节点标识匹配，IP已变化", "node-a", "10.9.9.9", true)
+	check("没有token的服务", "", "10.0.0.3", false)
+	check("不存在的服务", "", "10.0.0.4", false)
+	check("不存在的节点", "node-b", "10.0.0.4", false)
+
+	if err := d.RevokeIngestToken(nodeToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	check("token全部吊销后", "node-a", "10.0.0.2", false)
+}
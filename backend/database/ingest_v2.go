@@ -0,0 +1,332 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 通用上报接口单次最多包含的记录数
+const maxIngestBatchRecords = 5000
+
+// 时间戳最多允许超前服务器时间的范围（节点时钟误差）
+const maxIngestClockSkew = time.Hour
+
+// 通用上报在实时速率中的来源名称
+const ingestBatchRateSource = "v2"
+
+// 通用上报接口（/api/v2/ingest）的请求体
+type IngestBatch struct {
+	// 默认节点标识，记录中未指定节点时使用
+	NodeID string `json:"node_id"`
+	// 请求ID，同一请求ID在24小时内只会入库一次
+	RequestID string         `json:"request_id"`
+	Records   []IngestRecord `json:"records"`
+}
+
+// 一条流量记录：timestamp 为流量发生的时间（RFC3339字符串或Unix秒/毫秒），
+// 只知道日期时传 date（YYYY-MM-DD），此时只写入每日历史；两者都不传时使用接收时间
+type IngestRecord struct {
+	NodeID    string          `json:"node_id"`
+	Kind      string          `json:"kind"` // inbound / client / outbound
+	Key       string          `json:"key"`  // 入站或出站标签、用户邮箱
+	Up        int64           `json:"up"`
+	Down      int64           `json:"down"`
+	Timestamp json.RawMessage `json:"timestamp,omitempty"`
+	Date      string          `json:"date,omitempty"`
+
+	kind      trafficKind
+	at        time.Time
+	dailyOnly bool
+}
+
+// 设置默认节点标识，未指定节点的记录使用该节点；请求体中已有默认节点时不变
+func (b *IngestBatch) SetDefaultNode(nodeID string) {
+	if b.NodeID != "" || nodeID == "" {
+		return
+	}
+	b.NodeID = nodeID
+	for i := range b.Records {
+		if b.Records[i].NodeID == "" {
+			b.Records[i].NodeID = nodeID
+		}
+	}
+}
+
+// 是否包含非零的流量
+func (b *IngestBatch) hasTraffic() bool {
+	for _, r := range b.Records {
+		if r.Up > 0 || r.Down > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 通用上报的处理结果
+type IngestBatchResult struct {
+	Accepted    int   `json:"accepted"`    // 写入历史的记录数
+	Quarantined int   `json:"quarantined"` // 进入隔离区的记录数
+	Duplicates  int   `json:"duplicates"`  // 因重复推送被忽略的记录数
+	ServiceIDs  []int `json:"service_ids"` // 涉及的服务
+}
+
+// 解析并校验通用上报请求体，receivedAt 用于补全没有时间的记录
+func ParseIngestBatch(body []byte, receivedAt time.Time) (*IngestBatch, error) {
+	var batch IngestBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("%w: 请求体格式错误: %v", ErrInvalidTrafficData, err)
+	}
+	if len(batch.Records) == 0 {
+		return nil, fmt.Errorf("%w: records 不能为空", ErrInvalidTrafficData)
+	}
+	if len(batch.Records) > maxIngestBatchRecords {
+		return nil, fmt.Errorf("%w: 单次最多上报%d条记录", ErrInvalidTrafficData, maxIngestBatchRecords)
+	}
+	batch.NodeID = strings.TrimSpace(batch.NodeID)
+	batch.RequestID = strings.TrimSpace(batch.RequestID)
+	if len(batch.NodeID) > 128 || len(batch.RequestID) > 128 {
+		return nil, fmt.Errorf("%w: 节点标识或请求ID过长", ErrInvalidTrafficData)
+	}
+
+	for i := range batch.Records {
+		r := &batch.Records[i]
+		if err := r.resolve(receivedAt); err != nil {
+			return nil, fmt.Errorf("%w: 第%d条记录: %v", ErrInvalidTrafficData, i+1, err)
+		}
+		if r.NodeID == "" {
+			r.NodeID = batch.NodeID
+		}
+	}
+	return &batch, nil
+}
+
+// 校验记录并确定其写入的时间
+func (r *IngestRecord) resolve(receivedAt time.Time) error {
+	kind, ok := kindByName(r.Kind)
+	if !ok {
+		return fmt.Errorf("不支持的类型: %s", r.Kind)
+	}
+	r.kind = kind
+	r.Key = strings.TrimSpace(r.Key)
+	r.NodeID = strings.TrimSpace(r.NodeID)
+	if r.Key == "" || len(r.Key) > 256 {
+		return fmt.Errorf("key 不能为空且不能超过256个字符")
+	}
+	if len(r.NodeID) > 128 {
+		return fmt.Errorf("节点标识过长")
+	}
+	if r.Up < 0 || r.Down < 0 {
+		return fmt.Errorf("%s 的流量为负数", r.Key)
+	}
+
+	hasTimestamp := len(r.Timestamp) > 0 && string(r.Timestamp) != "null"
+	switch {
+	case hasTimestamp && r.Date != "":
+		return fmt.Errorf("timestamp 和 date 只能指定一个")
+	case hasTimestamp:
+		at, err := parseIngestTimestamp(r.Timestamp)
+		if err != nil {
+			return err
+		}
+		r.at = at
+	case r.Date != "":
+		date, err := time.ParseInLocation("2006-01-02", r.Date, time.Local)
+		if err != nil {
+			return fmt.Errorf("日期格式错误: %s", r.Date)
+		}
+		// 取当天中午，避免时区换算把数据算到相邻的日期
+		r.at = date.Add(12 * time.Hour)
+		r.dailyOnly = true
+	default:
+		r.at = receivedAt
+	}
+
+	if r.dailyOnly {
+		if r.Date > receivedAt.Format("2006-01-02") {
+			return fmt.Errorf("日期 %s 晚于今天", r.Date)
+		}
+	} else if r.at.After(receivedAt.Add(maxIngestClockSkew)) {
+		return fmt.Errorf("时间 %s 晚于当前时间", r.at.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// 时间戳支持RFC3339字符串、Unix秒或毫秒
+func parseIngestTimestamp(raw json.RawMessage) (time.Time, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if t, err := time.Parse(time.RFC3339, text); err == nil {
+			return t, nil
+		}
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return unixTimestamp(n), nil
+		}
+		return time.Time{}, fmt.Errorf("时间格式错误: %s", text)
+	}
+	var n int64
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return time.Time{}, fmt.Errorf("时间格式错误: %s", string(raw))
+	}
+	return unixTimestamp(n), nil
+}
+
+func unixTimestamp(n int64) time.Time {
+	// 超过该值视为毫秒（秒级时间戳要到5138年才会达到）
+	if n > 1e11 {
+		return time.UnixMilli(n)
+	}
+	return time.Unix(n, 0)
+}
+
+// 写入一批通用上报记录：按节点确定服务，每条记录按自身的时间写入对应的日期和小时
+func (d *Database) IngestBatch(src TrafficSource, body string, batch *IngestBatch) (*IngestBatchResult, error) {
+	now := src.ReceivedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if batch.RequestID != "" {
+		src.RequestID = batch.RequestID
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	result := &IngestBatchResult{ServiceIDs: make([]int, 0)}
+	acc := newTrafficAccumulator()
+
+	// 按节点分组，token绑定服务时全部写入该服务
+	type group struct {
+		src     TrafficSource
+		records []*IngestRecord
+	}
+	var groups []*group
+	byNode := map[string]*group{}
+	for i := range batch.Records {
+		r := &batch.Records[i]
+		node := r.NodeID
+		if src.ServiceID > 0 {
+			node = src.NodeID
+		}
+		g, ok := byNode[node]
+		if !ok {
+			g = &group{src: src}
+			g.src.NodeID = node
+			byNode[node] = g
+			groups = append(groups, g)
+		}
+		g.records = append(g.records, r)
+	}
+
+	// 同一批次中多个分组可能对应同一个服务，每个服务只做一次重复检测
+	duplicates := map[int]bool{}
+	// 各服务刚发生的流量，用于计算实时速率；迟到和补录的数据不参与
+	live := map[int]*trafficAccumulator{}
+	var liveOrder []int
+	for _, g := range groups {
+		serviceID, err := d.resolveService(tx, g.src, now)
+		if err != nil {
+			return nil, fmt.Errorf("获取或创建服务失败: %v", err)
+		}
+		duplicate, checked := duplicates[serviceID]
+		if !checked {
+			result.ServiceIDs = append(result.ServiceIDs, serviceID)
+			// 回放的数据不做重复检测
+			if !src.Replay {
+				if duplicate, err = d.checkDuplicatePush(tx, serviceID, g.src.RequestID, body, batch.hasTraffic(), now); err != nil {
+					return nil, fmt.Errorf("检测重复推送失败: %v", err)
+				}
+			}
+			duplicates[serviceID] = duplicate
+		}
+		if err := d.updateServiceLastSeen(tx, serviceID, now); err != nil {
+			return nil, fmt.Errorf("更新服务最后活跃时间失败: %v", err)
+		}
+		if duplicate {
+			result.Duplicates += len(g.records)
+			continue
+		}
+		if !src.Replay {
+			if err := d.updateServiceIP(tx, serviceID, g.src.ClientIP); err != nil {
+				return nil, fmt.Errorf("更新服务IP失败: %v", err)
+			}
+			// 只有补录数据的批次也作为一次上报，速率按相邻两次批量上报的间隔计算
+			if live[serviceID] == nil {
+				live[serviceID] = newTrafficAccumulator()
+				liveOrder = append(liveOrder, serviceID)
+			}
+		}
+
+		guard, err := d.newSampleGuard(tx, serviceID)
+		if err != nil {
+			return nil, fmt.Errorf("读取异常流量阈值失败: %v", err)
+		}
+		for _, r := range g.records {
+			recordID, err := d.ensureTrafficRecord(tx, r.kind, serviceID, r.Key, r.at)
+			if err != nil {
+				return nil, fmt.Errorf("创建%s记录失败: %v", r.Key, err)
+			}
+			if r.Up == 0 && r.Down == 0 {
+				result.Accepted++
+				continue
+			}
+			quarantined, err := d.quarantineSample(tx, guard, r.kind, recordID, serviceID, r.Key, r.Up, r.Down, r.at)
+			if err != nil {
+				return nil, err
+			}
+			if quarantined {
+				result.Quarantined++
+				continue
+			}
+			delta := &trafficDelta{kind: r.kind, recordID: recordID, serviceID: serviceID, key: r.Key, up: r.Up, down: r.Down, at: r.at, dailyOnly: r.dailyOnly}
+			acc.addDelta(delta)
+			result.Accepted++
+			if !src.Replay && !r.dailyOnly && now.Sub(r.at) <= rateMaxGap {
+				live[serviceID].addDelta(delta)
+			}
+		}
+	}
+
+	if err := acc.flush(tx); err != nil {
+		return nil, fmt.Errorf("写入流量历史失败: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, serviceID := range liveOrder {
+		live[serviceID].observe(serviceID, ingestBatchRateSource, now)
+		d.rates.record(live[serviceID].observations)
+	}
+	if result.Accepted == 0 && result.Quarantined == 0 && result.Duplicates > 0 {
+		return result, ErrDuplicatePush
+	}
+	return result, nil
+}
+
+// 获取或创建服务下的入站、用户或出站记录
+func (d *Database) ensureTrafficRecord(tx *sql.Tx, kind trafficKind, serviceID int, key string, at time.Time) (int, error) {
+	var recordID int
+	err := tx.QueryRow("SELECT id FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", serviceID, key).Scan(&recordID)
+	if err != sql.ErrNoRows {
+		return recordID, err
+	}
+	var res sql.Result
+	if kind.name == inboundKind.name {
+		res, err = tx.Exec(`INSERT INTO inbound_traffics (service_id, tag, port, last_updated, status) VALUES (?, ?, ?, ?, 'active')`,
+			serviceID, key, d.extractPortFromTag(key), at)
+	} else {
+		res, err = tx.Exec("INSERT INTO "+kind.table+" (service_id, "+kind.keyColumn+", last_updated, status) VALUES (?, ?, ?, 'active')",
+			serviceID, key, at)
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
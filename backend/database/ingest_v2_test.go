@@ -0,0 +1,150 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIngestBatch(t *testing.T) {
+	receivedAt := time.Date(2024, 6, 15, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		body      string
+		wantErr   string // 错误信息中应包含的内容，为空表示应解析成功
+		wantAt    time.Time
+		wantDaily bool
+		wantNode  string
+	}{
+		{
+			name:   "没有时间时使用接收时间",
+			body:   `{"records":[{"kind":"inbound","key":"in-1","up":1,"down":2}]}`,
+			wantAt: receivedAt,
+		},
+		{
+			name:   "RFC3339时间",
+			body:   `{"records":[{"kind":"client","key":"a@b","up":1,"timestamp":"2024-06-15T01:00:00Z"}]}`,
+			wantAt: time.Date(2024, 6, 15, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "Unix秒",
+			body:   `{"records":[{"kind":"outbound","key":"direct","timestamp":1718409600}]}`,
+			wantAt: time.Unix(1718409600, 0),
+		},
+		{
+			name:   "Unix毫秒",
+			body:   `{"records":[{"kind":"outbound","key":"direct","timestamp":1718409600000}]}`,
+			wantAt: time.Unix(1718409600, 0),
+		},
+		{
+			name:   "字符串形式的Unix秒",
+			body:   `{"records":[{"kind":"outbound","key":"direct","timestamp":"1718409600"}]}`,
+			wantAt: time.Unix(1718409600, 0),
+		},
+		{
+			name:      "只有日期",
+			body:      `{"records":[{"kind":"inbound","key":"in-1","date":"2024-06-01"}]}`,
+			wantAt:    time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local),
+			wantDaily: true,
+		},
+		{
+			name:     "记录继承默认节点",
+			body:     `{"node_id":" node-1 ","records":[{"kind":"inbound","key":"in-1"}]}`,
+			wantAt:   receivedAt,
+			wantNode: "node-1",
+		},
+		{
+			name:     "记录自己的节点优先",
+			body:     `{"node_id":"node-1","records":[{"kind":"inbound","key":"in-1","node_id":"node-2"}]}`,
+			wantAt:   receivedAt,
+			wantNode: "node-2",
+		},
+		{name: "格式错误", body: `{"records":`, wantErr: "请求体格式错误"},
+		{name: "没有记录", body: `{"records":[]}`, wantErr: "records 不能为空"},
+		{name: "不支持的类型", body: `{"records":[{"kind":"user","key":"a"}]}`, wantErr: "不支持的类型"},
+		{name: "key为空", body: `{"records":[{"kind":"inbound","key":" "}]}`, wantErr: "key 不能为空"},
+		{name: "负数流量", body: `{"records":[{"kind":"inbound","key":"in-1","up":-1}]}`, wantErr: "流量为负数"},
+		{
+			name:    "同时指定时间和日期",
+			body:    `{"records":[{"kind":"inbound","key":"in-1","timestamp":1718409600,"date":"2024-06-01"}]}`,
+			wantErr: "只能指定一个",
+		},
+		{name: "日期格式错误", body: `{"records":[{"kind":"inbound","key":"in-1","date":"2024/06/01"}]}`, wantErr: "日期格式错误"},
+		{name: "日期晚于今天", body: `{"records":[{"kind":"inbound","key":"in-1","date":"2024-06-16"}]}`, wantErr: "晚于今天"},
+		{
+			name:    "时间超前太多",
+			body:    `{"records":[{"kind":"inbound","key":"in-1","timestamp":"` + receivedAt.Add(2*time.Hour).Format(time.RFC3339) + `"}]}`,
+			wantErr: "晚于当前时间",
+		},
+		{name: "时间格式错误", body: `{"records":[{"kind":"inbound","key":"in-1","timestamp":"yesterday"}]}`, wantErr: "时间格式错误"},
+		{
+			name:    "请求ID过长",
+			body:    `{"request_id":"` + strings.Repeat("x", 129) + `","records":[{"kind":"inbound","key":"in-1"}]}`,
+			wantErr: "请求ID过长",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch, err := ParseIngestBatch([]byte(tt.body), receivedAt)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidTrafficData) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, 期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			r := batch.Records[0]
+			if !r.at.Equal(tt.wantAt) {
+				t.Errorf("时间 = %v, 期望 %v", r.at, tt.wantAt)
+			}
+			if r.dailyOnly != tt.wantDaily {
+				t.Errorf("dailyOnly = %v, 期望 %v", r.dailyOnly, tt.wantDaily)
+			}
+			if r.NodeID != tt.wantNode {
+				t.Errorf("节点 = %q, 期望 %q", r.NodeID, tt.wantNode)
+			}
+		})
+	}
+}
+
+func TestParseIngestBatchTooManyRecords(t *testing.T) {
+	body := `{"records":[` + strings.Repeat(`{"kind":"inbound","key":"in-1"},`, maxIngestBatchRecords) + `{"kind":"inbound","key":"in-1"}]}`
+	if _, err := ParseIngestBatch([]byte(body), time.Now()); !errors.Is(err, ErrInvalidTrafficData) {
+		t.Errorf("err = %v, 期望 ErrInvalidTrafficData", err)
+	}
+}
+
+// 批量上报中刚发生的流量计入实时速率，补录的旧数据不计入
+func TestIngestBatchRecordsRates(t *testing.T) {
+	d := openTestDatabase(t)
+	now := time.Now()
+	ingest := func(body string, receivedAt time.Time) int {
+		t.Helper()
+		batch, err := ParseIngestBatch([]byte(body), receivedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := d.IngestBatch(TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: receivedAt}, body, batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.ServiceIDs[0]
+	}
+
+	ingest(`{"records":[{"kind":"inbound","key":"in-1","up":100}]}`, now.Add(-20*time.Second))
+	// 补录一小时前的大量流量，不影响速率
+	ingest(`{"records":[{"kind":"inbound","key":"in-1","up":100000000,"timestamp":"`+now.Add(-time.Hour).Format(time.RFC3339)+`"}]}`, now.Add(-10*time.Second))
+	serviceID := ingest(`{"records":[{"kind":"inbound","key":"in-1","up":1000}]}`, now)
+
+	rate := d.ServiceRate(serviceID)
+	if rate.UpBps != 100 {
+		t.Errorf("上传速率 = %v, 期望 100（1000字节/10秒）", rate.UpBps)
+	}
+	if rate.PeakUpBps != 100 {
+		t.Errorf("峰值上传速率 = %v, 期望 100", rate.PeakUpBps)
+	}
+}
@@ -0,0 +1,534 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 合并/迁移参数错误
+var ErrInvalidMerge = errors.New("合并参数无效")
+
+// 合并时保留哪个服务的节点标识
+const (
+	KeepTargetNodeID = "target"
+	KeepSourceNodeID = "source"
+)
+
+// 单类记录（入站端口、客户端或出站）的合并结果
+type MergeKindReport struct {
+	Moved         int      `json:"moved"`          // 目标服务中不存在、直接迁移的记录数
+	Merged        int      `json:"merged"`         // 与目标服务同名记录合并的记录数
+	HistoryRows   int64    `json:"history_rows"`   // 迁移的历史记录行数
+	NameConflicts []string `json:"name_conflicts"` // 双方都有自定义名称且不一致（保留目标服务的名称）
+}
+
+// 服务合并结果
+type MergeReport struct {
+	SourceServiceID int             `json:"source_service_id"`
+	TargetServiceID int             `json:"target_service_id"`
+	Inbounds        MergeKindReport `json:"inbounds"`
+	Clients         MergeKindReport `json:"clients"`
+	Outbounds       MergeKindReport `json:"outbounds"`
+	// 合并后服务的节点标识，以及双方标识不同时未保留、记入节点标识历史的标识
+	NodeID        string `json:"node_id"`
+	RetiredNodeID string `json:"retired_node_id,omitempty"`
+}
+
+// 历史迁移结果
+type ReassignReport struct {
+	SourceServiceID int    `json:"source_service_id"`
+	TargetServiceID int    `json:"target_service_id"`
+	Kind            string `json:"kind"`
+	Key             string `json:"key"`
+	StartDate       string `json:"start_date"`
+	EndDate         string `json:"end_date"`
+	HistoryRows     int64  `json:"history_rows"`
+	MovedUp         int64  `json:"moved_up"`
+	MovedDown       int64  `json:"moved_down"`
+}
+
+// 待合并的记录
+type mergeRecord struct {
+	id         int
+	key        string
+	customName string
+}
+
+// 将源服务的全部数据合并到目标服务，并删除源服务。
+// 双方的节点标识不同时（如节点重装后生成了新的标识）按keepNodeID保留其中一个（默认保留目标服务的），
+// 另一个记入节点标识历史，之后带该标识的推送仍写入合并后的服务
+func (d *Database) MergeServices(sourceID int, targetID int, keepNodeID string) (*MergeReport, error) {
+	if sourceID == targetID {
+		return nil, fmt.Errorf("%w: 源服务与目标服务相同", ErrInvalidMerge)
+	}
+	if keepNodeID == "" {
+		keepNodeID = KeepTargetNodeID
+	}
+	if keepNodeID != KeepTargetNodeID && keepNodeID != KeepSourceNodeID {
+		return nil, fmt.Errorf("%w: keep_node_id 只能为 target 或 source", ErrInvalidMerge)
+	}
+	log.Printf("开始合并服务: %d -> %d", sourceID, targetID)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var source, target struct {
+		nodeID, customName  sql.NullString
+		firstSeen, lastSeen sql.NullTime
+	}
+	const serviceQuery = "SELECT node_id, custom_name, first_seen, last_seen FROM services WHERE id = ?"
+	err = tx.QueryRow(serviceQuery, sourceID).Scan(&source.nodeID, &source.customName, &source.firstSeen, &source.lastSeen)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: 源服务不存在", ErrInvalidMerge)
+	} else if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(serviceQuery, targetID).Scan(&target.nodeID, &target.customName, &target.firstSeen, &target.lastSeen)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: 目标服务不存在", ErrInvalidMerge)
+	} else if err != nil {
+		return nil, err
+	}
+
+	report := &MergeReport{SourceServiceID: sourceID, TargetServiceID: targetID}
+	if report.Inbounds, err = d.mergeRecords(tx, inboundKind, sourceID, targetID); err != nil {
+		return nil, fmt.Errorf("合并入站流量失败: %v", err)
+	}
+	if report.Clients, err = d.mergeRecords(tx, clientKind, sourceID, targetID); err != nil {
+		return nil, fmt.Errorf("合并客户端流量失败: %v", err)
+	}
+	if report.Outbounds, err = d.mergeRecords(tx, outboundKind, sourceID, targetID); err != nil {
+		return nil, fmt.Errorf("合并出站流量失败: %v", err)
+	}
+
+	// 上报token和IP历史归属目标服务
+	if _, err := tx.Exec("UPDATE ingest_tokens SET service_id = ? WHERE service_id = ?", targetID, sourceID); err != nil {
+		return nil, fmt.Errorf("迁移上报token失败: %v", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO service_ip_history (service_id, ip_address, first_seen, last_seen)
+		SELECT ?, ip_address, first_seen, last_seen FROM service_ip_history WHERE service_id = ?
+		ON CONFLICT(service_id, ip_address) DO UPDATE SET
+			first_seen = MIN(first_seen, excluded.first_seen),
+			last_seen = MAX(last_seen, excluded.last_seen)
+	`, targetID, sourceID)
+	if err != nil {
+		return nil, fmt.Errorf("迁移IP历史失败: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM service_ip_history WHERE service_id = ?", sourceID); err != nil {
+		return nil, fmt.Errorf("迁移IP历史失败: %v", err)
+	}
+	if err := moveOnlineRecords(tx, sourceID, targetID); err != nil {
+		return nil, fmt.Errorf("迁移在线记录失败: %v", err)
+	}
+	if err := moveHy2QuotaRules(tx, sourceID, targetID); err != nil {
+		return nil, fmt.Errorf("迁移hy2配额失败: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM ingest_dedup WHERE service_id = ?", sourceID); err != nil {
+		return nil, fmt.Errorf("清理去重记录失败: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE traffic_quarantine SET service_id = ? WHERE service_id = ?", targetID, sourceID); err != nil {
+		return nil, fmt.Errorf("迁移隔离样本失败: %v", err)
+	}
+
+	// 删除源服务前合并服务属性：目标服务没有的节点标识和自定义名称由源服务补全
+	if _, err := tx.Exec(`
+		UPDATE services SET
+			first_seen = MIN(first_seen, (SELECT first_seen FROM services WHERE id = ?)),
+			last_seen = MAX(last_seen, (SELECT last_seen FROM services WHERE id = ?)),
+			dedup_count = dedup_count + (SELECT dedup_count FROM services WHERE id = ?)
+		WHERE id = ?
+	`, sourceID, sourceID, sourceID, targetID); err != nil {
+		return nil, fmt.Errorf("更新目标服务失败: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM services WHERE id = ?", sourceID); err != nil {
+		return nil, fmt.Errorf("删除源服务失败: %v", err)
+	}
+	// 源服务的节点标识历史归属目标服务
+	if _, err := tx.Exec("UPDATE service_node_history SET service_id = ? WHERE service_id = ?", targetID, sourceID); err != nil {
+		return nil, fmt.Errorf("迁移节点标识历史失败: %v", err)
+	}
+	report.NodeID = target.nodeID.String
+	switch {
+	case source.nodeID.String == "" || source.nodeID.String == target.nodeID.String:
+	case target.nodeID.String == "":
+		report.NodeID = source.nodeID.String
+	case keepNodeID == KeepSourceNodeID:
+		report.NodeID = source.nodeID.String
+		report.RetiredNodeID = target.nodeID.String
+		err = retireNodeID(tx, targetID, target.nodeID.String, target.firstSeen, target.lastSeen)
+	default:
+		report.RetiredNodeID = source.nodeID.String
+		err = retireNodeID(tx, targetID, source.nodeID.String, source.firstSeen, source.lastSeen)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("记录节点标识历史失败: %v", err)
+	}
+	if report.NodeID != target.nodeID.String {
+		if _, err := tx.Exec("UPDATE services SET node_id = ? WHERE id = ?", report.NodeID, targetID); err != nil {
+			return nil, fmt.Errorf("迁移节点标识失败: %v", err)
+		}
+	}
+	if target.customName.String == "" && source.customName.String != "" {
+		if _, err := tx.Exec("UPDATE services SET custom_name = ? WHERE id = ?", source.customName.String, targetID); err != nil {
+			return nil, fmt.Errorf("迁移自定义名称失败: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.rates.forget(sourceID)
+	d.thresholds.reset()
+	log.Printf("服务合并完成: %d -> %d", sourceID, targetID)
+	return report, nil
+}
+
+// 将不再使用的节点标识记入服务的节点标识历史
+func retireNodeID(tx *sql.Tx, serviceID int, nodeID string, firstSeen sql.NullTime, lastSeen sql.NullTime) error {
+	_, err := tx.Exec(`
+		INSERT INTO service_node_history (node_id, service_id, first_seen, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT(node_id) DO UPDATE SET service_id = excluded.service_id, last_seen = excluded.last_seen
+	`, nodeID, serviceID, firstSeen, lastSeen)
+	return err
+}
+
+// 合并某一类记录：目标服务已有同名记录时按日期累加历史，否则直接迁移
+func (d *Database) mergeRecords(tx *sql.Tx, kind trafficKind, sourceID int, targetID int) (MergeKindReport, error) {
+	report := MergeKindReport{NameConflicts: make([]string, 0)}
+
+	rows, err := tx.Query("SELECT id, "+kind.keyColumn+", custom_name FROM "+kind.table+" WHERE service_id = ?", sourceID)
+	if err != nil {
+		return report, err
+	}
+	var records []mergeRecord
+	for rows.Next() {
+		var r mergeRecord
+		var customName sql.NullString
+		if err := rows.Scan(&r.id, &r.key, &customName); err != nil {
+			rows.Close()
+			return report, err
+		}
+		r.customName = customName.String
+		records = append(records, r)
+	}
+	rows.Close()
+
+	for _, r := range records {
+		var targetRecordID int
+		var targetName sql.NullString
+		err := tx.QueryRow("SELECT id, custom_name FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", targetID, r.key).Scan(&targetRecordID, &targetName)
+		if err == sql.ErrNoRows {
+			// 目标服务没有该记录，直接迁移
+			if _, err := tx.Exec("UPDATE "+kind.table+" SET service_id = ? WHERE id = ?", targetID, r.id); err != nil {
+				return report, err
+			}
+			result, err := tx.Exec("UPDATE "+kind.historyTable+" SET service_id = ? WHERE "+kind.idColumn+" = ?", targetID, r.id)
+			if err != nil {
+				return report, err
+			}
+			n, _ := result.RowsAffected()
+			report.HistoryRows += n
+			if kind.hourlyTable != "" {
+				if _, err := tx.Exec("UPDATE "+kind.hourlyTable+" SET service_id = ? WHERE "+kind.idColumn+" = ?", targetID, r.id); err != nil {
+					return report, err
+				}
+			}
+			if err := moveRecordLinks(tx, kind, r.id, r.id, targetID); err != nil {
+				return report, err
+			}
+			report.Moved++
+			continue
+		} else if err != nil {
+			return report, err
+		}
+
+		// 同一日期的流量累加到目标记录
+		n, err := moveHistory(tx, kind, r.id, targetRecordID, targetID, r.key, "", "")
+		if err != nil {
+			return report, err
+		}
+		report.HistoryRows += n
+
+		// 自定义名称：目标为空时使用源名称，双方不一致时保留目标名称并报告
+		if targetName.String == "" && r.customName != "" {
+			if _, err := tx.Exec("UPDATE "+kind.table+" SET custom_name = ? WHERE id = ?", r.customName, targetRecordID); err != nil {
+				return report, err
+			}
+		} else if r.customName != "" && r.customName != targetName.String {
+			report.NameConflicts = append(report.NameConflicts, r.key)
+		}
+		if _, err := tx.Exec(`
+			UPDATE `+kind.table+` SET last_updated = MAX(last_updated, (SELECT last_updated FROM `+kind.table+` WHERE id = ?))
+			WHERE id = ?
+		`, r.id, targetRecordID); err != nil {
+			return report, err
+		}
+		if err := moveRecordLinks(tx, kind, r.id, targetRecordID, targetID); err != nil {
+			return report, err
+		}
+		if _, err := tx.Exec("DELETE FROM "+kind.table+" WHERE id = ?", r.id); err != nil {
+			return report, err
+		}
+		report.Merged++
+	}
+	return report, nil
+}
+
+// 将一条记录在日期范围内的历史累加到另一条记录，并删除原历史；日期为空表示不限
+func moveHistory(tx *sql.Tx, kind trafficKind, fromRecordID int, toRecordID int, toServiceID int, key string, startDate string, endDate string) (int64, error) {
+	where := kind.idColumn + " = ?"
+	args := []interface{}{fromRecordID}
+	if startDate != "" {
+		where += " AND date >= ?"
+		args = append(args, startDate)
+	}
+	if endDate != "" {
+		where += " AND date <= ?"
+		args = append(args, endDate)
+	}
+
+	insertArgs := append([]interface{}{toRecordID, toServiceID, key}, args...)
+	_, err := tx.Exec(`
+		INSERT INTO `+kind.historyTable+` (`+kind.idColumn+`, service_id, `+kind.keyColumn+`, date, daily_up, daily_down, created_at)
+		SELECT ?, ?, ?, date, daily_up, daily_down, created_at FROM `+kind.historyTable+` WHERE `+where+`
+		ON CONFLICT(`+kind.idColumn+`, date) DO UPDATE SET
+			daily_up = daily_up + excluded.daily_up,
+			daily_down = daily_down + excluded.daily_down
+	`, insertArgs...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM "+kind.historyTable+" WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	if err := moveHourly(tx, kind, fromRecordID, toRecordID, toServiceID, key, startDate, endDate); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// 将某个端口（或用户）在日期范围内的历史迁移到另一个服务的同名记录
+func (d *Database) ReassignHistory(kind trafficKind, sourceID int, key string, targetID int, startDate string, endDate string) (*ReassignReport, error) {
+	if sourceID == targetID {
+		return nil, fmt.Errorf("%w: 源服务与目标服务相同", ErrInvalidMerge)
+	}
+	for _, date := range []string{startDate, endDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("%w: 日期格式错误: %s", ErrInvalidMerge, date)
+		}
+	}
+	if startDate != "" && endDate != "" && startDate > endDate {
+		return nil, fmt.Errorf("%w: 开始日期晚于结束日期", ErrInvalidMerge)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sourceRecordID int
+	err = tx.QueryRow("SELECT id FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", sourceID, key).Scan(&sourceRecordID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: 源服务中不存在该记录", ErrInvalidMerge)
+	} else if err != nil {
+		return nil, err
+	}
+	var exists int
+	err = tx.QueryRow("SELECT id FROM services WHERE id = ?", targetID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: 目标服务不存在", ErrInvalidMerge)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// 目标服务没有同名记录时按源记录创建
+	var targetRecordID int
+	err = tx.QueryRow("SELECT id FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", targetID, key).Scan(&targetRecordID)
+	if err == sql.ErrNoRows {
+		var result sql.Result
+		switch kind {
+		case inboundKind:
+			result, err = tx.Exec(`
+				INSERT INTO inbound_traffics (service_id, tag, port, custom_name, last_updated, status)
+				SELECT ?, tag, port, custom_name, last_updated, status FROM inbound_traffics WHERE id = ?
+			`, targetID, sourceRecordID)
+		case outboundKind:
+			result, err = tx.Exec(`
+				INSERT INTO outbound_traffics (service_id, tag, custom_name, last_updated, status)
+				SELECT ?, tag, custom_name, last_updated, status FROM outbound_traffics WHERE id = ?
+			`, targetID, sourceRecordID)
+		default:
+			result, err = tx.Exec(`
+				INSERT INTO client_traffics (service_id, email, custom_name, last_updated, status)
+				SELECT ?, email, custom_name, last_updated, status FROM client_traffics WHERE id = ?
+			`, targetID, sourceRecordID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		id64, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		targetRecordID = int(id64)
+	} else if err != nil {
+		return nil, err
+	}
+
+	report := &ReassignReport{
+		SourceServiceID: sourceID,
+		TargetServiceID: targetID,
+		Kind:            kind.name,
+		Key:             key,
+		StartDate:       startDate,
+		EndDate:         endDate,
+	}
+	query := "SELECT COALESCE(SUM(daily_up), 0), COALESCE(SUM(daily_down), 0) FROM " + kind.historyTable + " WHERE " + kind.idColumn + " = ?"
+	args := []interface{}{sourceRecordID}
+	if startDate != "" {
+		query += " AND date >= ?"
+		args = append(args, startDate)
+	}
+	if endDate != "" {
+		query += " AND date <= ?"
+		args = append(args, endDate)
+	}
+	if err := tx.QueryRow(query, args...).Scan(&report.MovedUp, &report.MovedDown); err != nil {
+		return nil, err
+	}
+
+	report.HistoryRows, err = moveHistory(tx, kind, sourceRecordID, targetRecordID, targetID, key, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.thresholds.reset()
+	log.Printf("历史迁移完成: %s %s 服务%d -> 服务%d, %d行", kind.name, key, sourceID, targetID, report.HistoryRows)
+	return report, nil
+}
+
+// 合并服务
+func (api *DatabaseAPI) MergeServices(c *gin.Context) {
+	var request struct {
+		SourceID int `json:"source_id"`
+		TargetID int `json:"target_id"`
+		// 双方节点标识不同时保留哪个：target（默认）或 source
+		KeepNodeID string `json:"keep_node_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+
+	report, err := api.db.MergeServices(request.SourceID, request.TargetID, request.KeepNodeID)
+	if errors.Is(err, ErrInvalidMerge) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "合并服务失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "服务合并成功",
+		"data":    report,
+	})
+}
+
+// 将服务中某个端口或用户的一段历史迁移到另一个服务
+func (api *DatabaseAPI) ReassignHistory(c *gin.Context) {
+	sourceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	var request struct {
+		Tag             string `json:"tag"`
+		Email           string `json:"email"`
+		OutboundTag     string `json:"outbound_tag"`
+		TargetServiceID int    `json:"target_service_id"`
+		StartDate       string `json:"start_date"`
+		EndDate         string `json:"end_date"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	var kind trafficKind
+	var key string
+	specified := 0
+	if request.Tag != "" {
+		kind, key = inboundKind, request.Tag
+		specified++
+	}
+	if request.Email != "" {
+		kind, key = clientKind, request.Email
+		specified++
+	}
+	if request.OutboundTag != "" {
+		kind, key = outboundKind, request.OutboundTag
+		specified++
+	}
+	if specified != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "必须且只能指定tag、email或outbound_tag其中之一",
+		})
+		return
+	}
+	report, err := api.db.ReassignHistory(kind, sourceID, key, request.TargetServiceID, request.StartDate, request.EndDate)
+	if errors.Is(err, ErrInvalidMerge) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "迁移历史失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "历史迁移成功",
+		"data":    report,
+	})
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 服务中某条入站记录的历史流量合计
+func inboundHistoryTotal(t *testing.T, d *Database, serviceID int, tag string) (int64, int64) {
+	t.Helper()
+	var up, down int64
+	err := d.db.QueryRow(`
+		SELECT COALESCE(SUM(h.daily_up), 0), COALESCE(SUM(h.daily_down), 0)
+		FROM inbound_traffic_history h JOIN inbound_traffics i ON i.id = h.inbound_traffic_id
+		WHERE i.service_id = ? AND i.tag = ?
+	`, serviceID, tag).Scan(&up, &down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return up, down
+}
+
+func TestMergeServicesNodeID(t *testing.T) {
+	tests := []struct {
+		name        string
+		sourceNode  string
+		targetNode  string
+		keep        string
+		wantNode    string
+		wantRetired string
+		wantErr     error
+	}{
+		{name: "双方标识相同", sourceNode: "node-a", targetNode: "node-a", wantNode: "node-a"},
+		{name: "目标服务没有标识", sourceNode: "node-a", wantNode: "node-a"},
+		{name: "源服务没有标识", targetNode: "node-b", wantNode: "node-b"},
+		{name: "标识不同默认保留目标服务的", sourceNode: "node-a", targetNode: "node-b", wantNode: "node-b", wantRetired: "node-a"},
+		{name: "标识不同保留源服务的", sourceNode: "node-a", targetNode: "node-b", keep: KeepSourceNodeID, wantNode: "node-a", wantRetired: "node-b"},
+		{name: "保留选项无效", sourceNode: "node-a", targetNode: "node-b", keep: "both", wantErr: ErrInvalidMerge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			// 双方标识相同时源服务只能按IP区分，先按IP写入再补上标识
+			source := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 10, 20))
+			target := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.2", NodeID: tt.targetNode}, inboundData("in-1", 1, 2))
+			if tt.sourceNode != "" && tt.sourceNode != tt.targetNode {
+				if _, err := d.db.Exec("UPDATE services SET node_id = ? WHERE id = ?", tt.sourceNode, source); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := d.MergeServices(source, target, tt.keep)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("合并失败: %v", err)
+			}
+			if report.NodeID != tt.wantNode || report.RetiredNodeID != tt.wantRetired {
+				t.Errorf("节点标识 = %q/%q, 期望 %q/%q", report.NodeID, report.RetiredNodeID, tt.wantNode, tt.wantRetired)
+			}
+			if up, down := inboundHistoryTotal(t, d, target, "in-1"); up != 11 || down != 22 {
+				t.Errorf("合并后流量 = %d/%d, 期望 11/22", up, down)
+			}
+
+			// 保留的和未保留的标识推送都写入合并后的服务
+			for _, nodeID := range []string{tt.wantNode, tt.wantRetired} {
+				if nodeID == "" {
+					continue
+				}
+				got := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.9", NodeID: nodeID}, inboundData("in-1", 0, 0))
+				if got != target {
+					t.Errorf("节点 %s 的推送写入服务 %d, 期望 %d", nodeID, got, target)
+				}
+			}
+			history, err := d.GetServiceNodeHistory(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantLen := map[bool]int{true: 1, false: 0}[tt.wantRetired != ""]; len(history) != wantLen {
+				t.Errorf("节点标识历史 = %v, 期望 %d 条", history, wantLen)
+			}
+		})
+	}
+}
+
+func TestMergeServicesCarriesNodeHistory(t *testing.T) {
+	d := openTestDatabase(t)
+	a := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", NodeID: "node-a"}, inboundData("in-1", 1, 1))
+	b := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.2", NodeID: "node-b"}, inboundData("in-1", 1, 1))
+	c := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.3", NodeID: "node-c"}, inboundData("in-1", 1, 1))
+	if _, err := d.MergeServices(a, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.MergeServices(b, c, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, nodeID := range []string{"node-a", "node-b", "node-c"} {
+		if got, _ := lookupService(d.db, nodeID, "10.0.0.9"); got != c {
+			t.Errorf("节点 %s 属于服务 %d, 期望 %d", nodeID, got, c)
+		}
+	}
+
+	// 删除服务时一并删除节点标识历史
+	if err := d.DeleteService(c); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM service_node_history").Scan(&count); err != nil || count != 0 {
+		t.Errorf("节点标识历史剩余 %d 条 (%v)", count, err)
+	}
+}
+
+func TestMergeServicesInvalid(t *testing.T) {
+	d := openTestDatabase(t)
+	a := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 1, 1))
+	tests := []struct {
+		name           string
+		source, target int
+	}{
+		{"源服务与目标服务相同", a, a},
+		{"源服务不存在", 999, a},
+		{"目标服务不存在", a, 999},
+	}
+	for _, tt := range tests {
+		if _, err := d.MergeServices(tt.source, tt.target, ""); !errors.Is(err, ErrInvalidMerge) {
+			t.Errorf("%s: err = %v, 期望 ErrInvalidMerge", tt.name, err)
+		}
+	}
+}
+
+func TestReassignHistory(t *testing.T) {
+	today := time.Now()
+	yesterday := today.AddDate(0, 0, -1)
+	tests := []struct {
+		name           string
+		start, end     string
+		wantMoved      int64
+		wantSourceLeft int64
+		wantErr        bool
+	}{
+		{name: "全部历史", wantMoved: 400, wantSourceLeft: 0},
+		{name: "只迁移昨天", start: yesterday.Format("2006-01-02"), end: yesterday.Format("2006-01-02"), wantMoved: 100, wantSourceLeft: 300},
+		{name: "从今天开始", start: today.Format("2006-01-02"), wantMoved: 300, wantSourceLeft: 100},
+		{name: "日期格式错误", start: "2024/01/01", wantErr: true},
+		{name: "开始日期晚于结束日期", start: "2024-02-01", end: "2024-01-01", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			source := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: yesterday}, inboundData("in-1", 100, 0))
+			pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: today}, inboundData("in-1", 300, 0))
+			target := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.2"}, inboundData("in-2", 0, 0))
+
+			report, err := d.ReassignHistory(inboundKind, source, "in-1", target, tt.start, tt.end)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidMerge) {
+					t.Fatalf("err = %v, 期望 ErrInvalidMerge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("迁移失败: %v", err)
+			}
+			if report.MovedUp != tt.wantMoved {
+				t.Errorf("迁移上传 = %d, 期望 %d", report.MovedUp, tt.wantMoved)
+			}
+			if up, _ := inboundHistoryTotal(t, d, target, "in-1"); up != tt.wantMoved {
+				t.Errorf("目标服务流量 = %d, 期望 %d", up, tt.wantMoved)
+			}
+			if up, _ := inboundHistoryTotal(t, d, source, "in-1"); up != tt.wantSourceLeft {
+				t.Errorf("源服务剩余流量 = %d, 期望 %d", up, tt.wantSourceLeft)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package database
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 超过该时间没有新的在线信息时，视为当前没有用户在线（hy2同步已停止）
+const onlineStaleAfter = 2 * time.Minute
+
+// 用户当前在线情况
+type OnlineUser struct {
+	Email     string    `json:"email"`
+	Devices   int       `json:"devices"`    // 当前在线设备数
+	TodayPeak int       `json:"today_peak"` // 今日同时在线设备数峰值
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 用户某一天的同时在线设备数峰值
+type OnlineDailyPeak struct {
+	Email       string     `json:"email"`
+	Date        string     `json:"date"`
+	PeakDevices int        `json:"peak_devices"`
+	PeakAt      *time.Time `json:"peak_at"`
+}
+
+// 一次在线设备数采样
+type OnlineSample struct {
+	Devices   int       `json:"devices"`
+	SampledAt time.Time `json:"sampled_at"`
+}
+
+// 记录一次在线信息：写入采样和每日峰值，current为true时替换该来源的当前在线用户
+// （回放的旧数据只补充采样和峰值，不覆盖当前状态）。同一服务有多个来源时，采样和峰值记录各来源的合计
+func updateOnlineUsers(tx *sql.Tx, serviceID int, source string, users map[string]int, at time.Time, current bool) error {
+	if current {
+		if _, err := tx.Exec(`DELETE FROM client_online WHERE service_id = ? AND source = ?`, serviceID, source); err != nil {
+			return err
+		}
+		for email, devices := range users {
+			if email == "" || devices <= 0 {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO client_online (service_id, source, email, devices, updated_at) VALUES (?, ?, ?, ?, ?)`,
+				serviceID, source, email, devices, at); err != nil {
+				return err
+			}
+		}
+	}
+	date := at.Local().Format("2006-01-02")
+	for email, devices := range users {
+		if email == "" || devices <= 0 {
+			continue
+		}
+		if current {
+			err := tx.QueryRow(`SELECT COALESCE(SUM(devices), 0) FROM client_online WHERE service_id = ? AND email = ? AND updated_at >= ?`,
+				serviceID, email, at.Add(-onlineStaleAfter)).Scan(&devices)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO client_online_samples (service_id, email, devices, sampled_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(service_id, email, sampled_at) DO NOTHING
+		`, serviceID, email, devices, at); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO client_online_daily (service_id, email, date, peak_devices, peak_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(service_id, email, date) DO UPDATE SET
+				peak_devices = MAX(peak_devices, excluded.peak_devices),
+				peak_at = CASE WHEN excluded.peak_devices > peak_devices THEN excluded.peak_at ELSE peak_at END
+		`, serviceID, email, date, devices, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 合并服务时迁移在线记录，同一用户同一天的峰值取较大值
+func moveOnlineRecords(tx *sql.Tx, sourceID int, targetID int) error {
+	if _, err := tx.Exec(`DELETE FROM client_online WHERE service_id = ?`, sourceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE OR IGNORE client_online_samples SET service_id = ? WHERE service_id = ?`, targetID, sourceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM client_online_samples WHERE service_id = ?`, sourceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO client_online_daily (service_id, email, date, peak_devices, peak_at)
+		SELECT ?, email, date, peak_devices, peak_at FROM client_online_daily WHERE service_id = ? AND 1
+		ON CONFLICT(service_id, email, date) DO UPDATE SET
+			peak_devices = MAX(peak_devices, excluded.peak_devices),
+			peak_at = CASE WHEN excluded.peak_devices > peak_devices THEN excluded.peak_at ELSE peak_at END
+	`, targetID, sourceID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM client_online_daily WHERE service_id = ?`, sourceID)
+	return err
+}
+
+// 删除超过保留时间（与每小时流量相同）的在线采样，返回删除的行数
+func (d *Database) PruneOnlineSamples() (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM client_online_samples WHERE sampled_at < ?`, time.Now().Add(-d.hourlyRetentionOrDefault()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// 服务当前在线的用户（多个来源的设备数合计，按设备数从多到少）
+func (d *Database) GetOnlineUsers(serviceID int) ([]OnlineUser, error) {
+	rows, err := d.db.Query(`
+		SELECT o.email, o.devices, o.updated_at, COALESCE(p.peak_devices, 0)
+		FROM client_online o
+		LEFT JOIN client_online_daily p ON p.service_id = o.service_id AND p.email = o.email AND p.date = ?
+		WHERE o.service_id = ? AND o.updated_at >= ?
+	`, time.Now().Format("2006-01-02"), serviceID, time.Now().Add(-onlineStaleAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]OnlineUser, 0)
+	index := make(map[string]int)
+	for rows.Next() {
+		var u OnlineUser
+		if err := rows.Scan(&u.Email, &u.Devices, &u.UpdatedAt, &u.TodayPeak); err != nil {
+			return nil, err
+		}
+		i, ok := index[u.Email]
+		if !ok {
+			index[u.Email] = len(users)
+			users = append(users, u)
+			continue
+		}
+		users[i].Devices += u.Devices
+		if u.UpdatedAt.After(users[i].UpdatedAt) {
+			users[i].UpdatedAt = u.UpdatedAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Devices != users[j].Devices {
+			return users[i].Devices > users[j].Devices
+		}
+		return users[i].Email < users[j].Email
+	})
+	return users, nil
+}
+
+// 最近days天每个用户每天的同时在线设备数峰值，email为空时返回服务的所有用户
+func (d *Database) GetOnlineDailyPeaks(serviceID int, email string, days int) ([]OnlineDailyPeak, error) {
+	query := `SELECT email, date, peak_devices, peak_at FROM client_online_daily WHERE service_id = ? AND date >= ?`
+	args := []interface{}{serviceID, time.Now().AddDate(0, 0, -(days - 1)).Format("2006-01-02")}
+	if email != "" {
+		query += " AND email = ?"
+		args = append(args, email)
+	}
+	query += " ORDER BY date DESC, peak_devices DESC, email"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peaks := make([]OnlineDailyPeak, 0)
+	for rows.Next() {
+		var p OnlineDailyPeak
+		var peakAt sql.NullTime
+		if err := rows.Scan(&p.Email, &p.Date, &p.PeakDevices, &peakAt); err != nil {
+			return nil, err
+		}
+		if peakAt.Valid {
+			p.PeakAt = &peakAt.Time
+		}
+		peaks = append(peaks, p)
+	}
+	return peaks, rows.Err()
+}
+
+// 用户最近一段时间的在线设备数采样
+func (d *Database) GetOnlineSamples(serviceID int, email string, since time.Time) ([]OnlineSample, error) {
+	rows, err := d.db.Query(`
+		SELECT devices, sampled_at FROM client_online_samples
+		WHERE service_id = ? AND email = ? AND sampled_at >= ?
+		ORDER BY sampled_at
+	`, serviceID, email, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]OnlineSample, 0)
+	for rows.Next() {
+		var s OnlineSample
+		if err := rows.Scan(&s.Devices, &s.SampledAt); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+func onlineDays(c *gin.Context) int {
+	days := 7
+	if d := c.Query("days"); d != "" {
+		if v, err := strconv.Atoi(d); err == nil && v > 0 && v <= 90 {
+			days = v
+		}
+	}
+	return days
+}
+
+// 获取服务当前在线用户和每日在线设备数峰值
+func (api *DatabaseAPI) GetServiceOnline(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	days := onlineDays(c)
+
+	users, err := api.db.GetOnlineUsers(serviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取在线用户失败: " + err.Error(),
+		})
+		return
+	}
+	peaks, err := api.db.GetOnlineDailyPeaks(serviceID, "", days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取在线峰值失败: " + err.Error(),
+		})
+		return
+	}
+	totalDevices := 0
+	for _, u := range users {
+		totalDevices += u.Devices
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取在线用户成功",
+		"data": gin.H{
+			"days":          days,
+			"online_users":  len(users),
+			"total_devices": totalDevices,
+			"users":         users,
+			"daily_peaks":   peaks,
+		},
+	})
+}
+
+// 获取单个用户的在线设备数、每日峰值和最近24小时的采样
+func (api *DatabaseAPI) GetUserOnline(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	email := c.Param("email")
+	days := onlineDays(c)
+
+	users, err := api.db.GetOnlineUsers(serviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取在线用户失败: " + err.Error(),
+		})
+		return
+	}
+	devices := 0
+	for _, u := range users {
+		if u.Email == email {
+			devices = u.Devices
+			break
+		}
+	}
+	peaks, err := api.db.GetOnlineDailyPeaks(serviceID, email, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取在线峰值失败: " + err.Error(),
+		})
+		return
+	}
+	samples, err := api.db.GetOnlineSamples(serviceID, email, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取在线采样失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取用户在线情况成功",
+		"data": gin.H{
+			"email":       email,
+			"days":        days,
+			"devices":     devices,
+			"daily_peaks": peaks,
+			"samples":     samples,
+		},
+	})
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// 一次带在线信息的hy2上报
+type onlinePush struct {
+	offset time.Duration // 相对当前时间
+	source string
+	users  map[string]int
+	replay bool
+}
+
+func pushOnline(t *testing.T, d *Database, now time.Time, p onlinePush) int {
+	t.Helper()
+	src := TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: now.Add(p.offset), Replay: p.replay}
+	return pushTestTraffic(t, d, src, &TrafficData{OnlineUsers: p.users, Source: p.source})
+}
+
+func TestOnlineUsers(t *testing.T) {
+	tests := []struct {
+		name        string
+		pushes      []onlinePush
+		wantDevices map[string]int // 当前在线设备数
+		wantSamples []int          // a@x 的采样
+		wantPeak    int            // a@x 最近两天的峰值
+	}{
+		{
+			name: "当前在线为最近一次上报，峰值取最大值",
+			pushes: []onlinePush{
+				{offset: -50 * time.Second, source: "hy2", users: map[string]int{"a@x": 2, "b@x": 1}},
+				{offset: -30 * time.Second, source: "hy2", users: map[string]int{"a@x": 3}},
+				{offset: -10 * time.Second, source: "hy2", users: map[string]int{"a@x": 1}},
+			},
+			wantDevices: map[string]int{"a@x": 1},
+			wantSamples: []int{2, 3, 1},
+			wantPeak:    3,
+		},
+		{
+			name: "多个来源的设备数相加",
+			pushes: []onlinePush{
+				{offset: -20 * time.Second, source: "hy2-a", users: map[string]int{"a@x": 2}},
+				{offset: -10 * time.Second, source: "hy2-b", users: map[string]int{"a@x": 1}},
+			},
+			wantDevices: map[string]int{"a@x": 3},
+			wantSamples: []int{2, 3},
+			wantPeak:    3,
+		},
+		{
+			name: "已停止同步的来源不计入",
+			pushes: []onlinePush{
+				{offset: -5 * time.Minute, source: "hy2-a", users: map[string]int{"a@x": 2}},
+				{offset: -10 * time.Second, source: "hy2-b", users: map[string]int{"a@x": 1}},
+			},
+			wantDevices: map[string]int{"a@x": 1},
+			wantSamples: []int{2, 1},
+			wantPeak:    2,
+		},
+		{
+			name: "用户下线后从当前在线中移除",
+			pushes: []onlinePush{
+				{offset: -20 * time.Second, source: "hy2", users: map[string]int{"a@x": 2, "b@x": 1}},
+				{offset: -10 * time.Second, source: "hy2", users: map[string]int{"b@x": 1}},
+			},
+			wantDevices: map[string]int{"b@x": 1},
+			wantSamples: []int{2},
+			wantPeak:    2,
+		},
+		{
+			name: "回放的旧数据只补充采样和峰值",
+			pushes: []onlinePush{
+				{offset: -10 * time.Second, source: "hy2", users: map[string]int{"a@x": 1}},
+				{offset: -40 * time.Second, source: "hy2", users: map[string]int{"a@x": 5}, replay: true},
+			},
+			wantDevices: map[string]int{"a@x": 1},
+			wantSamples: []int{5, 1},
+			wantPeak:    5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			now := time.Now()
+			var serviceID int
+			for _, p := range tt.pushes {
+				serviceID = pushOnline(t, d, now, p)
+			}
+
+			users, err := d.GetOnlineUsers(serviceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != len(tt.wantDevices) {
+				t.Errorf("在线用户 = %+v, 期望 %v", users, tt.wantDevices)
+			}
+			for _, u := range users {
+				if u.Devices != tt.wantDevices[u.Email] {
+					t.Errorf("%s 在线设备数 = %d, 期望 %d", u.Email, u.Devices, tt.wantDevices[u.Email])
+				}
+			}
+
+			samples, err := d.GetOnlineSamples(serviceID, "a@x", now.Add(-time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) != len(tt.wantSamples) {
+				t.Fatalf("采样 = %+v, 期望 %v", samples, tt.wantSamples)
+			}
+			for i, s := range samples {
+				if s.Devices != tt.wantSamples[i] {
+					t.Errorf("第%d个采样 = %d, 期望 %d", i, s.Devices, tt.wantSamples[i])
+				}
+			}
+
+			// 上报可能跨过零点，取两天中的最大值
+			peaks, err := d.GetOnlineDailyPeaks(serviceID, "a@x", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peak := 0
+			for _, p := range peaks {
+				if p.PeakDevices > peak {
+					peak = p.PeakDevices
+				}
+			}
+			if peak != tt.wantPeak {
+				t.Errorf("峰值 = %d, 期望 %d", peak, tt.wantPeak)
+			}
+		})
+	}
+}
+
+// 每日峰值按上报时间所在的日期分别记录
+func TestOnlineDailyPeaks(t *testing.T) {
+	d := openTestDatabase(t)
+	today := time.Now()
+	noon := func(daysAgo int) time.Time {
+		day := today.AddDate(0, 0, -daysAgo)
+		return time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, time.Local)
+	}
+	var serviceID int
+	for _, p := range []struct {
+		at    time.Time
+		users map[string]int
+	}{
+		{noon(2), map[string]int{"a@x": 4}},
+		{noon(2).Add(time.Hour), map[string]int{"a@x": 2, "b@x": 6}},
+		{noon(1), map[string]int{"a@x": 1}},
+		{noon(1).Add(time.Hour), map[string]int{"a@x": 3}},
+	} {
+		serviceID = pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: p.at, Replay: true}, &TrafficData{OnlineUsers: p.users, Source: "hy2"})
+	}
+
+	peaks, err := d.GetOnlineDailyPeaks(serviceID, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []OnlineDailyPeak{
+		{Email: "a@x", Date: noon(1).Format("2006-01-02"), PeakDevices: 3},
+		{Email: "b@x", Date: noon(2).Format("2006-01-02"), PeakDevices: 6},
+		{Email: "a@x", Date: noon(2).Format("2006-01-02"), PeakDevices: 4},
+	}
+	wantAt := []time.Time{noon(1).Add(time.Hour), noon(2).Add(time.Hour), noon(2)}
+	if len(peaks) != len(want) {
+		t.Fatalf("峰值 = %+v, 期望 %+v", peaks, want)
+	}
+	for i, p := range peaks {
+		if p.Email != want[i].Email || p.Date != want[i].Date || p.PeakDevices != want[i].PeakDevices {
+			t.Errorf("第%d个峰值 = %+v, 期望 %+v", i, p, want[i])
+		}
+		if p.PeakAt == nil || !p.PeakAt.Equal(wantAt[i]) {
+			t.Errorf("第%d个峰值时间 = %v, 期望 %v", i, p.PeakAt, wantAt[i])
+		}
+	}
+
+	// 只统计最近两天时不包含前天的峰值
+	if peaks, err := d.GetOnlineDailyPeaks(serviceID, "a@x", 2); err != nil || len(peaks) != 1 {
+		t.Errorf("最近两天的峰值 = %+v (%v), 期望只有昨天", peaks, err)
+	}
+}
+
+func TestPruneOnlineSamples(t *testing.T) {
+	d := openTestDatabase(t)
+	old := time.Now().Add(-d.hourlyRetentionOrDefault() - time.Hour)
+	serviceID := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: old, Replay: true}, &TrafficData{OnlineUsers: map[string]int{"a@x": 1}, Source: "hy2"})
+	pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, &TrafficData{OnlineUsers: map[string]int{"a@x": 2}, Source: "hy2"})
+
+	n, err := d.PruneOnlineSamples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("删除 %d 个采样, 期望 1", n)
+	}
+	samples, err := d.GetOnlineSamples(serviceID, "a@x", old.Add(-time.Hour))
+	if err != nil || len(samples) != 1 || samples[0].Devices != 2 {
+		t.Errorf("剩余采样 = %+v (%v), 期望只剩最近的一个", samples, err)
+	}
+	// 每日峰值不随采样清理
+	if peaks, err := d.GetOnlineDailyPeaks(serviceID, "a@x", 90); err != nil || len(peaks) != 2 {
+		t.Errorf("每日峰值 = %+v (%v), 期望保留2天", peaks, err)
+	}
+}
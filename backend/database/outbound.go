@@ -0,0 +1,265 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 出站流量分布中的一项
+type OutboundShare struct {
+	Tag        string  `json:"tag"`
+	CustomName string  `json:"custom_name"`
+	Up         int64   `json:"up"`
+	Down       int64   `json:"down"`
+	Total      int64   `json:"total"`
+	Percent    float64 `json:"percent"`
+}
+
+// 获取服务的全部出站记录及今日流量
+func (d *Database) getOutboundTraffics(serviceID int) ([]OutboundTrafficRecord, error) {
+	rows, err := d.db.Query(`
+		SELECT o.id, o.service_id, o.tag, o.custom_name, o.last_updated, o.status,
+			COALESCE(h.daily_up, 0), COALESCE(h.daily_down, 0)
+		FROM outbound_traffics o
+		LEFT JOIN outbound_traffic_history h ON h.outbound_traffic_id = o.id AND h.date = DATE('now', 'localtime')
+		WHERE o.service_id = ? AND o.status = 'active'
+		ORDER BY o.tag
+	`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]OutboundTrafficRecord, 0)
+	for rows.Next() {
+		var record OutboundTrafficRecord
+		var customName sql.NullString
+		err := rows.Scan(&record.ID, &record.ServiceID, &record.Tag, &customName, &record.LastUpdated, &record.Status,
+			&record.Up, &record.Down)
+		if err != nil {
+			return nil, err
+		}
+		record.CustomName = customName.String
+		record.Rate = d.recordRate(serviceID, outboundKind, record.Tag)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// 统计服务最近days天各出站标签的流量占比
+func (d *Database) GetOutboundBreakdown(serviceID int, days int) ([]OutboundShare, int64, error) {
+	rows, err := d.db.Query(`
+		SELECT o.tag, o.custom_name, COALESCE(SUM(h.daily_up), 0), COALESCE(SUM(h.daily_down), 0)
+		FROM outbound_traffics o
+		LEFT JOIN outbound_traffic_history h ON h.outbound_traffic_id = o.id
+			AND h.date >= DATE('now', ? || ' days', 'localtime') AND h.date <= DATE('now', 'localtime')
+		WHERE o.service_id = ?
+		GROUP BY o.id
+		ORDER BY SUM(h.daily_up) + SUM(h.daily_down) DESC, o.tag
+	`, fmt.Sprintf("-%d", days-1), serviceID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	shares := make([]OutboundShare, 0)
+	var total int64
+	for rows.Next() {
+		var share OutboundShare
+		var customName sql.NullString
+		if err := rows.Scan(&share.Tag, &customName, &share.Up, &share.Down); err != nil {
+			return nil, 0, err
+		}
+		share.CustomName = customName.String
+		share.Total = share.Up + share.Down
+		total += share.Total
+		shares = append(shares, share)
+	}
+	if total > 0 {
+		for i := range shares {
+			shares[i].Percent = float64(shares[i].Total) * 100 / float64(total)
+		}
+	}
+	return shares, total, nil
+}
+
+// 获取服务的出站流量分布
+func (api *DatabaseAPI) GetServiceOutbounds(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	days := 7
+	if d := c.Query("days"); d != "" {
+		if v, err := strconv.Atoi(d); err == nil && v > 0 && v <= 90 {
+			days = v
+		}
+	}
+
+	outbounds, err := api.db.getOutboundTraffics(serviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "获取出站流量失败: " + err.Error(),
+		})
+		return
+	}
+	shares, total, err := api.db.GetOutboundBreakdown(serviceID, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "统计出站流量失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取出站流量成功",
+		"data": gin.H{
+			"days":      days,
+			"total":     total,
+			"today":     outbounds,
+			"breakdown": shares,
+		},
+	})
+}
+
+// 获取出站标签详情（与端口详情结构一致）
+func (api *DatabaseAPI) GetOutboundDetail(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	tag := c.Param("tag")
+
+	var recordID int
+	var ip string
+	var customName sql.NullString
+	var lastUpdated time.Time
+	err = api.db.db.QueryRow(`
+		SELECT o.id, s.ip_address, o.custom_name, o.last_updated
+		FROM outbound_traffics o
+		JOIN services s ON o.service_id = s.id
+		WHERE o.service_id = ? AND o.tag = ?
+	`, serviceID, tag).Scan(&recordID, &ip, &customName, &lastUpdated)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "出站信息不存在: " + err.Error(),
+		})
+		return
+	}
+
+	var currentUp, currentDown, totalUp, totalDown int64
+	api.db.db.QueryRow(`
+		SELECT COALESCE(daily_up, 0), COALESCE(daily_down, 0) FROM outbound_traffic_history
+		WHERE outbound_traffic_id = ? AND date = DATE('now', 'localtime')
+	`, recordID).Scan(&currentUp, &currentDown)
+	api.db.db.QueryRow(`
+		SELECT COALESCE(SUM(daily_up), 0), COALESCE(SUM(daily_down), 0) FROM outbound_traffic_history
+		WHERE outbound_traffic_id = ?
+	`, recordID).Scan(&totalUp, &totalDown)
+
+	days := 7
+	if d := c.Query("days"); d != "" {
+		if v, err := strconv.Atoi(d); err == nil && v > 0 && v <= 30 {
+			days = v
+		}
+	}
+
+	rows, err := api.db.db.Query(`
+		SELECT date, daily_up, daily_down FROM outbound_traffic_history
+		WHERE outbound_traffic_id = ? AND date >= DATE('now', ? || ' days', 'localtime') AND date <= DATE('now', 'localtime')
+	`, recordID, fmt.Sprintf("-%d", days-1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询历史数据失败: " + err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	historyMap := make(map[string][2]int64)
+	for rows.Next() {
+		var date string
+		var dailyUp, dailyDown int64
+		if err := rows.Scan(&date, &dailyUp, &dailyDown); err != nil {
+			continue
+		}
+		if len(date) > 10 {
+			date = date[:10]
+		}
+		historyMap[date] = [2]int64{dailyUp, dailyDown}
+	}
+
+	// 补全最近days天，没有数据的日期为0
+	history := make([]map[string]interface{}, days)
+	for i := 0; i < days; i++ {
+		date := time.Now().In(time.Local).AddDate(0, 0, -(days - 1 - i)).Format("2006-01-02")
+		v := historyMap[date]
+		history[i] = map[string]interface{}{
+			"date":        date,
+			"daily_up":    v[0],
+			"daily_down":  v[1],
+			"total_daily": v[0] + v[1],
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "获取出站详情成功",
+		"data": gin.H{
+			"outbound_info": gin.H{
+				"ip":           ip,
+				"tag":          tag,
+				"total_up":     totalUp,
+				"total_down":   totalDown,
+				"current_up":   currentUp,
+				"current_down": currentDown,
+				"last_seen":    lastUpdated,
+				"custom_name":  customName.String,
+				"rate":         api.db.recordRate(serviceID, outboundKind, tag),
+			},
+			"history": history,
+		},
+	})
+}
+
+// 更新出站标签的自定义名称
+func (api *DatabaseAPI) UpdateOutboundCustomName(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("service_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	tag := c.Param("tag")
+	var request struct {
+		CustomName string `json:"custom_name"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	api.updateCustomName(c, "outbound_traffics", map[string]interface{}{"service_id": serviceID, "tag": tag}, request.CustomName)
+}
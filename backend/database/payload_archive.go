@@ -0,0 +1,409 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 归档记录的处理结果
+const (
+	PayloadOutcomeOK      = "ok"        // 解析并入库成功
+	PayloadOutcomeInvalid = "invalid"   // 请求体不是有效的流量数据
+	PayloadOutcomeError   = "error"     // 入库失败
+	PayloadOutcomeDup     = "duplicate" // 重复推送，已忽略
+	PayloadOutcomeQueued  = "queued"    // 已进入写入队列，尚未处理
+)
+
+// 归档数据的格式，回放时按格式解析
+const (
+	PayloadFormatTraffic = "traffic" // 3x-ui推送格式（/api/traffic、hy2和Xray采集）
+	PayloadFormatBatch   = "v2"      // 通用批量上报格式（/api/v2/ingest）
+)
+
+// 原始上报数据归档配置，MaxRows为0表示未启用
+type payloadArchiveConfig struct {
+	MaxRows int
+	MaxAge  time.Duration
+}
+
+// 原始上报数据归档记录
+type PayloadRecord struct {
+	ID         int64     `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	ClientIP   string    `json:"client_ip"`
+	NodeID     string    `json:"node_id"`
+	ServiceID  int       `json:"service_id"`
+	UserAgent  string    `json:"user_agent"`
+	Headers    string    `json:"headers"`
+	Body       string    `json:"body,omitempty"`
+	Format     string    `json:"format"`
+	BodySize   int       `json:"body_size"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error"`
+}
+
+// 回放参数错误
+var ErrInvalidReplay = errors.New("回放参数无效")
+
+// 单条回放结果
+type ReplayResult struct {
+	ID      int64  `json:"id"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// 回放目标数据库文件名（只允许放在主数据库同目录下）
+var replayTargetNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+\.db$`)
+
+// 启用原始上报数据归档，按条数和保存时间限制归档大小
+func (d *Database) EnablePayloadArchive(maxRows int, maxAge time.Duration) {
+	d.archive = payloadArchiveConfig{MaxRows: maxRows, MaxAge: maxAge}
+}
+
+// 是否启用了原始上报数据归档
+func (d *Database) PayloadArchiveEnabled() bool {
+	return d.archive.MaxRows > 0
+}
+
+// 归档一条原始上报数据，过期和超量的记录由定时任务清理
+func (d *Database) ArchivePayload(rec *PayloadRecord) error {
+	if !d.PayloadArchiveEnabled() {
+		return nil
+	}
+	if rec.ReceivedAt.IsZero() {
+		rec.ReceivedAt = time.Now()
+	}
+	if rec.Format == "" {
+		rec.Format = PayloadFormatTraffic
+	}
+	var serviceID interface{}
+	if rec.ServiceID > 0 {
+		serviceID = rec.ServiceID
+	}
+	result, err := d.db.Exec(`
+		INSERT INTO ingest_payloads (received_at, client_ip, node_id, service_id, user_agent, headers, body, format, body_size, outcome, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rec.ReceivedAt, rec.ClientIP, rec.NodeID, serviceID, rec.UserAgent, rec.Headers, rec.Body, rec.Format, len(rec.Body), rec.Outcome, rec.Error)
+	if err != nil {
+		return err
+	}
+	rec.ID, _ = result.LastInsertId()
+	rec.BodySize = len(rec.Body)
+	return nil
+}
+
+// 清理过期和超出条数限制的归档记录，返回删除的行数
+func (d *Database) PrunePayloadArchive() (int64, error) {
+	if !d.PayloadArchiveEnabled() {
+		return 0, nil
+	}
+	var total int64
+	if d.archive.MaxAge > 0 {
+		result, err := d.db.Exec(`DELETE FROM ingest_payloads WHERE received_at < ?`, time.Now().Add(-d.archive.MaxAge))
+		if err != nil {
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	result, err := d.db.Exec(`
+		DELETE FROM ingest_payloads
+		WHERE id <= (SELECT id FROM ingest_payloads ORDER BY id DESC LIMIT 1 OFFSET ?)
+	`, d.archive.MaxRows)
+	if err != nil {
+		return total, err
+	}
+	n, _ := result.RowsAffected()
+	return total + n, nil
+}
+
+// 更新归档记录的处理结果（异步写入完成后调用）
+func (d *Database) UpdatePayloadOutcome(id int64, outcome string, errMsg string) error {
+	if !d.PayloadArchiveEnabled() {
+		return nil
+	}
+	_, err := d.db.Exec(`UPDATE ingest_payloads SET outcome = ?, error = ? WHERE id = ?`, outcome, errMsg, id)
+	return err
+}
+
+// 分页查询归档记录（不包含请求体）
+func (d *Database) ListPayloads(serviceID int, outcome string, limit int, offset int) ([]PayloadRecord, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if serviceID > 0 {
+		where += " AND service_id = ?"
+		args = append(args, serviceID)
+	}
+	if outcome != "" {
+		where += " AND outcome = ?"
+		args = append(args, outcome)
+	}
+
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(id) FROM ingest_payloads"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query(`
+		SELECT id, received_at, client_ip, node_id, service_id, user_agent, headers, format, body_size, outcome, error
+		FROM ingest_payloads`+where+` ORDER BY id DESC LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := make([]PayloadRecord, 0)
+	for rows.Next() {
+		rec, err := scanPayload(rows, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, *rec)
+	}
+	return records, total, nil
+}
+
+// 获取单条归档记录（包含请求体）
+func (d *Database) GetPayload(id int64) (*PayloadRecord, error) {
+	row := d.db.QueryRow(`
+		SELECT id, received_at, client_ip, node_id, service_id, user_agent, headers, format, body_size, outcome, error, body
+		FROM ingest_payloads WHERE id = ?
+	`, id)
+	return scanPayload(row, true)
+}
+
+// 可扫描一行结果的对象（*sql.Row 或 *sql.Rows）
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPayload(row rowScanner, withBody bool) (*PayloadRecord, error) {
+	var rec PayloadRecord
+	var nodeID, userAgent, headers, errMsg sql.NullString
+	var serviceID sql.NullInt64
+	dest := []interface{}{&rec.ID, &rec.ReceivedAt, &rec.ClientIP, &nodeID, &serviceID, &userAgent, &headers, &rec.Format, &rec.BodySize, &rec.Outcome, &errMsg}
+	if withBody {
+		dest = append(dest, &rec.Body)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	rec.NodeID = nodeID.String
+	rec.ServiceID = int(serviceID.Int64)
+	rec.UserAgent = userAgent.String
+	rec.Headers = headers.String
+	rec.Error = errMsg.String
+	return &rec, nil
+}
+
+// 将归档的原始数据按接收顺序重新解析并写入数据库
+// targetName为空时写入当前数据库，否则写入主数据库同目录下的指定文件（不存在时新建）
+func (d *Database) ReplayPayloads(ids []int64, targetName string) ([]ReplayResult, error) {
+	target := d
+	if targetName != "" {
+		if !replayTargetNameRe.MatchString(targetName) {
+			return nil, fmt.Errorf("%w: 目标数据库文件名只能包含字母、数字、下划线、点和横线，并以.db结尾", ErrInvalidReplay)
+		}
+		targetPath := filepath.Join(filepath.Dir(d.path), targetName)
+		if filepath.Clean(targetPath) == filepath.Clean(d.path) {
+			return nil, fmt.Errorf("%w: 目标数据库不能与当前数据库相同，回放到当前数据库请留空文件名", ErrInvalidReplay)
+		}
+		if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+			log.Printf("回放目标数据库不存在，将新建: %s", targetPath)
+		}
+		opened, err := OpenDatabase(targetPath)
+		if err != nil {
+			return nil, err
+		}
+		defer opened.Close()
+		target = opened
+	}
+
+	// 按ID排序保证与原始接收顺序一致
+	records := make([]*PayloadRecord, 0, len(ids))
+	for _, id := range ids {
+		rec, err := d.GetPayload(id)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: 归档记录不存在: %d", ErrInvalidReplay, id)
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+
+	results := make([]ReplayResult, 0, len(records))
+	for _, rec := range records {
+		result := ReplayResult{ID: rec.ID, Outcome: PayloadOutcomeOK}
+		src := TrafficSource{
+			ClientIP:   rec.ClientIP,
+			NodeID:     rec.NodeID,
+			UserAgent:  rec.UserAgent,
+			ReceivedAt: rec.ReceivedAt,
+			Replay:     true,
+		}
+		// token绑定的服务只在原数据库中有意义
+		if target == d {
+			src.ServiceID = rec.ServiceID
+		}
+		if err := target.replayPayload(src, rec); errors.Is(err, ErrInvalidTrafficData) {
+			result.Outcome = PayloadOutcomeInvalid
+			result.Error = err.Error()
+		} else if err != nil {
+			result.Outcome = PayloadOutcomeError
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// 按归档格式解析并写入一条归档数据
+func (d *Database) replayPayload(src TrafficSource, rec *PayloadRecord) error {
+	switch rec.Format {
+	case PayloadFormatBatch:
+		batch, err := ParseIngestBatch([]byte(rec.Body), rec.ReceivedAt)
+		if err != nil {
+			return err
+		}
+		batch.SetDefaultNode(rec.NodeID)
+		src.NodeID = batch.NodeID
+		_, err = d.IngestBatch(src, rec.Body, batch)
+		return err
+	case PayloadFormatTraffic, "":
+		var trafficData TrafficData
+		if err := json.Unmarshal([]byte(rec.Body), &trafficData); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTrafficData, err)
+		}
+		return d.ProcessTrafficData(src, rec.Body, &trafficData)
+	default:
+		return fmt.Errorf("%w: 不支持的归档格式 %s", ErrInvalidTrafficData, rec.Format)
+	}
+}
+
+// 查询归档的原始上报数据
+func (api *DatabaseAPI) GetPayloads(c *gin.Context) {
+	limit := 50
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 500 {
+		limit = v
+	}
+	offset := 0
+	if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	serviceID, _ := strconv.Atoi(c.Query("service_id"))
+
+	records, total, err := api.db.ListPayloads(serviceID, c.Query("outcome"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询归档数据失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "查询归档数据成功",
+		"data": gin.H{
+			"enabled": api.db.PayloadArchiveEnabled(),
+			"total":   total,
+			"records": records,
+		},
+	})
+}
+
+// 获取单条归档数据
+func (api *DatabaseAPI) GetPayload(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的归档ID",
+		})
+		return
+	}
+
+	record, err := api.db.GetPayload(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "归档记录不存在",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询归档数据失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "查询归档数据成功",
+		"data":    record,
+	})
+}
+
+// 回放归档数据
+func (api *DatabaseAPI) ReplayPayloads(c *gin.Context) {
+	var request struct {
+		IDs        []int64 `json:"ids"`
+		TargetName string  `json:"target_name"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误: " + err.Error(),
+		})
+		return
+	}
+	if len(request.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请选择要回放的归档记录",
+		})
+		return
+	}
+
+	results, err := api.db.ReplayPayloads(request.IDs, request.TargetName)
+	if errors.Is(err, ErrInvalidReplay) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "回放失败: " + err.Error(),
+		})
+		return
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Outcome != PayloadOutcomeOK {
+			failed++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": fmt.Sprintf("回放完成，成功%d条，失败%d条", len(results)-failed, failed),
+		"data":    results,
+	})
+}
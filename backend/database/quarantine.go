@@ -0,0 +1,455 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上报数据不合法（例如负数流量），整次上报被拒绝
+var ErrInvalidTrafficData = errors.New("流量数据不合法")
+
+// 隔离样本状态
+const (
+	QuarantinePending   = "pending"   // 待处理
+	QuarantineApproved  = "approved"  // 已确认并写入历史
+	QuarantineDiscarded = "discarded" // 已丢弃
+)
+
+// 异常流量阈值配置
+type quarantineConfig struct {
+	// 没有服务阈值和历史数据时使用的默认阈值，0表示不限制
+	DefaultBytes int64
+	// 学习阈值 = 近30天单日最大流量 × LearnFactor，0表示不学习
+	LearnFactor int64
+	// 学习阈值的下限，避免历史流量很小的记录被误判
+	MinBytes int64
+}
+
+var defaultQuarantineConfig = quarantineConfig{
+	DefaultBytes: 1 << 40,
+	LearnFactor:  10,
+	MinBytes:     10 << 30,
+}
+
+// 隔离区中的一条样本
+type QuarantineSample struct {
+	ID         int64      `json:"id"`
+	ServiceID  int        `json:"service_id"`
+	Kind       string     `json:"kind"`
+	Key        string     `json:"key"`
+	Up         int64      `json:"up"`
+	Down       int64      `json:"down"`
+	Threshold  int64      `json:"threshold"`
+	Reason     string     `json:"reason"`
+	ReceivedAt time.Time  `json:"received_at"`
+	Status     string     `json:"status"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+}
+
+// 一次上报处理过程中使用的阈值信息
+type sampleGuard struct {
+	serviceThreshold int64
+}
+
+// 各记录近30天单日最大流量的缓存，按天刷新，避免每次上报都扫描历史表；
+// 合并、迁移、导入等直接修改历史的操作完成后清空
+type learnedThresholds struct {
+	mu       sync.Mutex
+	day      string
+	maxDaily map[string]int64 // 键为 kind|记录ID
+}
+
+func newLearnedThresholds() *learnedThresholds {
+	return &learnedThresholds{maxDaily: make(map[string]int64)}
+}
+
+func (l *learnedThresholds) get(day string, key string) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.day != day {
+		l.day = day
+		l.maxDaily = make(map[string]int64)
+		return 0, false
+	}
+	maxDaily, ok := l.maxDaily[key]
+	return maxDaily, ok
+}
+
+func (l *learnedThresholds) set(day string, key string, maxDaily int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.day == day {
+		l.maxDaily[key] = maxDaily
+	}
+}
+
+func (l *learnedThresholds) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxDaily = make(map[string]int64)
+}
+
+// 设置异常流量阈值
+func (d *Database) SetQuarantineConfig(defaultBytes int64, learnFactor int64, minBytes int64) {
+	d.quarantine = quarantineConfig{DefaultBytes: defaultBytes, LearnFactor: learnFactor, MinBytes: minBytes}
+}
+
+// 校验上报数据，拒绝负数流量和负数在线设备数
+func ValidateTrafficData(trafficData *TrafficData) error {
+	for _, t := range trafficData.InboundTraffics {
+		if t.Up < 0 || t.Down < 0 {
+			return fmt.Errorf("%w: 入站 %s 的流量为负数", ErrInvalidTrafficData, t.Tag)
+		}
+	}
+	for _, t := range trafficData.ClientTraffics {
+		if t.Up < 0 || t.Down < 0 {
+			return fmt.Errorf("%w: 客户端 %s 的流量为负数", ErrInvalidTrafficData, t.Email)
+		}
+	}
+	for user, devices := range trafficData.OnlineUsers {
+		if devices < 0 {
+			return fmt.Errorf("%w: 用户 %s 的在线设备数为负数", ErrInvalidTrafficData, user)
+		}
+	}
+	if len(trafficData.Source) > 128 {
+		return fmt.Errorf("%w: 上报来源过长", ErrInvalidTrafficData)
+	}
+	return nil
+}
+
+func (d *Database) newSampleGuard(tx *sql.Tx, serviceID int) (*sampleGuard, error) {
+	guard := &sampleGuard{}
+	err := tx.QueryRow("SELECT sample_threshold_bytes FROM services WHERE id = ?", serviceID).Scan(&guard.serviceThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+// 计算样本的阈值：服务阈值优先，其次按历史学习，最后使用默认阈值；返回0表示不限制
+func (d *Database) sampleThreshold(tx *sql.Tx, guard *sampleGuard, kind trafficKind, recordID int) (int64, string, error) {
+	if guard.serviceThreshold > 0 {
+		return guard.serviceThreshold, "超过服务设定的单次上报阈值", nil
+	}
+	if d.quarantine.LearnFactor > 0 {
+		day := time.Now().Format("2006-01-02")
+		cacheKey := kind.name + "|" + strconv.Itoa(recordID)
+		maxDaily, ok := d.thresholds.get(day, cacheKey)
+		if !ok {
+			err := tx.QueryRow(`
+				SELECT COALESCE(MAX(daily_up + daily_down), 0) FROM `+kind.historyTable+`
+				WHERE `+kind.idColumn+` = ? AND date >= DATE('now', 'localtime', '-30 days')
+			`, recordID).Scan(&maxDaily)
+			if err != nil {
+				return 0, "", err
+			}
+			// 没有历史的新记录不缓存，产生历史后即可按历史学习
+			if maxDaily > 0 {
+				d.thresholds.set(day, cacheKey, maxDaily)
+			}
+		}
+		if maxDaily > 0 {
+			threshold := int64(math.MaxInt64)
+			if maxDaily <= math.MaxInt64/d.quarantine.LearnFactor {
+				threshold = maxDaily * d.quarantine.LearnFactor
+			}
+			if threshold < d.quarantine.MinBytes {
+				threshold = d.quarantine.MinBytes
+			}
+			return threshold, fmt.Sprintf("超过近30天单日最大流量的%d倍", d.quarantine.LearnFactor), nil
+		}
+	}
+	return d.quarantine.DefaultBytes, "超过默认单次上报阈值", nil
+}
+
+// 样本超过阈值时写入隔离区，返回是否已隔离
+func (d *Database) quarantineSample(tx *sql.Tx, guard *sampleGuard, kind trafficKind, recordID int, serviceID int, key string, up int64, down int64, at time.Time) (bool, error) {
+	threshold, reason, err := d.sampleThreshold(tx, guard, kind, recordID)
+	if err != nil || threshold <= 0 {
+		return false, err
+	}
+	// up、down均非负，用减法比较避免相加溢出
+	if up <= threshold-down {
+		return false, nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO traffic_quarantine (service_id, kind, record_key, up, down, threshold, reason, received_at, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, serviceID, kind.name, key, up, down, threshold, reason, at, QuarantinePending)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("异常流量样本已隔离: 服务%d %s %s 上传:%s 下载:%s（%s）", serviceID, kind.name, key, d.formatBytes(up), d.formatBytes(down), reason)
+	return true, nil
+}
+
+// 查询隔离区样本
+func (d *Database) ListQuarantine(serviceID int, status string, limit int, offset int) ([]QuarantineSample, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if serviceID > 0 {
+		where += " AND service_id = ?"
+		args = append(args, serviceID)
+	}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(id) FROM traffic_quarantine"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query(`
+		SELECT id, service_id, kind, record_key, up, down, threshold, reason, received_at, status, resolved_at
+		FROM traffic_quarantine`+where+` ORDER BY id DESC LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	samples := make([]QuarantineSample, 0)
+	for rows.Next() {
+		sample, err := scanQuarantineSample(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		samples = append(samples, *sample)
+	}
+	return samples, total, nil
+}
+
+func scanQuarantineSample(row rowScanner) (*QuarantineSample, error) {
+	var s QuarantineSample
+	var reason sql.NullString
+	var resolvedAt sql.NullTime
+	err := row.Scan(&s.ID, &s.ServiceID, &s.Kind, &s.Key, &s.Up, &s.Down, &s.Threshold, &reason, &s.ReceivedAt, &s.Status, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.Reason = reason.String
+	if resolvedAt.Valid {
+		s.ResolvedAt = &resolvedAt.Time
+	}
+	return &s, nil
+}
+
+// 处理一条待处理的隔离样本：approve为true时按接收时间写入历史，否则丢弃
+func (d *Database) ResolveQuarantine(id int64, approve bool) (*QuarantineSample, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sample, err := scanQuarantineSample(tx.QueryRow(`
+		SELECT id, service_id, kind, record_key, up, down, threshold, reason, received_at, status, resolved_at
+		FROM traffic_quarantine WHERE id = ? AND status = ?
+	`, id, QuarantinePending))
+	if err != nil {
+		return nil, err
+	}
+
+	status := QuarantineDiscarded
+	if approve {
+		status = QuarantineApproved
+		kind, ok := kindByName(sample.Kind)
+		if !ok {
+			return nil, fmt.Errorf("未知的记录类型: %s", sample.Kind)
+		}
+		var recordID int
+		err := tx.QueryRow("SELECT id FROM "+kind.table+" WHERE service_id = ? AND "+kind.keyColumn+" = ?", sample.ServiceID, sample.Key).Scan(&recordID)
+		if err == sql.ErrNoRows {
+			// 记录在隔离后被删除或迁移，重新创建
+			var result sql.Result
+			switch kind {
+			case inboundKind:
+				result, err = tx.Exec(`INSERT INTO inbound_traffics (service_id, tag, port, last_updated, status) VALUES (?, ?, ?, ?, 'active')`,
+					sample.ServiceID, sample.Key, d.extractPortFromTag(sample.Key), sample.ReceivedAt)
+			case outboundKind:
+				result, err = tx.Exec(`INSERT INTO outbound_traffics (service_id, tag, last_updated, status) VALUES (?, ?, ?, 'active')`,
+					sample.ServiceID, sample.Key, sample.ReceivedAt)
+			default:
+				result, err = tx.Exec(`INSERT INTO client_traffics (service_id, email, last_updated, status) VALUES (?, ?, ?, 'active')`,
+					sample.ServiceID, sample.Key, sample.ReceivedAt)
+			}
+			if err != nil {
+				return nil, err
+			}
+			recordID64, _ := result.LastInsertId()
+			recordID = int(recordID64)
+		} else if err != nil {
+			return nil, err
+		}
+		if err := addTrafficHistory(tx, kind, recordID, sample.ServiceID, sample.Key, sample.Up, sample.Down, sample.ReceivedAt, true); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE traffic_quarantine SET status = ?, resolved_at = ? WHERE id = ?", status, now, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.thresholds.reset()
+	sample.Status = status
+	sample.ResolvedAt = &now
+	log.Printf("隔离样本 %d 已处理: %s", id, status)
+	return sample, nil
+}
+
+// 设置服务的单次上报阈值（字节），0表示使用学习阈值或默认阈值
+func (d *Database) SetServiceSampleThreshold(serviceID int, thresholdBytes int64) error {
+	result, err := d.db.Exec("UPDATE services SET sample_threshold_bytes = ? WHERE id = ?", thresholdBytes, serviceID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// 查询隔离区样本
+func (api *DatabaseAPI) GetQuarantine(c *gin.Context) {
+	limit := 50
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 500 {
+		limit = v
+	}
+	offset := 0
+	if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	serviceID, _ := strconv.Atoi(c.Query("service_id"))
+	status := c.DefaultQuery("status", QuarantinePending)
+	if status == "all" {
+		status = ""
+	}
+
+	samples, total, err := api.db.ListQuarantine(serviceID, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "查询隔离样本失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "查询隔离样本成功",
+		"data": gin.H{
+			"total":   total,
+			"samples": samples,
+		},
+	})
+}
+
+// 确认隔离样本并写入历史
+func (api *DatabaseAPI) ApproveQuarantine(c *gin.Context) {
+	api.resolveQuarantine(c, true)
+}
+
+// 丢弃隔离样本
+func (api *DatabaseAPI) DiscardQuarantine(c *gin.Context) {
+	api.resolveQuarantine(c, false)
+}
+
+func (api *DatabaseAPI) resolveQuarantine(c *gin.Context, approve bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的样本ID",
+		})
+		return
+	}
+
+	sample, err := api.db.ResolveQuarantine(id, approve)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "样本不存在或已处理",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "处理隔离样本失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "样本已丢弃"
+	if approve {
+		message = "样本已写入历史"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": message,
+		"data":    sample,
+	})
+}
+
+// 设置服务的单次上报阈值
+func (api *DatabaseAPI) UpdateServiceSampleThreshold(c *gin.Context) {
+	serviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "无效的服务ID",
+		})
+		return
+	}
+	var request struct {
+		ThresholdBytes int64 `json:"threshold_bytes"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.ThresholdBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请求参数错误，threshold_bytes必须为非负整数",
+		})
+		return
+	}
+
+	err = api.db.SetServiceSampleThreshold(serviceID, request.ThresholdBytes)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "服务不存在",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "设置阈值失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "阈值设置成功",
+		"data": gin.H{
+			"service_id":      serviceID,
+			"threshold_bytes": request.ThresholdBytes,
+		},
+	})
+}
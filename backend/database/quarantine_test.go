@@ -0,0 +1,133 @@
+package database
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSampleThreshold(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           quarantineConfig
+		serviceThreshold int64
+		history          int64 // 昨天的流量，0表示没有历史
+		sample           int64
+		wantThreshold    int64
+		wantQuarantined  bool
+	}{
+		{name: "没有历史使用默认阈值", config: quarantineConfig{DefaultBytes: 1000, LearnFactor: 10}, sample: 1001, wantThreshold: 1000, wantQuarantined: true},
+		{name: "等于阈值不隔离", config: quarantineConfig{DefaultBytes: 1000, LearnFactor: 10}, sample: 1000, wantThreshold: 1000},
+		{name: "默认阈值为0不限制", config: quarantineConfig{}, sample: math.MaxInt64 / 2, wantThreshold: 0},
+		{name: "按历史学习", config: quarantineConfig{DefaultBytes: 1 << 40, LearnFactor: 10}, history: 100, sample: 1001, wantThreshold: 1000, wantQuarantined: true},
+		{name: "学习阈值不低于下限", config: quarantineConfig{DefaultBytes: 1 << 40, LearnFactor: 10, MinBytes: 5000}, history: 100, sample: 4000, wantThreshold: 5000},
+		{name: "未启用学习", config: quarantineConfig{DefaultBytes: 1000}, history: 500, sample: 1001, wantThreshold: 1000, wantQuarantined: true},
+		{name: "服务阈值优先", config: quarantineConfig{DefaultBytes: 1000, LearnFactor: 10}, serviceThreshold: 50, history: 100, sample: 51, wantThreshold: 50, wantQuarantined: true},
+		{name: "学习阈值溢出", config: quarantineConfig{DefaultBytes: 1000, LearnFactor: 10}, history: math.MaxInt64 / 5, sample: math.MaxInt64 / 2, wantThreshold: math.MaxInt64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			d.SetQuarantineConfig(0, 0, 0)
+			src := TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: time.Now().AddDate(0, 0, -1)}
+			serviceID := pushTestTraffic(t, d, src, inboundData("in-1", tt.history, 0))
+			if tt.serviceThreshold > 0 {
+				if err := d.SetServiceSampleThreshold(serviceID, tt.serviceThreshold); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d.quarantine = tt.config
+
+			tx, err := d.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			guard, err := d.newSampleGuard(tx, serviceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var recordID int
+			if err := tx.QueryRow("SELECT id FROM inbound_traffics WHERE service_id = ?", serviceID).Scan(&recordID); err != nil {
+				t.Fatal(err)
+			}
+			threshold, _, err := d.sampleThreshold(tx, guard, inboundKind, recordID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if threshold != tt.wantThreshold {
+				t.Errorf("阈值 = %d, 期望 %d", threshold, tt.wantThreshold)
+			}
+			quarantined, err := d.quarantineSample(tx, guard, inboundKind, recordID, serviceID, "in-1", tt.sample, 0, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quarantined != tt.wantQuarantined {
+				t.Errorf("隔离 = %v, 期望 %v", quarantined, tt.wantQuarantined)
+			}
+		})
+	}
+}
+
+// 学习阈值按天缓存，直接修改历史的操作（如确认隔离样本）后重新计算
+func TestLearnedThresholdCache(t *testing.T) {
+	d := openTestDatabase(t)
+	d.SetQuarantineConfig(0, 0, 0)
+	src := TrafficSource{ClientIP: "10.0.0.1", ReceivedAt: time.Now().AddDate(0, 0, -1)}
+	pushTestTraffic(t, d, src, inboundData("in-1", 100, 0))
+	d.SetQuarantineConfig(1<<40, 10, 0)
+
+	today := TrafficSource{ClientIP: "10.0.0.1"}
+	if err := d.ProcessTrafficData(today, "", inboundData("in-1", 5000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	samples, _, err := d.ListQuarantine(0, QuarantinePending, 10, 0)
+	if err != nil || len(samples) != 1 {
+		t.Fatalf("隔离样本 = %v (%v), 期望 1 条", samples, err)
+	}
+	if samples[0].Threshold != 1000 {
+		t.Errorf("阈值 = %d, 期望 1000", samples[0].Threshold)
+	}
+
+	// 确认后今天的流量为5000，学习阈值提高到50000
+	if _, err := d.ResolveQuarantine(samples[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ProcessTrafficData(today, "", inboundData("in-1", 40000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, total, _ := d.ListQuarantine(0, QuarantinePending, 10, 0); total != 0 {
+		t.Errorf("确认样本后仍按旧的学习阈值隔离")
+	}
+}
+
+func TestResolveQuarantine(t *testing.T) {
+	for _, approve := range []bool{true, false} {
+		d := openTestDatabase(t)
+		d.SetQuarantineConfig(1000, 0, 0)
+		serviceID := pushTestTraffic(t, d, TrafficSource{ClientIP: "10.0.0.1"}, inboundData("in-1", 2000, 10))
+		samples, _, _ := d.ListQuarantine(serviceID, "", 10, 0)
+		if len(samples) != 1 {
+			t.Fatalf("隔离样本 = %d 条, 期望 1", len(samples))
+		}
+
+		sample, err := d.ResolveQuarantine(samples[0].ID, approve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantStatus, wantUp := QuarantineDiscarded, int64(0)
+		if approve {
+			wantStatus, wantUp = QuarantineApproved, 2000
+		}
+		if sample.Status != wantStatus {
+			t.Errorf("状态 = %s, 期望 %s", sample.Status, wantStatus)
+		}
+		if up, _ := inboundHistoryTotal(t, d, serviceID, "in-1"); up != wantUp {
+			t.Errorf("approve=%v: 历史上传 = %d, 期望 %d", approve, up, wantUp)
+		}
+		// 已处理的样本不能再次处理
+		if _, err := d.ResolveQuarantine(samples[0].ID, approve); err == nil {
+			t.Errorf("重复处理样本应失败")
+		}
+	}
+}
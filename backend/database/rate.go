@@ -0,0 +1,214 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 速率窗口：峰值速率在该时间内统计
+	rateWindow = 10 * time.Minute
+	// 两次推送间隔超过该时间时不计算速率（节点离线后重新上线）
+	rateMaxGap = 5 * time.Minute
+	// 超过该时间没有新的推送时当前速率视为0
+	rateStaleAfter = 2 * time.Minute
+)
+
+// 实时速率（字节/秒）
+type Rate struct {
+	UpBps       float64    `json:"up_bps"`
+	DownBps     float64    `json:"down_bps"`
+	PeakUpBps   float64    `json:"peak_up_bps"`
+	PeakDownBps float64    `json:"peak_down_bps"`
+	UpdatedAt   *time.Time `json:"updated_at"`
+}
+
+type rateSample struct {
+	at   time.Time
+	up   float64
+	down float64
+}
+
+// 同一服务的一个上报来源（3x-ui推送、某个hy2等），速率按该来源相邻两次上报的间隔计算，
+// series 的键为 service / inbound|tag / client|email / outbound|tag
+type sourceRates struct {
+	lastAt time.Time
+	pushes []time.Time // 窗口内的上报时间
+	series map[string][]rateSample
+}
+
+// 单个服务的速率数据，多个来源的速率相加
+type serviceRates struct {
+	lastAt  time.Time
+	sources map[string]*sourceRates
+}
+
+// 一次上报中各记录的流量增量，提交成功后用于计算速率
+type rateObservation struct {
+	serviceID int
+	source    string
+	at        time.Time
+	deltas    map[string][2]int64
+}
+
+// 按服务记录最近一段时间的速率，只保存在内存中
+type rateTracker struct {
+	mu       sync.Mutex
+	services map[int]*serviceRates
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{services: make(map[int]*serviceRates)}
+}
+
+func rateKey(kind trafficKind, key string) string {
+	return kind.name + "|" + key
+}
+
+// 根据一次上报相对同一来源上一次上报的时间间隔计算速率
+func (t *rateTracker) record(observations []rateObservation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, obs := range observations {
+		sr, ok := t.services[obs.serviceID]
+		if !ok {
+			sr = &serviceRates{sources: make(map[string]*sourceRates)}
+			t.services[obs.serviceID] = sr
+		}
+		src, ok := sr.sources[obs.source]
+		if !ok {
+			src = &sourceRates{series: make(map[string][]rateSample)}
+			sr.sources[obs.source] = src
+		}
+		// 乱序到达的上报不参与计算
+		if !obs.at.After(src.lastAt) {
+			continue
+		}
+		interval := obs.at.Sub(src.lastAt)
+		first := src.lastAt.IsZero()
+		src.lastAt = obs.at
+		src.pushes = append(src.pushes, obs.at)
+		if obs.at.After(sr.lastAt) {
+			sr.lastAt = obs.at
+		}
+		if !first && interval <= rateMaxGap {
+			seconds := interval.Seconds()
+			for key, delta := range obs.deltas {
+				src.series[key] = append(src.series[key], rateSample{at: obs.at, up: float64(delta[0]) / seconds, down: float64(delta[1]) / seconds})
+			}
+		}
+		src.prune(obs.at.Add(-rateWindow))
+	}
+}
+
+// 清理窗口外的样本和上报时间
+func (src *sourceRates) prune(cutoff time.Time) {
+	i := 0
+	for i < len(src.pushes) && src.pushes[i].Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		src.pushes = append([]time.Time(nil), src.pushes[i:]...)
+	}
+	for key, samples := range src.series {
+		i := 0
+		for i < len(samples) && samples[i].at.Before(cutoff) {
+			i++
+		}
+		if i == len(samples) {
+			delete(src.series, key)
+		} else if i > 0 {
+			src.series[key] = append([]rateSample(nil), samples[i:]...)
+		}
+	}
+}
+
+// 该来源在时间at的速率：at之前最近一次上报中有该记录的流量时为该次的速率，否则为0
+func (src *sourceRates) rateAt(key string, at time.Time) (float64, float64) {
+	var lastPush time.Time
+	for _, p := range src.pushes {
+		if p.After(at) {
+			break
+		}
+		lastPush = p
+	}
+	samples := src.series[key]
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].at.After(at) {
+			continue
+		}
+		if samples[i].at.Equal(lastPush) {
+			return samples[i].up, samples[i].down
+		}
+		break
+	}
+	return 0, 0
+}
+
+// 获取当前速率和窗口内的峰值速率（各来源之和）
+func (t *rateTracker) get(serviceID int, key string, now time.Time) Rate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var rate Rate
+	sr, ok := t.services[serviceID]
+	if !ok {
+		return rate
+	}
+	cutoff := now.Add(-rateWindow)
+	var times []time.Time
+	for _, src := range sr.sources {
+		samples := src.series[key]
+		if len(samples) == 0 {
+			continue
+		}
+		last := samples[len(samples)-1]
+		// 本次推送中没有该记录（没有流量）或推送已中断时，当前速率为0
+		if last.at.Equal(src.lastAt) && now.Sub(last.at) <= rateStaleAfter {
+			rate.UpBps += last.up
+			rate.DownBps += last.down
+		}
+		for _, s := range samples {
+			if !s.at.Before(cutoff) {
+				times = append(times, s.at)
+			}
+		}
+	}
+	if len(times) == 0 {
+		return rate
+	}
+	// 峰值：在每个样本的时间点上把各来源当时的速率相加
+	for _, at := range times {
+		var up, down float64
+		for _, src := range sr.sources {
+			u, d := src.rateAt(key, at)
+			up += u
+			down += d
+		}
+		if up > rate.PeakUpBps {
+			rate.PeakUpBps = up
+		}
+		if down > rate.PeakDownBps {
+			rate.PeakDownBps = down
+		}
+	}
+	at := sr.lastAt
+	rate.UpdatedAt = &at
+	return rate
+}
+
+// 删除或合并服务后丢弃其速率数据
+func (t *rateTracker) forget(serviceID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.services, serviceID)
+}
+
+// 服务整体的实时速率（入站流量合计）
+func (d *Database) ServiceRate(serviceID int) Rate {
+	return d.rates.get(serviceID, "service", time.Now())
+}
+
+// 单个端口、用户或出站的实时速率
+func (d *Database) recordRate(serviceID int, kind trafficKind, key string) Rate {
+	return d.rates.get(serviceID, rateKey(kind, key), time.Now())
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Xray累计值游标的键（Xray API地址）
+func XrayCounterSource(cfg *XrayConfig) string {
+	return net.JoinHostPort(cfg.APIHost, cfg.APIPort)
+}
+
+// 根据上次保存的累计值计算Xray计数器的增量（计数器名称如 user>>>email>>>traffic>>>uplink）：
+//   - 来源还没有游标（首次采集）时只记录基准，增量为0，不把Xray启动以来的累计值算作当天的流量
+//   - 计数器变小或上次读到的计数器不见了，说明Xray重启过，此时增量为当前值
+//   - 新出现的计数器（新增的用户或入站）增量为当前值
+func xrayDeltas(tx *sql.Tx, source string, counters map[string]int64) (map[string]int64, error) {
+	lasts := map[string]int64{}
+	rows, err := tx.Query(`SELECT name, value FROM xray_counters WHERE source = ?`, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		lasts[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deltas := make(map[string]int64, len(counters))
+	if len(lasts) == 0 {
+		for name := range counters {
+			deltas[name] = 0
+		}
+		return deltas, nil
+	}
+	restarted := false
+	for name, last := range lasts {
+		cur, ok := counters[name]
+		if !ok || cur < last {
+			restarted = true
+			break
+		}
+	}
+	for name, cur := range counters {
+		if cur < 0 {
+			return nil, fmt.Errorf("%w: Xray计数器 %s 为负数", ErrInvalidTrafficData, name)
+		}
+		if restarted {
+			deltas[name] = cur
+		} else {
+			deltas[name] = cur - lasts[name]
+		}
+	}
+	return deltas, nil
+}
+
+// 保存本次读取的累计值，作为下次计算增量的起点；Xray重启后消失的计数器一并删除
+func saveXrayCounters(tx *sql.Tx, source string, counters map[string]int64, at time.Time) error {
+	if _, err := tx.Exec(`DELETE FROM xray_counters WHERE source = ?`, source); err != nil {
+		return err
+	}
+	for name, value := range counters {
+		_, err := tx.Exec(`INSERT INTO xray_counters (source, name, value, updated_at) VALUES (?, ?, ?, ?)`, source, name, value, at)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写入一次Xray采集：读取计数器时不清零，增量的计算、流量的写入和游标的更新在同一个事务中，
+// 写入失败或进程退出时游标不变，下次采集会重新计算这部分流量。toData将计数器增量转换为上报格式
+func (d *Database) ProcessXrayCounters(src TrafficSource, source string, counters map[string]int64, toData func(map[string]int64) *TrafficData) (*TrafficData, error) {
+	at := src.ReceivedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	deltas, err := xrayDeltas(tx, source, counters)
+	if err != nil {
+		return nil, err
+	}
+	data := toData(deltas)
+	if err := ValidateTrafficData(data); err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(data)
+
+	acc := newTrafficAccumulator()
+	if err := d.applyTrafficData(tx, src, string(body), data, acc); err != nil && err != ErrDuplicatePush {
+		return nil, err
+	}
+	if err := acc.flush(tx); err != nil {
+		return nil, fmt.Errorf("写入流量历史失败: %v", err)
+	}
+	if err := saveXrayCounters(tx, source, counters, at); err != nil {
+		return nil, fmt.Errorf("保存Xray计数器失败: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.rates.record(acc.observations)
+	return data, nil
+}
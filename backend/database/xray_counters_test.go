@@ -0,0 +1,105 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestXrayDeltas(t *testing.T) {
+	const up, down = "user>>>a>>>traffic>>>uplink", "user>>>a>>>traffic>>>downlink"
+	const newUser = "user>>>b>>>traffic>>>uplink"
+	tests := []struct {
+		name  string
+		reads []map[string]int64 // 依次读取的累计值，最后一次读取的增量与want比较
+		want  map[string]int64
+	}{
+		{
+			name:  "首次采集只记录基准",
+			reads: []map[string]int64{{up: 1000, down: 50}},
+			want:  map[string]int64{up: 0, down: 0},
+		},
+		{
+			name:  "正常增长",
+			reads: []map[string]int64{{up: 1000, down: 50}, {up: 1500, down: 80}},
+			want:  map[string]int64{up: 500, down: 30},
+		},
+		{
+			name:  "新增的计数器按当前值计算",
+			reads: []map[string]int64{{up: 1000}, {up: 1000, newUser: 70}},
+			want:  map[string]int64{up: 0, newUser: 70},
+		},
+		{
+			name:  "计数器变小按重启处理",
+			reads: []map[string]int64{{up: 1000, down: 50}, {up: 1200, down: 10}},
+			want:  map[string]int64{up: 1200, down: 10},
+		},
+		{
+			name:  "计数器消失按重启处理",
+			reads: []map[string]int64{{up: 1000, newUser: 5}, {up: 1100}},
+			want:  map[string]int64{up: 1100},
+		},
+		{
+			name:  "重启后从新的累计值继续",
+			reads: []map[string]int64{{up: 1000}, {up: 30}, {up: 45}},
+			want:  map[string]int64{up: 15},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := openTestDatabase(t)
+			var got map[string]int64
+			for i, read := range tt.reads {
+				tx, err := d.db.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = xrayDeltas(tx, "127.0.0.1:10085", read)
+				if err != nil {
+					t.Fatalf("第%d次读取: %v", i+1, err)
+				}
+				if err := saveXrayCounters(tx, "127.0.0.1:10085", read, time.Now()); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("增量 = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 写入失败时游标不变，下次采集重新计算这部分流量
+func TestProcessXrayCountersKeepsCursorOnFailure(t *testing.T) {
+	d := openTestDatabase(t)
+	const source = "127.0.0.1:10085"
+	toData := func(deltas map[string]int64) *TrafficData {
+		return inboundData("xray-in", deltas["inbound>>>xray-in>>>traffic>>>uplink"], 0)
+	}
+	read := func(v int64) map[string]int64 { return map[string]int64{"inbound>>>xray-in>>>traffic>>>uplink": v} }
+	src := TrafficSource{ClientIP: "10.0.0.1"}
+
+	if _, err := d.ProcessXrayCounters(src, source, read(1000), toData); err != nil {
+		t.Fatal(err)
+	}
+	// token绑定的服务不存在，写入失败
+	failing := src
+	failing.ServiceID = 999
+	if _, err := d.ProcessXrayCounters(failing, source, read(1300), toData); err == nil {
+		t.Fatal("写入失败时应返回错误")
+	}
+	data, err := d.ProcessXrayCounters(src, source, read(1500), toData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.InboundTraffics[0].Up != 500 {
+		t.Errorf("失败后的增量 = %d, 期望 500", data.InboundTraffics[0].Up)
+	}
+	serviceID, _ := lookupService(d.db, "", "10.0.0.1")
+	if up, _ := inboundHistoryTotal(t, d, serviceID, "xray-in"); up != 500 {
+		t.Errorf("历史上传 = %d, 期望 500（首次采集只记录基准）", up)
+	}
+}
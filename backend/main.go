@@ -2,17 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"xtrafficdash/database"
+	"xtrafficdash/scheduler"
+	"xtrafficdash/xray"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -24,6 +37,29 @@ type Config struct {
 	DebugMode    bool   `json:"debug_mode"`
 	LogLevel     string `json:"log_level"`
 	DatabasePath string `json:"database_path"`
+	// 为true时拒绝所有未携带上报token的流量推送
+	RequireIngestToken bool `json:"require_ingest_token"`
+	// 受信任的反向代理（CIDR或IP），只有来自这些地址的请求才会采信X-Forwarded-For/X-Real-Ip
+	TrustedProxies []string `json:"trusted_proxies"`
+	// 原始上报数据归档
+	PayloadArchiveEnabled    bool `json:"payload_archive_enabled"`
+	PayloadArchiveMaxRows    int  `json:"payload_archive_max_rows"`
+	PayloadArchiveMaxAgeDays int  `json:"payload_archive_max_age_days"`
+	// 内容完全相同的推送在该时间窗口内视为重复推送（秒，0表示只按请求ID去重）
+	DedupWindowSeconds int `json:"dedup_window_seconds"`
+	// 单次上报样本超过阈值时进入隔离区
+	QuarantineDefaultBytes int64 `json:"quarantine_default_bytes"`
+	QuarantineLearnFactor  int64 `json:"quarantine_learn_factor"`
+	QuarantineMinBytes     int64 `json:"quarantine_min_bytes"`
+	// 上报写入队列（0表示不使用队列，每次上报同步写入）
+	IngestQueueSize   int `json:"ingest_queue_size"`
+	IngestBatchSize   int `json:"ingest_batch_size"`
+	IngestFlushMillis int `json:"ingest_flush_millis"`
+	// 每小时流量保留天数
+	HourlyRetentionDays int `json:"hourly_retention_days"`
+	// 拉取型采集（hy2、Xray）同时运行的来源数上限，以及失败重试的最长间隔（秒）
+	CollectorConcurrency       int `json:"collector_concurrency"`
+	CollectorMaxBackoffSeconds int `json:"collector_max_backoff_seconds"`
 }
 
 // 响应数据结构体
@@ -38,6 +74,10 @@ var (
 	config *Config
 	logger *logrus.Logger
 	db     *database.Database
+	// 上报写入队列，为nil时同步写入
+	ingestQueue *database.IngestQueue
+	// hy2同步和Xray采集的调度器
+	collectors *scheduler.Scheduler
 )
 
 // 环境变量读取函数
@@ -57,6 +97,25 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsInt64(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		return strings.ToLower(value) == "true"
@@ -76,7 +135,8 @@ func setTimezone() {
 	time.Local = loc
 }
 
-func init() {
+// 读取配置并初始化日志、数据库等全局依赖（在main中调用，测试时不会执行）
+func setup() {
 	setTimezone()
 	// 初始化日志
 	logger = logrus.New()
@@ -89,6 +149,28 @@ func init() {
 		DebugMode:    getEnvAsBool("DEBUG_MODE", false),
 		LogLevel:     getEnv("LOG_LEVEL", "info"),
 		DatabasePath: getEnv("DATABASE_PATH", "xtrafficdash.db"),
+
+		RequireIngestToken: getEnvAsBool("REQUIRE_INGEST_TOKEN", false),
+		TrustedProxies:     getEnvAsList("TRUSTED_PROXIES"),
+
+		PayloadArchiveEnabled:    getEnvAsBool("PAYLOAD_ARCHIVE_ENABLED", false),
+		PayloadArchiveMaxRows:    getEnvAsInt("PAYLOAD_ARCHIVE_MAX_ROWS", 5000),
+		PayloadArchiveMaxAgeDays: getEnvAsInt("PAYLOAD_ARCHIVE_MAX_AGE_DAYS", 7),
+
+		DedupWindowSeconds: getEnvAsInt("DEDUP_WINDOW_SECONDS", 5),
+
+		QuarantineDefaultBytes: getEnvAsInt64("QUARANTINE_DEFAULT_BYTES", 1<<40),
+		QuarantineLearnFactor:  getEnvAsInt64("QUARANTINE_LEARN_FACTOR", 10),
+		QuarantineMinBytes:     getEnvAsInt64("QUARANTINE_MIN_BYTES", 10<<30),
+
+		IngestQueueSize:   getEnvAsInt("INGEST_QUEUE_SIZE", 1000),
+		IngestBatchSize:   getEnvAsInt("INGEST_BATCH_SIZE", 200),
+		IngestFlushMillis: getEnvAsInt("INGEST_FLUSH_MS", 500),
+
+		HourlyRetentionDays: getEnvAsInt("HOURLY_RETENTION_DAYS", 7),
+
+		CollectorConcurrency:       getEnvAsInt("COLLECTOR_CONCURRENCY", 4),
+		CollectorMaxBackoffSeconds: getEnvAsInt("COLLECTOR_MAX_BACKOFF_SECONDS", 300),
 	}
 
 	// 设置日志级别
@@ -117,6 +199,25 @@ func init() {
 		logger.Info("数据库初始化成功")
 	}
 
+	// 重复推送检测
+	if db != nil {
+		db.SetDedupWindow(time.Duration(config.DedupWindowSeconds) * time.Second)
+		db.SetQuarantineConfig(config.QuarantineDefaultBytes, config.QuarantineLearnFactor, config.QuarantineMinBytes)
+		db.SetHourlyRetention(time.Duration(config.HourlyRetentionDays) * 24 * time.Hour)
+	}
+
+	// 原始上报数据归档（可选）
+	if db != nil && config.PayloadArchiveEnabled {
+		db.EnablePayloadArchive(config.PayloadArchiveMaxRows, time.Duration(config.PayloadArchiveMaxAgeDays)*24*time.Hour)
+		logger.Infof("已启用原始上报数据归档: 最多%d条, 保留%d天", config.PayloadArchiveMaxRows, config.PayloadArchiveMaxAgeDays)
+	}
+
+	// 上报写入队列
+	if db != nil && config.IngestQueueSize > 0 {
+		ingestQueue = database.NewIngestQueue(db, config.IngestQueueSize, config.IngestBatchSize, time.Duration(config.IngestFlushMillis)*time.Millisecond)
+		logger.Infof("已启用上报写入队列: 容量%d, 批量%d, 间隔%dms", config.IngestQueueSize, config.IngestBatchSize, config.IngestFlushMillis)
+	}
+
 	// 初始化hy2配置表
 	if db != nil {
 		err := db.InitHy2ConfigTable()
@@ -127,6 +228,7 @@ func init() {
 }
 
 func main() {
+	setup()
 	logger.Info("启动XTrafficDash...")
 	logger.Infof("监听端口: %d", config.ListenPort)
 	logger.Infof("数据库路径: %s", config.DatabasePath)
@@ -141,8 +243,17 @@ func main() {
 	// 创建Gin路由
 	r := gin.New()
 
+	// 只采信受信任代理转发的客户端IP，未配置时不信任任何代理
+	r.RemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-Ip"}
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		logger.Fatalf("受信任代理配置无效: %v", err)
+	}
+	if len(config.TrustedProxies) > 0 {
+		logger.Infof("受信任代理: %s", strings.Join(config.TrustedProxies, ", "))
+	}
+
 	// 使用中间件
-	r.Use(gin.Logger())
+	r.Use(gin.LoggerWithFormatter(accessLogFormatter))
 	r.Use(gin.Recovery())
 	r.Use(corsMiddleware())
 
@@ -153,12 +264,49 @@ func main() {
 	addr := fmt.Sprintf("0.0.0.0:%d", config.ListenPort)
 	logger.Infof("服务器启动在地址 %s", addr)
 
-	// 启动hy2流量同步定时任务（自动执行）
-	go startHy2SyncTask()
+	// 启动上报写入队列
+	if ingestQueue != nil {
+		ingestQueue.Start()
+	}
+
+	// 启动hy2同步和Xray采集（每个来源按各自的间隔调度）
+	collectors = scheduler.New(config.CollectorConcurrency, time.Duration(config.CollectorMaxBackoffSeconds)*time.Second)
+	stopCollectors := make(chan struct{})
+	go startCollectorTask(stopCollectors)
 
-	if err := r.Run(addr); err != nil {
-		logger.Fatalf("服务器启动失败: %v", err)
+	// 启动数据清理定时任务
+	go startMaintenanceTask()
+
+	srv := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("服务器启动失败: %v", err)
+		}
+	}()
+
+	// 收到退出信号后停止接收请求，并写完队列中的数据
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	logger.Info("正在退出...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Errorf("关闭HTTP服务失败: %v", err)
+	}
+	// 先停止采集，等正在进行的采集写完再关闭写入队列
+	close(stopCollectors)
+	collectors.Stop()
+	if ingestQueue != nil {
+		ingestQueue.Close()
+	}
+	if db != nil {
+		if err := db.Close(); err != nil {
+			logger.Errorf("关闭数据库失败: %v", err)
+		}
 	}
+	logger.Info("已退出")
 }
 
 // 设置路由
@@ -174,6 +322,9 @@ func setupRoutes(r *gin.Engine) {
 	// 接收流量数据的API接口
 	r.POST("/api/traffic", handleTraffic)
 
+	// 通用批量上报接口（自定义脚本、其他面板）
+	r.POST("/api/v2/ingest", handleIngestV2)
+
 	// 注册数据库API路由（需要认证）
 	if db != nil {
 		dbAPI := database.NewDatabaseAPI(db)
@@ -215,11 +366,29 @@ func setupRoutes(r *gin.Engine) {
 		})
 	})
 
-	r.GET("/api/hy2-configs", getAllHy2ConfigsHandler)
-	r.POST("/api/hy2-configs", saveAllHy2ConfigsHandler)
-	r.POST("/api/hy2-configs/add", addHy2ConfigHandler)
-	r.POST("/api/hy2-configs/update", updateHy2ConfigHandler)
-	r.DELETE("/api/hy2-configs/:id", deleteHy2ConfigHandler)
+	// hy2配置（包含hy2密码和客户端私钥，需要认证）
+	hy2Group := r.Group("/api/hy2-configs")
+	hy2Group.Use(database.AuthMiddleware())
+	{
+		hy2Group.GET("", getAllHy2ConfigsHandler)
+		hy2Group.POST("", saveAllHy2ConfigsHandler)
+		hy2Group.POST("/add", addHy2ConfigHandler)
+		hy2Group.POST("/update", updateHy2ConfigHandler)
+		hy2Group.DELETE("/:id", deleteHy2ConfigHandler)
+	}
+
+	// Xray采集配置（需要认证）
+	xrayGroup := r.Group("/api/xray-configs")
+	xrayGroup.Use(database.AuthMiddleware())
+	{
+		xrayGroup.GET("", getAllXrayConfigsHandler)
+		xrayGroup.POST("", addXrayConfigHandler)
+		xrayGroup.PUT("/:id", updateXrayConfigHandler)
+		xrayGroup.DELETE("/:id", deleteXrayConfigHandler)
+	}
+
+	// 采集状态（需要认证）
+	r.GET("/api/collectors", database.AuthMiddleware(), getCollectorStatusHandler)
 
 	// 处理所有其他静态文件请求
 	r.NoRoute(func(c *gin.Context) {
@@ -238,7 +407,7 @@ func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Ingest-Token, X-Node-Id, X-Request-Id")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -281,10 +450,29 @@ func handleTraffic(c *gin.Context) {
 		return
 	}
 
-	// 优先读取 X-Real-Ip header
-	realIP := c.GetHeader("X-Real-Ip")
-	if realIP == "" {
-		realIP = c.ClientIP()
+	// 客户端IP：X-Forwarded-For/X-Real-Ip 只在请求来自受信任代理时生效
+	realIP := c.ClientIP()
+
+	// 可选的节点标识，用于在IP变化时保持同一个服务
+	nodeID := strings.TrimSpace(c.GetHeader("X-Node-Id"))
+	if nodeID == "" {
+		nodeID = strings.TrimSpace(c.Query("node_id"))
+	}
+
+	// hy2同步任务通过签名声明所代表的节点，签名有效时使用其声明的节点地址
+	if syncHost := c.GetHeader("X-Sync-Host"); syncHost != "" {
+		if database.VerifySyncNode(syncHost, nodeID, c.GetHeader("X-Request-Id"), bodyBytes, c.GetHeader("X-Sync-Timestamp"), c.GetHeader("X-Sync-Signature")) {
+			realIP = syncHost
+		} else {
+			logger.Warnf("同步签名校验失败，忽略声明的节点地址 %s - IP: %s", syncHost, realIP)
+		}
+	}
+	if len(nodeID) > 128 {
+		c.JSON(400, ResponseData{
+			Success: false,
+			Error:   "节点标识过长",
+		})
+		return
 	}
 
 	// 构建请求数据
@@ -296,38 +484,394 @@ func handleTraffic(c *gin.Context) {
 		"query_params": c.Request.URL.Query(),
 		"raw_body":     string(bodyBytes),
 		"client_ip":    realIP,
+		"node_id":      nodeID,
+		"request_id":   requestIDFromContext(c),
 		"user_agent":   c.Request.UserAgent(),
 	}
 
 	// 简化日志输出
-	logger.Infof("收到流量数据请求 - IP: %s, 数据长度: %d bytes", requestData["client_ip"], len(requestData["raw_body"].(string)))
+	logger.Infof("收到流量数据请求 - IP: %s, 节点: %s, 数据长度: %d bytes", requestData["client_ip"], nodeID, len(requestData["raw_body"].(string)))
 
 	// 处理数据库存储
+	duplicate := false
+	archived := false
 	if db != nil {
+		// 校验上报token，token可以通过header或query参数传递（3x-ui只能配置URL）
+		serviceID, ok := authorizeIngest(c, nodeID, realIP)
+		if !ok {
+			return
+		}
+
+		archive := &database.PayloadRecord{
+			ReceivedAt: requestData["timestamp"].(time.Time),
+			ClientIP:   realIP,
+			NodeID:     nodeID,
+			ServiceID:  serviceID,
+			UserAgent:  requestData["user_agent"].(string),
+			Headers:    summarizeHeaders(c),
+			Body:       requestData["raw_body"].(string),
+			Outcome:    database.PayloadOutcomeOK,
+		}
+
 		// 尝试解析为流量数据
 		var trafficData database.TrafficData
 		if err := json.Unmarshal(bodyBytes, &trafficData); err == nil {
+			// 负数流量直接拒绝
+			if err := database.ValidateTrafficData(&trafficData); err != nil {
+				logger.Warnf("拒绝不合法的流量数据 - IP: %s, 节点: %s: %v", realIP, nodeID, err)
+				archive.Outcome = database.PayloadOutcomeInvalid
+				archive.Error = err.Error()
+				if err := db.ArchivePayload(archive); err != nil {
+					logger.Errorf("归档原始上报数据失败: %v", err)
+				}
+				c.JSON(400, ResponseData{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
 			// 成功解析为流量数据，存储到数据库
-			err = db.ProcessTrafficData(requestData["client_ip"].(string), requestData["user_agent"].(string), requestData["raw_body"].(string), &trafficData)
-			if err != nil {
+			src := database.TrafficSource{
+				ClientIP:   requestData["client_ip"].(string),
+				NodeID:     nodeID,
+				UserAgent:  requestData["user_agent"].(string),
+				ServiceID:  serviceID,
+				ReceivedAt: archive.ReceivedAt,
+				RequestID:  requestData["request_id"].(string),
+			}
+			if ingestQueue != nil {
+				// 异步写入：先归档取得归档ID，写入完成后由队列更新处理结果
+				archive.Outcome = database.PayloadOutcomeQueued
+				if err := db.ArchivePayload(archive); err != nil {
+					logger.Errorf("归档原始上报数据失败: %v", err)
+				}
+				archived = true
+				err = ingestQueue.Enqueue(&database.IngestJob{
+					Source:    src,
+					Body:      requestData["raw_body"].(string),
+					Data:      &trafficData,
+					ArchiveID: archive.ID,
+				})
+				if err != nil {
+					logger.Warnf("流量数据入队失败 - IP: %s, 节点: %s: %v", realIP, nodeID, err)
+					if archive.ID > 0 {
+						if err := db.UpdatePayloadOutcome(archive.ID, database.PayloadOutcomeError, err.Error()); err != nil {
+							logger.Errorf("更新归档处理结果失败: %v", err)
+						}
+					}
+					status, message := 429, "写入队列已满，请稍后重试"
+					if err == database.ErrIngestQueueClosed {
+						status, message = 503, "服务正在退出，请稍后重试"
+					}
+					c.Header("Retry-After", "1")
+					c.JSON(status, ResponseData{
+						Success: false,
+						Error:   message,
+					})
+					return
+				}
+			} else if err = db.ProcessTrafficData(src, requestData["raw_body"].(string), &trafficData); err == database.ErrDuplicatePush {
+				logger.Infof("重复推送已忽略 - IP: %s, 节点: %s", realIP, nodeID)
+				archive.Outcome = database.PayloadOutcomeDup
+				duplicate = true
+			} else if err != nil {
 				logger.Errorf("存储流量数据失败: %v", err)
+				archive.Outcome = database.PayloadOutcomeError
+				archive.Error = err.Error()
 			} else {
 				logger.Infof("流量数据已存储到数据库")
 			}
 		} else {
 			logger.Warnf("请求体不是有效的流量数据格式: %v", err)
+			archive.Outcome = database.PayloadOutcomeInvalid
+			archive.Error = err.Error()
+		}
+
+		// 归档原始数据，便于排查和回放
+		if !archived {
+			if err := db.ArchivePayload(archive); err != nil {
+				logger.Errorf("归档原始上报数据失败: %v", err)
+			}
 		}
 	}
 
+	message := "流量数据接收成功"
+	if duplicate {
+		message = "重复推送，已忽略"
+	}
 	c.JSON(200, ResponseData{
 		Success: true,
-		Message: "流量数据接收成功",
+		Message: message,
 		Data: map[string]interface{}{
 			"timestamp": requestData["timestamp"],
 		},
 	})
 }
 
+// 读取可选的请求ID/序列号（header或query参数）
+func requestIDFromContext(c *gin.Context) string {
+	requestID := c.GetHeader("X-Request-Id")
+	if requestID == "" {
+		requestID = c.Query("request_id")
+	}
+	if requestID == "" {
+		requestID = c.Query("seq")
+	}
+	requestID = strings.TrimSpace(requestID)
+	if len(requestID) > 128 {
+		requestID = requestID[:128]
+	}
+	return requestID
+}
+
+// 归档时保留的请求头摘要（不包含token等敏感信息）
+func summarizeHeaders(c *gin.Context) string {
+	summary := map[string]string{}
+	for _, key := range []string{"Content-Type", "Content-Length", "X-Forwarded-For", "X-Real-Ip", "X-Node-Id", "X-Sync-Host", "X-Request-Id"} {
+		if value := c.GetHeader(key); value != "" {
+			summary[key] = value
+		}
+	}
+	summary["Remote-Addr"] = c.Request.RemoteAddr
+	if c.GetHeader("X-Ingest-Token") != "" || c.Query("token") != "" {
+		summary["Ingest-Token"] = "present"
+	}
+	data, _ := json.Marshal(summary)
+	return string(data)
+}
+
+// 访问日志格式与gin默认格式相同，但隐藏查询参数中的上报token
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redactLogPath(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// 将路径中查询参数 token 的值替换为 redacted
+func redactLogPath(path string) string {
+	base, rawQuery, ok := strings.Cut(path, "?")
+	if !ok || !strings.Contains(rawQuery, "token") {
+		return path
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// 无法解析时不输出查询参数
+		return base + "?***"
+	}
+	if _, ok := query["token"]; !ok {
+		return path
+	}
+	query.Set("token", "redacted")
+	return base + "?" + query.Encode()
+}
+
+// 校验流量上报的token，返回token绑定的服务ID（未使用token时为0）
+func authorizeIngest(c *gin.Context, nodeID string, clientIP string) (int, bool) {
+	token := c.GetHeader("X-Ingest-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	if token != "" {
+		serviceID, err := db.ResolveIngestToken(token)
+		if err == database.ErrInvalidIngestToken {
+			logger.Warnf("拒绝流量数据请求 - IP: %s, 上报token无效", clientIP)
+			c.JSON(401, ResponseData{
+				Success: false,
+				Error:   "上报token无效或已吊销",
+			})
+			return 0, false
+		} else if err != nil {
+			logger.Errorf("校验上报token失败: %v", err)
+			c.JSON(500, ResponseData{
+				Success: false,
+				Error:   "校验上报token失败",
+			})
+			return 0, false
+		}
+		return serviceID, true
+	}
+
+	if config.RequireIngestToken {
+		logger.Warnf("拒绝流量数据请求 - IP: %s, 缺少上报token", clientIP)
+		c.JSON(401, ResponseData{
+			Success: false,
+			Error:   "缺少上报token",
+		})
+		return 0, false
+	}
+
+	// 服务已启用token后，不再接受该IP无token的上报
+	required, err := db.ServiceRequiresToken(nodeID, clientIP)
+	if err != nil {
+		logger.Errorf("查询服务token状态失败: %v", err)
+		c.JSON(500, ResponseData{
+			Success: false,
+			Error:   "校验上报token失败",
+		})
+		return 0, false
+	}
+	if required {
+		logger.Warnf("拒绝流量数据请求 - IP: %s, 该服务已启用上报token", clientIP)
+		c.JSON(401, ResponseData{
+			Success: false,
+			Error:   "该服务已启用上报token，请在请求中携带token",
+		})
+		return 0, false
+	}
+	return 0, true
+}
+
+// 处理通用批量上报：每条记录带有类型、键和时间，迟到或补录的数据写入其所属的日期和小时。
+// 补录的批次可能很大，且需要返回处理结果，所以同步写入而不经过写入队列
+func handleIngestV2(c *gin.Context) {
+	if db == nil {
+		c.JSON(500, ResponseData{
+			Success: false,
+			Error:   "数据库未初始化",
+		})
+		return
+	}
+	bodyBytes, err := c.GetRawData()
+	if err != nil {
+		c.JSON(400, ResponseData{
+			Success: false,
+			Error:   "读取请求体失败",
+		})
+		return
+	}
+
+	realIP := c.ClientIP()
+	receivedAt := time.Now()
+	// 请求头或query参数中的节点标识作为默认节点
+	nodeID := strings.TrimSpace(c.GetHeader("X-Node-Id"))
+	if nodeID == "" {
+		nodeID = strings.TrimSpace(c.Query("node_id"))
+	}
+	// 归档时记录格式，回放时按通用上报解析
+	archive := &database.PayloadRecord{
+		ReceivedAt: receivedAt,
+		ClientIP:   realIP,
+		NodeID:     nodeID,
+		UserAgent:  c.Request.UserAgent(),
+		Headers:    summarizeHeaders(c),
+		Body:       string(bodyBytes),
+		Format:     database.PayloadFormatBatch,
+		Outcome:    database.PayloadOutcomeOK,
+	}
+
+	batch, err := database.ParseIngestBatch(bodyBytes, receivedAt)
+	if err != nil {
+		logger.Warnf("拒绝不合法的批量上报 - IP: %s: %v", realIP, err)
+		// 通过校验的请求才归档，避免未授权的请求写满归档
+		serviceID, ok := authorizeIngest(c, nodeID, realIP)
+		if !ok {
+			return
+		}
+		archive.ServiceID = serviceID
+		archive.Outcome = database.PayloadOutcomeInvalid
+		archive.Error = err.Error()
+		if err := db.ArchivePayload(archive); err != nil {
+			logger.Errorf("归档原始上报数据失败: %v", err)
+		}
+		c.JSON(400, ResponseData{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	batch.SetDefaultNode(nodeID)
+	if batch.RequestID == "" {
+		batch.RequestID = requestIDFromContext(c)
+	}
+
+	serviceID, ok := authorizeIngest(c, batch.NodeID, realIP)
+	if !ok {
+		return
+	}
+	// 没有token时，记录中出现的其他节点也不能是已启用token的服务
+	if serviceID == 0 {
+		checked := map[string]bool{batch.NodeID: true}
+		for _, r := range batch.Records {
+			if checked[r.NodeID] {
+				continue
+			}
+			checked[r.NodeID] = true
+			required, err := db.ServiceRequiresToken(r.NodeID, realIP)
+			if err != nil {
+				logger.Errorf("查询服务token状态失败: %v", err)
+				c.JSON(500, ResponseData{
+					Success: false,
+					Error:   "校验上报token失败",
+				})
+				return
+			}
+			if required {
+				c.JSON(401, ResponseData{
+					Success: false,
+					Error:   "节点 " + r.NodeID + " 已启用上报token，请在请求中携带token",
+				})
+				return
+			}
+		}
+	}
+
+	logger.Infof("收到批量上报 - IP: %s, 节点: %s, 记录数: %d", realIP, batch.NodeID, len(batch.Records))
+	src := database.TrafficSource{
+		ClientIP:   realIP,
+		NodeID:     batch.NodeID,
+		UserAgent:  c.Request.UserAgent(),
+		ServiceID:  serviceID,
+		ReceivedAt: receivedAt,
+	}
+	result, err := db.IngestBatch(src, string(bodyBytes), batch)
+	archive.NodeID = batch.NodeID
+	archive.ServiceID = serviceID
+	if err == database.ErrDuplicatePush {
+		archive.Outcome = database.PayloadOutcomeDup
+	} else if err != nil {
+		archive.Outcome = database.PayloadOutcomeError
+		archive.Error = err.Error()
+	}
+	if err := db.ArchivePayload(archive); err != nil {
+		logger.Errorf("归档原始上报数据失败: %v", err)
+	}
+	if err != nil && err != database.ErrDuplicatePush {
+		logger.Errorf("写入批量上报失败: %v", err)
+		c.JSON(500, ResponseData{
+			Success: false,
+			Error:   "写入批量上报失败: " + err.Error(),
+		})
+		return
+	}
+
+	message := "批量上报接收成功"
+	if err == database.ErrDuplicatePush {
+		message = "重复推送，已忽略"
+	}
+	c.JSON(200, ResponseData{
+		Success: true,
+		Message: message,
+		Data:    result,
+	})
+}
+
 // 获取hy2配置
 func getHy2ConfigHandler(c *gin.Context) {
 	if db == nil {
@@ -357,6 +901,14 @@ func updateHy2ConfigHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"success": false, "error": "参数错误: " + err.Error()})
 		return
 	}
+	if msg := normalizeHy2Config(&cfg); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": msg})
+		return
+	}
+	if msg := checkHy2ConfigConflict(cfg); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": msg})
+		return
+	}
 	err := db.UpdateHy2Config(&cfg)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
@@ -396,17 +948,221 @@ func getAllHy2ConfigsHandler(c *gin.Context) {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"success": true, "data": cfgs})
+	// 附带每个配置的同步状态
+	type hy2ConfigWithStatus struct {
+		database.Hy2Config
+		Status *collectorStatus `json:"status"`
+	}
+	list := make([]hy2ConfigWithStatus, 0, len(cfgs))
+	for i := range cfgs {
+		list = append(list, hy2ConfigWithStatus{Hy2Config: cfgs[i], Status: hy2CollectorStatus(&cfgs[i])})
+	}
+	c.JSON(200, gin.H{"success": true, "data": list})
+}
+
+// 校验hy2地址、证书、同步方式和采集间隔，未指定同步方式时直接写入本地数据库；转发时目标地址必须有效
+func normalizeHy2Config(cfg *database.Hy2Config) string {
+	if msg := normalizeHy2Source(cfg); msg != "" {
+		return msg
+	}
+	cfg.Name = strings.TrimSpace(cfg.Name)
+	if len(cfg.Name) > 64 {
+		return "名称不能超过64个字符"
+	}
+	cfg.NodeID = strings.TrimSpace(cfg.NodeID)
+	if len(cfg.NodeID) > 128 {
+		return "节点标识过长"
+	}
+	cfg.InboundTag = strings.TrimSpace(cfg.InboundTag)
+	if cfg.InboundTag == "" {
+		cfg.InboundTag = database.Hy2DefaultInboundTag
+	}
+	if len(cfg.InboundTag) > 64 || strings.ContainsAny(cfg.InboundTag, "/?#") {
+		return "入站标签不能超过64个字符，且不能包含 / ? #"
+	}
+	cfg.SyncMode = strings.TrimSpace(cfg.SyncMode)
+	cfg.TargetAPIURL = strings.TrimSpace(cfg.TargetAPIURL)
+	switch cfg.SyncMode {
+	case "":
+		cfg.SyncMode = database.Hy2SyncLocal
+	case database.Hy2SyncLocal, database.Hy2SyncForward:
+	default:
+		return "同步方式必须为 local 或 forward"
+	}
+	if cfg.SyncMode == database.Hy2SyncForward && !isValidURL(cfg.TargetAPIURL) {
+		return "目标API地址无效，必须以http://或https://开头"
+	}
+	return validateCollectorTiming(cfg.IntervalSeconds, cfg.TimeoutSeconds)
+}
+
+// 检查配置之间的冲突，返回冲突的配置序号和原因：
+// 同一hy2地址只能配置一次（计数器游标按地址保存）；写入同一面板的同一服务（主机和节点标识相同）的配置入站标签不能相同
+func hy2ConfigConflict(cfgs []database.Hy2Config) (int, string) {
+	sources := make(map[string]int, len(cfgs))
+	tags := make(map[string]int, len(cfgs))
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		source := database.Hy2CounterSource(cfg)
+		if j, ok := sources[source]; ok {
+			return i, fmt.Sprintf("hy2地址 %s 与%s重复", source, hy2ConfigLabel(&cfgs[j]))
+		}
+		sources[source] = i
+
+		tagKey := strings.ToLower(cfg.SourceAPIHost) + "|" + cfg.NodeID + "|" + cfg.InboundTag
+		if cfg.SyncMode == database.Hy2SyncForward {
+			tagKey += "|" + cfg.TargetAPIURL
+		}
+		if j, ok := tags[tagKey]; ok {
+			return i, fmt.Sprintf("与%s属于同一服务（主机和节点标识相同），入站标签 %s 不能相同", hy2ConfigLabel(&cfgs[j]), cfg.InboundTag)
+		}
+		tags[tagKey] = i
+	}
+	return -1, ""
+}
+
+// 检查单条新增或修改的配置与已有配置是否冲突
+func checkHy2ConfigConflict(cfg database.Hy2Config) string {
+	existing, err := db.GetAllHy2Configs()
+	if err != nil {
+		return "读取hy2配置失败: " + err.Error()
+	}
+	cfgs := make([]database.Hy2Config, 0, len(existing)+1)
+	for _, e := range existing {
+		if cfg.ID == 0 || e.ID != cfg.ID {
+			cfgs = append(cfgs, e)
+		}
+	}
+	cfgs = append(cfgs, cfg)
+	_, msg := hy2ConfigConflict(cfgs)
+	return msg
+}
+
+// 提示信息中的配置名称
+func hy2ConfigLabel(cfg *database.Hy2Config) string {
+	if cfg.Name != "" {
+		return "配置「" + cfg.Name + "」"
+	}
+	return "配置「" + database.Hy2CounterSource(cfg) + "」"
+}
+
+// 校验hy2统计API的地址和证书设置；填写了完整地址时，主机和端口从地址中解析
+func normalizeHy2Source(cfg *database.Hy2Config) string {
+	cfg.SourceAPIURL = strings.TrimSpace(cfg.SourceAPIURL)
+	cfg.SourceAPIHost = strings.Trim(strings.TrimSpace(cfg.SourceAPIHost), "[]")
+	cfg.SourceAPIPort = strings.TrimSpace(cfg.SourceAPIPort)
+	cfg.TLSPinSHA256 = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(cfg.TLSPinSHA256), ":", ""))
+	if cfg.SourceAPIURL != "" {
+		u, err := url.Parse(cfg.SourceAPIURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "hy2统计API地址无效，应为 http(s)://主机[:端口][/路径]"
+		}
+		if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return "hy2统计API地址不能包含用户名、查询参数或锚点"
+		}
+		cfg.SourceAPIHost = u.Hostname()
+		cfg.SourceAPIPort = u.Port()
+		if cfg.SourceAPIPort == "" {
+			cfg.SourceAPIPort = "80"
+			if u.Scheme == "https" {
+				cfg.SourceAPIPort = "443"
+			}
+		}
+		cfg.SourceAPIURL = strings.TrimRight(u.String(), "/")
+	}
+	if !isValidHost(cfg.SourceAPIHost) {
+		return "hy2服务端IP/域名无效"
+	}
+	if !isValidPort(cfg.SourceAPIPort) {
+		return "hy2服务端端口无效"
+	}
+	if strings.TrimSpace(cfg.SourceAPIPassword) == "" {
+		return "hy2服务端密码不能为空"
+	}
+	if !strings.HasPrefix(cfg.SourceAPIURL, "https://") &&
+		(cfg.TLSCA != "" || cfg.TLSPinSHA256 != "" || cfg.TLSClientCert != "" || cfg.TLSClientKey != "") {
+		return "证书设置只能用于https地址"
+	}
+	if _, err := hy2TLSConfig(cfg); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// 根据配置生成访问hy2统计API的TLS设置，http地址返回nil
+func hy2TLSConfig(cfg *database.Hy2Config) (*tls.Config, error) {
+	if !strings.HasPrefix(cfg.SourceAPIURL, "https://") {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSCA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.TLSCA)) {
+			return nil, errors.New("CA证书无效，应为PEM格式")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.TLSPinSHA256 != "" {
+		pin, err := hex.DecodeString(cfg.TLSPinSHA256)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, errors.New("证书指纹无效，应为SHA-256的64位十六进制")
+		}
+		// 只填指纹时（如自签名证书）不校验证书链和域名，只比对服务端证书的指纹
+		tlsCfg.InsecureSkipVerify = cfg.TLSCA == ""
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("服务端未提供证书")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("服务端证书指纹不匹配: %x", sum)
+			}
+			return nil
+		}
+	}
+	if cfg.TLSClientCert != "" || cfg.TLSClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.TLSClientCert), []byte(cfg.TLSClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("客户端证书或私钥无效: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// 访问hy2统计API的HTTP客户端，超时由请求的ctx控制
+func hy2HTTPClient(cfg *database.Hy2Config) (*http.Client, error) {
+	tlsCfg, err := hy2TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	// 每次同步都新建客户端，不保留空闲连接
+	transport.DisableKeepAlives = true
+	return &http.Client{Transport: transport}, nil
+}
+
+// 校验采集间隔（5~86400秒）和超时（1~300秒），0表示使用默认值
+func validateCollectorTiming(intervalSeconds, timeoutSeconds int) string {
+	if intervalSeconds != 0 && (intervalSeconds < 5 || intervalSeconds > 86400) {
+		return "采集间隔必须在5~86400秒之间"
+	}
+	if timeoutSeconds != 0 && (timeoutSeconds < 1 || timeoutSeconds > 300) {
+		return "采集超时必须在1~300秒之间"
+	}
+	return ""
 }
 
 func isValidHost(host string) bool {
 	if host == "" {
 		return false
 	}
-	// 简单IP或域名校验
-	ipRe := regexp.MustCompile(`^([0-9]{1,3}\.){3}[0-9]{1,3}$`)
+	// IPv4、IPv6或域名
+	if net.ParseIP(host) != nil {
+		return true
+	}
 	domainRe := regexp.MustCompile(`^([a-zA-Z0-9\-]+\.)+[a-zA-Z]{2,}$`)
-	return ipRe.MatchString(host) || domainRe.MatchString(host)
+	return domainRe.MatchString(host)
 }
 
 func isValidPort(port string) bool {
@@ -429,32 +1185,16 @@ func saveAllHy2ConfigsHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"success": false, "error": "参数错误: " + err.Error()})
 		return
 	}
-	// 校验
-	if len(cfgs) > 0 {
-		// 统一目标地址
-		targetURL := cfgs[0].TargetAPIURL
-		if !isValidURL(targetURL) {
-			c.JSON(400, gin.H{"success": false, "error": "目标API地址无效，必须以http://或https://开头"})
+	// 校验（每个配置有各自的同步方式和目标地址）
+	for i := range cfgs {
+		if msg := normalizeHy2Config(&cfgs[i]); msg != "" {
+			c.JSON(400, gin.H{"success": false, "error": "第" + strconv.Itoa(i+1) + "行：" + msg})
 			return
 		}
-		for i, cfg := range cfgs {
-			if !isValidHost(cfg.SourceAPIHost) {
-				c.JSON(400, gin.H{"success": false, "error": "第" + strconv.Itoa(i+1) + "行：hy2服务端IP/域名无效"})
-				return
-			}
-			if !isValidPort(cfg.SourceAPIPort) {
-				c.JSON(400, gin.H{"success": false, "error": "第" + strconv.Itoa(i+1) + "行：hy2服务端端口无效"})
-				return
-			}
-			if strings.TrimSpace(cfg.SourceAPIPassword) == "" {
-				c.JSON(400, gin.H{"success": false, "error": "第" + strconv.Itoa(i+1) + "行：hy2服务端密码不能为空"})
-				return
-			}
-			if cfg.TargetAPIURL != targetURL {
-				c.JSON(400, gin.H{"success": false, "error": "所有配置的目标API地址必须一致"})
-				return
-			}
-		}
+	}
+	if i, msg := hy2ConfigConflict(cfgs); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": "第" + strconv.Itoa(i+1) + "行：" + msg})
+		return
 	}
 	// 先清空表再插入
 	err := db.DeleteAllHy2Configs()
@@ -463,7 +1203,10 @@ func saveAllHy2ConfigsHandler(c *gin.Context) {
 		return
 	}
 	for _, cfg := range cfgs {
-		db.AddHy2Config(&cfg)
+		if err := db.AddHy2Config(&cfg); err != nil {
+			c.JSON(500, gin.H{"success": false, "error": err.Error()})
+			return
+		}
 	}
 	c.JSON(200, gin.H{"success": true, "message": "保存成功"})
 }
@@ -479,6 +1222,14 @@ func addHy2ConfigHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"success": false, "error": "参数错误: " + err.Error()})
 		return
 	}
+	if msg := normalizeHy2Config(&cfg); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": msg})
+		return
+	}
+	if msg := checkHy2ConfigConflict(cfg); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": msg})
+		return
+	}
 	err := db.AddHy2Config(&cfg)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
@@ -487,130 +1238,651 @@ func addHy2ConfigHandler(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "message": "添加成功"})
 }
 
-// hy2流量同步定时任务（自动执行，支持多配置）
-func startHy2SyncTask() {
+// 采集的默认间隔和超时
+const (
+	defaultCollectInterval = 10 * time.Second
+	defaultHy2Timeout      = 15 * time.Second
+	defaultXrayTimeout     = 10 * time.Second
+)
+
+// 定时读取hy2和Xray配置并更新采集任务（配置修改后最多10秒生效），stop关闭时退出
+func startCollectorTask(stop <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 	for {
-		if db == nil {
-			time.Sleep(10 * time.Second)
-			continue
+		if db != nil {
+			if jobs, err := collectorJobs(); err != nil {
+				logger.Errorf("读取采集配置失败: %v", err)
+			} else {
+				collectors.Sync(jobs)
+			}
 		}
-		cfgs, err := db.GetAllHy2Configs()
-		if err != nil {
-			logger.Errorf("读取hy2配置失败: %v", err)
-			time.Sleep(10 * time.Second)
-			continue
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
 		}
+	}
+}
 
-		// 如果没有配置，跳过本次执行
-		if len(cfgs) == 0 {
-			time.Sleep(10 * time.Second)
-			continue
-		}
+func secondsOr(seconds int, def time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return def
+}
+
+// hy2配置是否启用且完整（转发模式还需要目标地址），停用或不完整的配置不会同步
+func hy2Collectable(cfg *database.Hy2Config) bool {
+	if !cfg.Enabled || cfg.SourceAPIHost == "" || cfg.SourceAPIPort == "" || cfg.SourceAPIPassword == "" {
+		return false
+	}
+	return cfg.SyncMode != database.Hy2SyncForward || cfg.TargetAPIURL != ""
+}
+
+// 采集任务的Key，同一地址只会有一个任务
+func hy2JobKey(cfg *database.Hy2Config) string {
+	return "hy2|" + database.Hy2CounterSource(cfg)
+}
+
+func xrayJobKey(cfg *database.XrayConfig) string {
+	return "xray|" + net.JoinHostPort(cfg.APIHost, cfg.APIPort)
+}
+
+// 配置指纹：各字段带长度拼接后取SHA-256，不在内存中保留密码和私钥的明文
+func configFingerprint(fields ...string) string {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(strconv.Itoa(len(f)) + ":" + f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 采集任务的配置指纹，只包含任务使用的字段，不含ID（批量保存会重建hy2配置，ID变化但内容不变时不重启任务）。
+// 间隔和超时由调度器单独比较；Hy2Config新增同步用到的字段时需要加到这里
+func hy2JobVersion(cfg *database.Hy2Config) string {
+	return configFingerprint(
+		cfg.NodeID,
+		cfg.SourceAPIPassword,
+		cfg.SourceAPIHost,
+		cfg.SourceAPIPort,
+		cfg.SourceAPIURL,
+		cfg.TargetAPIURL,
+		cfg.SyncMode,
+		cfg.TLSCA,
+		cfg.TLSPinSHA256,
+		cfg.TLSClientCert,
+		cfg.TLSClientKey,
+		cfg.Name,
+		cfg.InboundTag,
+	)
+}
+
+func xrayJobVersion(cfg *database.XrayConfig) string {
+	return configFingerprint(cfg.NodeID, cfg.APIHost, cfg.APIPort)
+}
+
+// 根据hy2和Xray配置生成采集任务
+func collectorJobs() ([]scheduler.Job, error) {
+	hy2Cfgs, err := db.GetAllHy2Configs()
+	if err != nil {
+		return nil, err
+	}
+	xrayCfgs, err := db.GetAllXrayConfigs()
+	if err != nil {
+		return nil, err
+	}
 
-		// 从第一个配置中获取目标地址，所有配置共享同一个目标
-		targetURL := cfgs[0].TargetAPIURL
-		if targetURL == "" {
-			logger.Warnf("[HY2] 目标地址为空，跳过本次同步")
-			time.Sleep(10 * time.Second)
+	var jobs []scheduler.Job
+	for _, cfg := range hy2Cfgs {
+		// 跳过无效配置
+		if !hy2Collectable(&cfg) {
 			continue
 		}
+		cfg := cfg
+		source := database.Hy2CounterSource(&cfg)
+		jobs = append(jobs, scheduler.Job{
+			Key:      hy2JobKey(&cfg),
+			Version:  hy2JobVersion(&cfg),
+			Interval: secondsOr(cfg.IntervalSeconds, defaultCollectInterval),
+			Timeout:  secondsOr(cfg.TimeoutSeconds, defaultHy2Timeout),
+			Run: func(ctx context.Context) (int64, error) {
+				n, err := hy2SyncOnce(ctx, &cfg)
+				if err != nil {
+					logger.Errorf("[HY2] %s: %v", source, err)
+				}
+				return n, err
+			},
+		})
+	}
+	for _, cfg := range xrayCfgs {
+		cfg := cfg
+		addr := net.JoinHostPort(cfg.APIHost, cfg.APIPort)
+		jobs = append(jobs, scheduler.Job{
+			Key:      xrayJobKey(&cfg),
+			Version:  xrayJobVersion(&cfg),
+			Interval: secondsOr(cfg.IntervalSeconds, defaultCollectInterval),
+			Timeout:  secondsOr(cfg.TimeoutSeconds, defaultXrayTimeout),
+			Run: func(ctx context.Context) (int64, error) {
+				n, err := xraySyncOnce(ctx, &cfg)
+				if err != nil {
+					logger.Errorf("[XRAY] %s: %v", addr, err)
+				}
+				return n, err
+			},
+		})
+	}
+	return jobs, nil
+}
 
-		// 为每个配置执行同步，但都发送到同一个目标地址
-		for _, cfg := range cfgs {
-			// 跳过无效配置
-			if cfg.SourceAPIHost == "" || cfg.SourceAPIPort == "" || cfg.SourceAPIPassword == "" {
-				continue
+// 定时清理过期数据（每小时流量等）
+func startMaintenanceTask() {
+	for {
+		if db != nil {
+			if n, err := db.PruneHourlyTraffic(); err != nil {
+				logger.Errorf("清理每小时流量失败: %v", err)
+			} else if n > 0 {
+				logger.Infof("已清理%d条过期的每小时流量", n)
 			}
-
-			// 创建配置副本，使用统一的目标地址
-			syncCfg := database.Hy2Config{
-				ID:                cfg.ID,
-				SourceAPIPassword: cfg.SourceAPIPassword,
-				SourceAPIHost:     cfg.SourceAPIHost,
-				SourceAPIPort:     cfg.SourceAPIPort,
-				TargetAPIURL:      targetURL, // 使用统一的目标地址
+			if n, err := db.PruneOnlineSamples(); err != nil {
+				logger.Errorf("清理在线采样失败: %v", err)
+			} else if n > 0 {
+				logger.Infof("已清理%d条过期的在线采样", n)
+			}
+			if n, err := db.PrunePayloadArchive(); err != nil {
+				logger.Errorf("清理原始上报归档失败: %v", err)
+			} else if n > 0 {
+				logger.Infof("已清理%d条过期或超量的原始上报归档", n)
 			}
-
-			go hy2SyncOnce(&syncCfg)
 		}
-		time.Sleep(10 * time.Second)
+		time.Sleep(time.Hour)
 	}
 }
 
-// hy2流量同步单次执行逻辑
-func hy2SyncOnce(cfg *database.Hy2Config) {
-	client := &http.Client{Timeout: 15 * time.Second}
-	// 构建源API URL
-	sourceURL := "http://" + cfg.SourceAPIHost + ":" + cfg.SourceAPIPort + "/traffic?clear=1"
-	// 1. 拉取源API流量
-	req, err := http.NewRequest("GET", sourceURL, nil)
+// 采集来源的健康状态
+type collectorStatus struct {
+	Type     string `json:"type"` // hy2 / xray
+	ConfigID int    `json:"config_id"`
+	Source   string `json:"source"`
+	NodeID   string `json:"node_id"`
+	Name     string `json:"name"`
+	// pending 尚未采集 / ok 正常 / failing 连续失败 / disabled 已停用 / skipped 配置不完整，不会同步
+	State string `json:"state"`
+	scheduler.Status
+}
+
+func newCollectorStatus(kind string, configID int, source string, nodeID string, key string, collectable bool) *collectorStatus {
+	cs := &collectorStatus{Type: kind, ConfigID: configID, Source: source, NodeID: nodeID, State: "pending"}
+	if !collectable {
+		cs.State = "skipped"
+		return cs
+	}
+	if collectors == nil {
+		return cs
+	}
+	st, ok := collectors.Status(key)
+	cs.Status = st
+	switch {
+	case !ok:
+	case st.ConsecutiveFailures > 0:
+		cs.State = "failing"
+	case st.LastSuccess == nil:
+		cs.State = "pending"
+	default:
+		cs.State = "ok"
+	}
+	return cs
+}
+
+func hy2CollectorStatus(cfg *database.Hy2Config) *collectorStatus {
+	cs := newCollectorStatus("hy2", cfg.ID, database.Hy2CounterSource(cfg), cfg.NodeID, hy2JobKey(cfg), hy2Collectable(cfg))
+	cs.Name = cfg.Name
+	if !cfg.Enabled {
+		cs.State = "disabled"
+	}
+	return cs
+}
+
+func xrayCollectorStatus(cfg *database.XrayConfig) *collectorStatus {
+	return newCollectorStatus("xray", cfg.ID, net.JoinHostPort(cfg.APIHost, cfg.APIPort), cfg.NodeID, xrayJobKey(cfg), true)
+}
+
+// 获取所有hy2和Xray来源的采集状态
+func getCollectorStatusHandler(c *gin.Context) {
+	if db == nil {
+		c.JSON(500, gin.H{"success": false, "error": "数据库未初始化"})
+		return
+	}
+	hy2Cfgs, err := db.GetAllHy2Configs()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	xrayCfgs, err := db.GetAllXrayConfigs()
 	if err != nil {
-		logger.Errorf("[HY2] 创建请求失败: %v", err)
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+
+	list := make([]*collectorStatus, 0, len(hy2Cfgs)+len(xrayCfgs))
+	failing := 0
+	for i := range hy2Cfgs {
+		list = append(list, hy2CollectorStatus(&hy2Cfgs[i]))
+	}
+	for i := range xrayCfgs {
+		list = append(list, xrayCollectorStatus(&xrayCfgs[i]))
+	}
+	for _, cs := range list {
+		if cs.State == "failing" {
+			failing++
+		}
+	}
+	c.JSON(200, gin.H{"success": true, "data": gin.H{
+		"total":      len(list),
+		"failing":    failing,
+		"collectors": list,
+	}})
+}
+
+// hy2流量同步单次执行逻辑，超时由ctx控制
+func hy2SyncOnce(ctx context.Context, cfg *database.Hy2Config) (int64, error) {
+	client, err := hy2HTTPClient(cfg)
+	if err != nil {
+		return 0, err
+	}
+	// 1. 拉取源API的累计流量（不清零，增量由面板根据上次保存的累计值计算）
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.BaseURL()+"/traffic", nil)
+	if err != nil {
+		return 0, fmt.Errorf("创建请求失败: %v", err)
+	}
 	req.Header.Set("Authorization", cfg.SourceAPIPassword)
 	resp, err := client.Do(req)
 	if err != nil {
-		logger.Errorf("[HY2] 请求源API失败: %v", err)
-		return
+		return 0, fmt.Errorf("请求源API失败: %v", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		logger.Errorf("[HY2] 源API返回状态码: %d, 响应: %s", resp.StatusCode, string(body))
-		return
+		return 0, fmt.Errorf("源API返回状态码: %d, 响应: %s", resp.StatusCode, string(body))
 	}
 
-	var raw struct {
-		User struct {
-			Tx int64 `json:"tx"`
-			Rx int64 `json:"rx"`
-		} `json:"user"`
-	}
+	// /traffic 返回 {"用户名": {"tx": 上传, "rx": 下载}, ...}
+	var counters map[string]database.Hy2Counter
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logger.Errorf("[HY2] 读取源API响应失败: %v", err)
-		return
+		return 0, fmt.Errorf("读取源API响应失败: %v", err)
 	}
-	if err := json.Unmarshal(body, &raw); err != nil {
-		logger.Errorf("[HY2] 解析源API响应失败: %v", err)
-		return
+	if err := json.Unmarshal(body, &counters); err != nil {
+		return 0, fmt.Errorf("解析源API响应失败: %v", err)
 	}
-	logger.Infof("[HY2] 获取到流量数据: tx=%d, rx=%d", raw.User.Tx, raw.User.Rx)
 
-	// 2. 转换格式
-	postData := map[string]interface{}{
-		"inboundTraffics": []map[string]interface{}{
-			{
-				"IsInbound":  true,
-				"IsOutbound": false,
-				"Tag":        "hysteria2",
-				"Up":         raw.User.Tx,
-				"Down":       raw.User.Rx,
-			},
-		},
+	// 在线设备数获取失败时只上报流量
+	online, err := hy2FetchOnline(ctx, client, cfg)
+	if err != nil {
+		logger.Warnf("[HY2] 获取在线用户失败: %v", err)
 	}
-	jsonBytes, _ := json.Marshal(postData)
 
-	// 3. POST到目标API
-	postReq, err := http.NewRequest("POST", cfg.TargetAPIURL, bytes.NewBuffer(jsonBytes))
+	// 2. 写入本地数据库，或推送到其他面板；失败时游标不变，下次同步重新计算增量
+	source := database.Hy2CounterSource(cfg)
+	var data *database.TrafficData
+	if cfg.SyncMode == database.Hy2SyncForward {
+		// 推送到其他面板不使用hy2的证书设置
+		data, err = hy2Forward(ctx, &http.Client{}, cfg, source, counters, online)
+	} else {
+		data, err = hy2StoreLocal(cfg, source, counters, online)
+	}
 	if err != nil {
-		logger.Errorf("[HY2] 创建POST请求失败: %v", err)
-		return
+		return 0, fmt.Errorf("写入流量数据失败，下次同步时重试: %v", err)
+	}
+	total := inboundBytes(data)
+	logger.Infof("[HY2] %s (%s): 用户数=%d, 流量=%d字节", source, cfg.InboundTag, len(data.ClientTraffics), total)
+
+	// 3. 检查配额，超出配额的用户踢下线（转发模式的流量记在目标面板，本地没有用量，不检查）
+	if cfg.SyncMode != database.Hy2SyncForward {
+		hy2EnforceQuotas(ctx, client, cfg)
+	}
+	return total, nil
+}
+
+// 直接写入本地数据库，按配置的节点标识和hy2服务端地址确定服务
+func hy2StoreLocal(cfg *database.Hy2Config, source string, counters map[string]database.Hy2Counter, online map[string]int) (*database.TrafficData, error) {
+	now := time.Now()
+	src := database.TrafficSource{
+		ClientIP:   cfg.SourceAPIHost,
+		NodeID:     cfg.NodeID,
+		UserAgent:  "hy2-sync",
+		ReceivedAt: now,
+		// 每次同步使用唯一的请求ID，避免流量相同的两次同步被当作重复推送
+		RequestID: fmt.Sprintf("hy2-%d-%d", cfg.ID, now.UnixNano()),
+	}
+	data, err := db.ProcessHy2Counters(src, source, cfg.InboundTag, counters, online)
+	archiveCollected(src, data, err)
+	return data, err
+}
+
+// 归档采集任务写入的流量增量（3x-ui推送格式，可以回放）；写入失败时游标不变，只记录错误
+func archiveCollected(src database.TrafficSource, data *database.TrafficData, err error) {
+	archive := &database.PayloadRecord{
+		ReceivedAt: src.ReceivedAt,
+		ClientIP:   src.ClientIP,
+		NodeID:     src.NodeID,
+		UserAgent:  src.UserAgent,
+		Format:     database.PayloadFormatTraffic,
+		Outcome:    database.PayloadOutcomeOK,
+	}
+	if data != nil {
+		body, _ := json.Marshal(data)
+		archive.Body = string(body)
+	}
+	if errors.Is(err, database.ErrInvalidTrafficData) {
+		archive.Outcome = database.PayloadOutcomeInvalid
+		archive.Error = err.Error()
+	} else if err != nil {
+		archive.Outcome = database.PayloadOutcomeError
+		archive.Error = err.Error()
+	}
+	if err := db.ArchivePayload(archive); err != nil {
+		logger.Errorf("归档采集数据失败: %v", err)
+	}
+}
+
+// 以3x-ui推送的格式转发到其他面板的 /api/traffic，目标返回成功后才保存游标。
+// 推送在发送前保存，目标面板确认前每次同步都原样重发（请求ID不变），确认后才根据新的累计值生成下一个推送
+func hy2Forward(ctx context.Context, client *http.Client, cfg *database.Hy2Config, source string, counters map[string]database.Hy2Counter, online map[string]int) (*database.TrafficData, error) {
+	pending, err := db.Hy2PendingForward(source)
+	if err != nil {
+		return nil, fmt.Errorf("读取待确认的推送失败: %v", err)
+	}
+	if pending != nil {
+		if err := hy2Post(ctx, client, cfg, pending); err != nil {
+			return nil, fmt.Errorf("重发未确认的推送失败: %v", err)
+		}
+		if err := db.CompleteHy2Forward(source, pending, time.Now()); err != nil {
+			return nil, fmt.Errorf("保存hy2计数器失败: %v", err)
+		}
+	}
+
+	deltas, err := db.Hy2Deltas(source, counters)
+	if err != nil {
+		return nil, err
+	}
+	data := database.NewHy2TrafficData(deltas, cfg.InboundTag)
+	data.OnlineUsers = online
+	jsonBytes, _ := json.Marshal(data)
+
+	now := time.Now()
+	sourceHash := sha256.Sum256([]byte(source))
+	pending = &database.Hy2PendingForward{
+		RequestID: fmt.Sprintf("hy2-%x-%d", sourceHash[:8], now.UnixNano()),
+		Body:      jsonBytes,
+		Counters:  counters,
+		CreatedAt: now,
+	}
+	if err := db.SaveHy2PendingForward(source, pending); err != nil {
+		return nil, fmt.Errorf("保存待确认的推送失败: %v", err)
+	}
+	if err := hy2Post(ctx, client, cfg, pending); err != nil {
+		return nil, err
+	}
+	if err := db.CompleteHy2Forward(source, pending, time.Now()); err != nil {
+		return nil, fmt.Errorf("保存hy2计数器失败: %v", err)
+	}
+	return data, nil
+}
+
+// 发送一次转发推送，目标返回200才算确认
+func hy2Post(ctx context.Context, client *http.Client, cfg *database.Hy2Config, p *database.Hy2PendingForward) error {
+	postReq, err := http.NewRequestWithContext(ctx, "POST", cfg.TargetAPIURL, bytes.NewReader(p.Body))
+	if err != nil {
+		return fmt.Errorf("创建POST请求失败: %v", err)
 	}
 	postReq.Header.Set("Content-Type", "application/json")
-	// 新增：带上真实IP
-	postReq.Header.Set("X-Real-Ip", cfg.SourceAPIHost)
+	postReq.Header.Set("X-Request-Id", p.RequestID)
+	// 通过签名声明上报的节点（目标服务需使用相同的PASSWORD才能校验通过）
+	timestamp, signature := database.SignSyncNode(cfg.SourceAPIHost, cfg.NodeID, p.RequestID, p.Body)
+	postReq.Header.Set("X-Sync-Host", cfg.SourceAPIHost)
+	postReq.Header.Set("X-Sync-Timestamp", timestamp)
+	postReq.Header.Set("X-Sync-Signature", signature)
+	if cfg.NodeID != "" {
+		postReq.Header.Set("X-Node-Id", cfg.NodeID)
+	}
 	postResp, err := client.Do(postReq)
 	if err != nil {
-		logger.Errorf("[HY2] 发送POST到目标API失败: %v", err)
-		return
+		return fmt.Errorf("发送POST到目标API失败: %v", err)
 	}
 	defer postResp.Body.Close()
 	if postResp.StatusCode != 200 {
 		respBody, _ := io.ReadAll(postResp.Body)
-		logger.Errorf("[HY2] 目标API返回状态码: %d, 响应: %s", postResp.StatusCode, string(respBody))
+		return fmt.Errorf("目标API返回状态码: %d, 响应: %s", postResp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// 对hy2配置对应服务中超出配额的用户调用 /kick（每次同步都会检查，直到配额重置或管理员解除限制）
+func hy2EnforceQuotas(ctx context.Context, client *http.Client, cfg *database.Hy2Config) {
+	serviceID, err := db.Hy2ServiceID(cfg)
+	if err != nil {
+		logger.Errorf("[HY2] 查找同步服务失败: %v", err)
+		return
+	}
+	if serviceID == 0 {
+		return
+	}
+	now := time.Now()
+	violations, err := db.Hy2QuotaViolations(serviceID, now)
+	if err != nil {
+		logger.Errorf("[HY2] 检查配额失败: %v", err)
+		return
+	}
+	if len(violations) == 0 {
+		return
+	}
+
+	users := make([]string, 0, len(violations))
+	for _, v := range violations {
+		users = append(users, v.Email)
+	}
+	kickErr := hy2Kick(ctx, client, cfg, users)
+	if kickErr != nil {
+		logger.Errorf("[HY2] 踢下线失败: %v", kickErr)
+	} else {
+		logger.Infof("[HY2] 已踢下线超出配额的用户: %s", strings.Join(users, ", "))
+	}
+	for _, v := range violations {
+		if err := db.RecordHy2Kick(v, kickErr, now); err != nil {
+			logger.Errorf("[HY2] 记录踢下线失败: %v", err)
+		}
+	}
+}
+
+// 调用hy2的 /kick 接口断开用户的连接（请求体为用户名数组）
+func hy2Kick(ctx context.Context, client *http.Client, cfg *database.Hy2Config, users []string) error {
+	body, _ := json.Marshal(users)
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.BaseURL()+"/kick", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", cfg.SourceAPIPassword)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("状态码 %d, 响应: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// 获取hy2当前在线的用户及其设备数（/online 返回 {"用户名": 设备数, ...}）
+func hy2FetchOnline(ctx context.Context, client *http.Client, cfg *database.Hy2Config) (map[string]int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.BaseURL()+"/online", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", cfg.SourceAPIPassword)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+	online := map[string]int{}
+	if err := json.NewDecoder(resp.Body).Decode(&online); err != nil {
+		return nil, err
+	}
+	return online, nil
+}
+
+// 获取全部Xray采集配置
+func getAllXrayConfigsHandler(c *gin.Context) {
+	if db == nil {
+		c.JSON(500, gin.H{"success": false, "error": "数据库未初始化"})
+		return
+	}
+	cfgs, err := db.GetAllXrayConfigs()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
-	logger.Infof("[HY2] 流量数据已成功推送到目标API")
+	type xrayConfigWithStatus struct {
+		database.XrayConfig
+		Status *collectorStatus `json:"status"`
+	}
+	list := make([]xrayConfigWithStatus, 0, len(cfgs))
+	for i := range cfgs {
+		list = append(list, xrayConfigWithStatus{XrayConfig: cfgs[i], Status: xrayCollectorStatus(&cfgs[i])})
+	}
+	c.JSON(200, gin.H{"success": true, "data": list})
+}
+
+// 校验Xray采集配置
+func validateXrayConfig(cfg *database.XrayConfig) string {
+	cfg.APIHost = strings.TrimSpace(cfg.APIHost)
+	cfg.APIPort = strings.TrimSpace(cfg.APIPort)
+	cfg.NodeID = strings.TrimSpace(cfg.NodeID)
+	if !isValidHost(cfg.APIHost) {
+		return "Xray API地址无效"
+	}
+	if !isValidPort(cfg.APIPort) {
+		return "Xray API端口无效"
+	}
+	if len(cfg.NodeID) > 128 {
+		return "节点标识过长"
+	}
+	return validateCollectorTiming(cfg.IntervalSeconds, cfg.TimeoutSeconds)
+}
+
+// 新增Xray采集配置
+func addXrayConfigHandler(c *gin.Context) {
+	if db == nil {
+		c.JSON(500, gin.H{"success": false, "error": "数据库未初始化"})
+		return
+	}
+	var cfg database.XrayConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "参数错误: " + err.Error()})
+		return
+	}
+	if msg := validateXrayConfig(&cfg); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": msg})
+		return
+	}
+	if err := db.AddXrayConfig(&cfg); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "message": "添加成功", "data": cfg})
+}
+
+// 更新Xray采集配置
+func updateXrayConfigHandler(c *gin.Context) {
+	if db == nil {
+		c.JSON(500, gin.H{"success": false, "error": "数据库未初始化"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "参数错误: id无效"})
+		return
+	}
+	var cfg database.XrayConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "参数错误: " + err.Error()})
+		return
+	}
+	cfg.ID = id
+	if msg := validateXrayConfig(&cfg); msg != "" {
+		c.JSON(400, gin.H{"success": false, "error": msg})
+		return
+	}
+	err = db.UpdateXrayConfig(&cfg)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "配置不存在"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "message": "保存成功", "data": cfg})
+}
+
+// 删除Xray采集配置
+func deleteXrayConfigHandler(c *gin.Context) {
+	if db == nil {
+		c.JSON(500, gin.H{"success": false, "error": "数据库未初始化"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "参数错误: id无效"})
+		return
+	}
+	if err := db.DeleteXrayConfig(id); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "message": "删除成功"})
+}
+
+// Xray流量采集单次执行逻辑，超时由ctx控制
+func xraySyncOnce(ctx context.Context, cfg *database.XrayConfig) (int64, error) {
+	addr := net.JoinHostPort(cfg.APIHost, cfg.APIPort)
+	counters, err := xray.Collect(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	src := database.TrafficSource{
+		ClientIP:   cfg.APIHost,
+		NodeID:     cfg.NodeID,
+		UserAgent:  "xray-stats",
+		ReceivedAt: now,
+		// 每次采集使用唯一的请求ID，避免流量相同的两次采集被当作重复推送
+		RequestID: fmt.Sprintf("xray-%d-%d", cfg.ID, now.UnixNano()),
+	}
+	// 写入失败时游标不变，下次采集重新计算增量
+	data, err := db.ProcessXrayCounters(src, database.XrayCounterSource(cfg), counters, xray.ToTrafficData)
+	archiveCollected(src, data, err)
+	if err != nil {
+		return 0, fmt.Errorf("存储流量数据失败，下次采集时重试: %v", err)
+	}
+	logger.Debugf("[XRAY] %s: 采集到%d个入站、%d个用户的流量", addr, len(data.InboundTraffics), len(data.ClientTraffics))
+	return inboundBytes(data), nil
+}
+
+// 入站流量合计（上传+下载），作为一次采集的流量字节数
+func inboundBytes(data *database.TrafficData) int64 {
+	var total int64
+	for _, t := range data.InboundTraffics {
+		if t.IsInbound {
+			total += t.Up + t.Down
+		}
+	}
+	return total
 }
@@ -0,0 +1,275 @@
+// Package scheduler 定时运行拉取型采集任务（hy2、Xray gRPC）：
+// 每个来源一个协程按各自的间隔运行，同一来源的两次运行不会重叠，所有来源共享并发上限，失败后按指数退避重试。
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 一个采集来源
+type Job struct {
+	Key      string // 来源标识，相同Key的任务不会同时运行
+	Version  string // 配置指纹，变化时重启任务
+	Interval time.Duration
+	Timeout  time.Duration
+	Run      func(ctx context.Context) (int64, error) // 返回本次采集到的流量字节数
+}
+
+// 来源的采集状态
+type Status struct {
+	Key                 string     `json:"key"`
+	Running             bool       `json:"running"`
+	LastAttempt         *time.Time `json:"last_attempt"`
+	LastSuccess         *time.Time `json:"last_success"`
+	LastError           string     `json:"last_error"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastLatencyMs       int64      `json:"last_latency_ms"`
+	LastBytes           int64      `json:"last_bytes"` // 上次成功采集到的流量字节数
+	NextRun             *time.Time `json:"next_run"`
+}
+
+// 采集调度器
+type Scheduler struct {
+	sem        chan struct{}
+	maxBackoff time.Duration
+
+	mu       sync.Mutex
+	runners  map[string]*runner
+	statuses map[string]*Status
+	// 已移除但可能仍在运行的任务，同一来源再次加入时等它结束
+	retired map[string]<-chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+type runner struct {
+	job    Job
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// 创建调度器，maxConcurrent为同时运行的任务数上限，maxBackoff为失败重试的最长间隔
+func New(maxConcurrent int, maxBackoff time.Duration) *Scheduler {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	return &Scheduler{
+		sem:        make(chan struct{}, maxConcurrent),
+		maxBackoff: maxBackoff,
+		runners:    make(map[string]*runner),
+		statuses:   make(map[string]*Status),
+		retired:    make(map[string]<-chan struct{}),
+	}
+}
+
+// 更新任务列表：新增的来源开始运行，配置变化的来源在当前运行结束后按新配置重启，不再存在的来源停止
+func (s *Scheduler) Sync(jobs []Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+
+	seen := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		if seen[job.Key] {
+			continue
+		}
+		seen[job.Key] = true
+
+		old, ok := s.runners[job.Key]
+		if ok && old.job.Version == job.Version && old.job.Interval == job.Interval && old.job.Timeout == job.Timeout {
+			continue
+		}
+		var prev <-chan struct{}
+		if ok {
+			old.cancel()
+			prev = old.done
+		} else if done, ok := s.retired[job.Key]; ok {
+			prev = done
+			delete(s.retired, job.Key)
+		}
+		s.start(job, prev)
+	}
+	for key, r := range s.runners {
+		if !seen[key] {
+			r.cancel()
+			s.retired[key] = r.done
+			delete(s.runners, key)
+			delete(s.statuses, key)
+		}
+	}
+	// 已经结束的任务不用再等
+	for key, done := range s.retired {
+		select {
+		case <-done:
+			delete(s.retired, key)
+		default:
+		}
+	}
+}
+
+// 获取来源的采集状态，来源不存在时返回false
+func (s *Scheduler) Status(key string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[key]
+	if !ok {
+		return Status{Key: key}, false
+	}
+	return *st, true
+}
+
+// 获取所有来源的采集状态（按Key排序）
+func (s *Scheduler) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Status, 0, len(s.statuses))
+	for _, st := range s.statuses {
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// 在锁内修改来源的状态（来源已被移除时忽略）
+func (s *Scheduler) updateStatus(key string, fn func(st *Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.statuses[key]; ok {
+		fn(st)
+	}
+}
+
+// 停止所有任务，等待正在运行的任务结束后返回
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for _, r := range s.runners {
+		r.cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) start(job Job, prev <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runner{job: job, cancel: cancel, done: make(chan struct{})}
+	s.runners[job.Key] = r
+	// 配置变化重启时保留之前的状态
+	if _, ok := s.statuses[job.Key]; !ok {
+		s.statuses[job.Key] = &Status{Key: job.Key}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(r.done)
+		// 同一来源的旧任务还在运行时，等它结束后再开始
+		if prev != nil {
+			<-prev
+		}
+		s.loop(ctx, job)
+	}()
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	// 首次运行前随机等待一段时间，避免所有来源同时请求
+	delay := time.Duration(rand.Int63n(int64(job.Interval)))
+	// 配置变化重启后继续之前的失败计数
+	failures := 0
+	s.updateStatus(job.Key, func(st *Status) { failures = st.ConsecutiveFailures })
+	for {
+		next := time.Now().Add(delay)
+		s.updateStatus(job.Key, func(st *Status) { st.NextRun = &next })
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case s.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		start := time.Now()
+		s.updateStatus(job.Key, func(st *Status) {
+			st.Running = true
+			st.LastAttempt = &start
+			st.NextRun = nil
+		})
+		n, err := runOnce(ctx, job)
+		<-s.sem
+		end := time.Now()
+		if ctx.Err() != nil {
+			// 任务被停止或因配置变化重启，本次结果不计入状态
+			s.updateStatus(job.Key, func(st *Status) { st.Running = false })
+			return
+		}
+
+		if err != nil {
+			failures++
+			delay = backoff(job.Interval, failures, s.maxBackoff)
+		} else {
+			failures = 0
+			delay = job.Interval
+		}
+		s.updateStatus(job.Key, func(st *Status) {
+			st.Running = false
+			st.LastLatencyMs = end.Sub(start).Milliseconds()
+			st.ConsecutiveFailures = failures
+			if err != nil {
+				st.LastError = err.Error()
+			} else {
+				st.LastSuccess = &end
+				st.LastError = ""
+				st.LastBytes = n
+			}
+		})
+		delay = withJitter(delay)
+	}
+}
+
+// 运行一次任务，超时后取消其context；任务panic时按失败处理
+func runOnce(ctx context.Context, job Job) (n int64, err error) {
+	runCtx, cancel := context.WithTimeout(ctx, job.Timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("采集任务异常: %v", r)
+		}
+	}()
+	return job.Run(runCtx)
+}
+
+// 连续失败n次后的等待时间：间隔的2^n倍，不超过maxBackoff（间隔本身比maxBackoff长时不退避）
+func backoff(interval time.Duration, n int, maxBackoff time.Duration) time.Duration {
+	if interval >= maxBackoff {
+		return interval
+	}
+	delay := interval
+	for i := 0; i < n && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// 在等待时间上增加±10%的随机偏移
+func withJitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread/2) + time.Duration(rand.Int63n(spread))
+}
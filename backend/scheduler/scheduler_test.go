@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		failures   int
+		maxBackoff time.Duration
+		want       time.Duration
+	}{
+		{"第一次失败", 10 * time.Second, 1, 5 * time.Minute, 20 * time.Second},
+		{"连续失败三次", 10 * time.Second, 3, 5 * time.Minute, 80 * time.Second},
+		{"不超过上限", 10 * time.Second, 10, 5 * time.Minute, 5 * time.Minute},
+		{"失败次数很大时不溢出", 10 * time.Second, 1000, 5 * time.Minute, 5 * time.Minute},
+		{"间隔比上限长时不退避", 10 * time.Minute, 3, 5 * time.Minute, 10 * time.Minute},
+		{"没有失败", 10 * time.Second, 0, 5 * time.Minute, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backoff(tt.interval, tt.failures, tt.maxBackoff); got != tt.want {
+				t.Errorf("backoff = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		got := withJitter(10 * time.Second)
+		if got < 9*time.Second || got > 11*time.Second {
+			t.Fatalf("withJitter = %v, 超出±10%%", got)
+		}
+	}
+	if got := withJitter(0); got != 0 {
+		t.Errorf("withJitter(0) = %v", got)
+	}
+}
+
+// 记录同一来源同时运行的次数
+type overlapJob struct {
+	running  int32
+	overlaps int32
+	runs     int32
+	started  chan struct{}
+	once     sync.Once
+	hold     time.Duration // 每次运行时不理会取消、至少占用的时间
+}
+
+func newOverlapJob(hold time.Duration) *overlapJob {
+	return &overlapJob{started: make(chan struct{}), hold: hold}
+}
+
+func (o *overlapJob) job(version string) Job {
+	return Job{
+		Key:      "hy2:1",
+		Version:  version,
+		Interval: 5 * time.Millisecond,
+		Timeout:  time.Second,
+		Run: func(ctx context.Context) (int64, error) {
+			if atomic.AddInt32(&o.running, 1) > 1 {
+				atomic.AddInt32(&o.overlaps, 1)
+			}
+			atomic.AddInt32(&o.runs, 1)
+			o.once.Do(func() { close(o.started) })
+			time.Sleep(o.hold)
+			atomic.AddInt32(&o.running, -1)
+			return 1, nil
+		},
+	}
+}
+
+func (o *overlapJob) waitStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-o.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("任务没有运行")
+	}
+}
+
+func TestSyncDoesNotOverlap(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *Scheduler, o *overlapJob)
+	}{
+		{
+			name: "配置变化后重启",
+			change: func(s *Scheduler, o *overlapJob) {
+				s.Sync([]Job{o.job("v2")})
+			},
+		},
+		{
+			name: "移除后立即重新加入",
+			change: func(s *Scheduler, o *overlapJob) {
+				s.Sync(nil)
+				s.Sync([]Job{o.job("v1")})
+			},
+		},
+		{
+			name: "移除、其他同步后重新加入",
+			change: func(s *Scheduler, o *overlapJob) {
+				s.Sync(nil)
+				s.Sync(nil)
+				s.Sync([]Job{o.job("v1")})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(4, time.Second)
+			o := newOverlapJob(50 * time.Millisecond)
+			s.Sync([]Job{o.job("v1")})
+			o.waitStarted(t)
+			tt.change(s, o)
+			time.Sleep(150 * time.Millisecond)
+			s.Stop()
+			if n := atomic.LoadInt32(&o.overlaps); n > 0 {
+				t.Errorf("同一来源同时运行了%d次", n)
+			}
+			if n := atomic.LoadInt32(&o.runs); n < 2 {
+				t.Errorf("重新加入后没有继续运行，共运行%d次", n)
+			}
+		})
+	}
+}
+
+func TestSyncRemovesStatus(t *testing.T) {
+	s := New(1, time.Second)
+	defer s.Stop()
+	o := newOverlapJob(0)
+	s.Sync([]Job{o.job("v1")})
+	if _, ok := s.Status("hy2:1"); !ok {
+		t.Fatal("加入的来源没有状态")
+	}
+	s.Sync(nil)
+	if _, ok := s.Status("hy2:1"); ok {
+		t.Error("移除的来源仍有状态")
+	}
+}
+
+func TestFailuresBackOff(t *testing.T) {
+	s := New(1, time.Hour)
+	var runs int32
+	s.Sync([]Job{{
+		Key:      "xray:1",
+		Interval: 5 * time.Millisecond,
+		Timeout:  time.Second,
+		Run: func(ctx context.Context) (int64, error) {
+			atomic.AddInt32(&runs, 1)
+			return 0, errors.New("连接失败")
+		},
+	}})
+	time.Sleep(300 * time.Millisecond)
+	s.Stop()
+
+	st, _ := s.Status("xray:1")
+	if st.LastError != "连接失败" || st.ConsecutiveFailures == 0 {
+		t.Errorf("状态 = %+v, 期望记录失败", st)
+	}
+	// 每次失败后等待翻倍：5ms起，300ms内最多运行6次左右；不退避时会运行约60次
+	if n := atomic.LoadInt32(&runs); n > 8 {
+		t.Errorf("失败后没有退避，运行了%d次", n)
+	}
+}
+
+func TestRunOnceRecoversPanic(t *testing.T) {
+	_, err := runOnce(context.Background(), Job{Timeout: time.Second, Run: func(ctx context.Context) (int64, error) {
+		panic("boom")
+	}})
+	if err == nil {
+		t.Error("任务panic时应返回错误")
+	}
+}
@@ -0,0 +1,225 @@
+// Package xray 通过Xray-core的gRPC StatsService读取流量统计
+//
+// 为避免引入整个xray-core依赖，这里手写了QueryStats请求/响应的protobuf编解码，
+// 字段编号与 app/stats/command/command.proto 保持一致。
+package xray
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"xtrafficdash/database"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const queryStatsMethod = "/xray.app.stats.command.StatsService/QueryStats"
+
+// StatsService客户端
+type StatsClient struct {
+	conn *grpc.ClientConn
+}
+
+// 连接Xray的API入站（例如 127.0.0.1:10085）
+func Dial(ctx context.Context, addr string) (*StatsClient, error) {
+	conn, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsClient{conn: conn}, nil
+}
+
+// 关闭连接
+func (c *StatsClient) Close() error {
+	return c.conn.Close()
+}
+
+// 查询名称匹配pattern的计数器，reset为true时读取后清零（返回的即为上次读取以来的增量）
+func (c *StatsClient) QueryStats(ctx context.Context, pattern string, reset bool) (map[string]int64, error) {
+	req := &queryStatsRequest{pattern: pattern, reset: reset}
+	resp := &queryStatsResponse{}
+	if err := c.conn.Invoke(ctx, queryStatsMethod, req, resp, grpc.ForceCodec(statsCodec{})); err != nil {
+		return nil, err
+	}
+	return resp.stats, nil
+}
+
+// 将计数器转换为流量数据：
+//
+//	inbound>>>tag>>>traffic>>>uplink/downlink
+//	outbound>>>tag>>>traffic>>>uplink/downlink
+//	user>>>email>>>traffic>>>uplink/downlink
+func ToTrafficData(stats map[string]int64) *database.TrafficData {
+	inbounds := map[string]*database.InboundTraffic{}
+	outbounds := map[string]*database.InboundTraffic{}
+	clients := map[string]*database.ClientTraffic{}
+	var inboundOrder, outboundOrder, clientOrder []string
+
+	for name, value := range stats {
+		parts := strings.Split(name, ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" {
+			continue
+		}
+		kind, key, direction := parts[0], parts[1], parts[3]
+		var up, down *int64
+		switch kind {
+		case "inbound", "outbound":
+			m, order := inbounds, &inboundOrder
+			if kind == "outbound" {
+				m, order = outbounds, &outboundOrder
+			}
+			t, ok := m[key]
+			if !ok {
+				t = &database.InboundTraffic{IsInbound: kind == "inbound", IsOutbound: kind == "outbound", Tag: key}
+				m[key] = t
+				*order = append(*order, key)
+			}
+			up, down = &t.Up, &t.Down
+		case "user":
+			t, ok := clients[key]
+			if !ok {
+				t = &database.ClientTraffic{Email: key, Enable: true}
+				clients[key] = t
+				clientOrder = append(clientOrder, key)
+			}
+			up, down = &t.Up, &t.Down
+		default:
+			continue
+		}
+		switch direction {
+		case "uplink":
+			*up += value
+		case "downlink":
+			*down += value
+		}
+	}
+
+	sort.Strings(inboundOrder)
+	sort.Strings(outboundOrder)
+	sort.Strings(clientOrder)
+
+	data := &database.TrafficData{}
+	for _, tag := range inboundOrder {
+		data.InboundTraffics = append(data.InboundTraffics, *inbounds[tag])
+	}
+	for _, tag := range outboundOrder {
+		data.InboundTraffics = append(data.InboundTraffics, *outbounds[tag])
+	}
+	for _, email := range clientOrder {
+		data.ClientTraffics = append(data.ClientTraffics, *clients[email])
+	}
+	return data
+}
+
+// 读取一次全部流量计数器的累计值（不清零，增量由面板根据上次保存的累计值计算），超时由ctx控制
+func Collect(ctx context.Context, addr string) (map[string]int64, error) {
+	client, err := Dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接Xray API失败: %v", err)
+	}
+	defer client.Close()
+
+	stats, err := client.QueryStats(ctx, "", false)
+	if err != nil {
+		return nil, fmt.Errorf("查询Xray流量统计失败: %v", err)
+	}
+	return stats, nil
+}
+
+// QueryStatsRequest { string pattern = 1; bool reset = 2; }
+type queryStatsRequest struct {
+	pattern string
+	reset   bool
+}
+
+// QueryStatsResponse { repeated Stat stat = 1; }，Stat { string name = 1; int64 value = 2; }
+type queryStatsResponse struct {
+	stats map[string]int64
+}
+
+// 只支持上面两种消息的gRPC编解码器
+type statsCodec struct{}
+
+func (statsCodec) Name() string { return "proto" }
+
+func (statsCodec) Marshal(v interface{}) ([]byte, error) {
+	req, ok := v.(*queryStatsRequest)
+	if !ok {
+		return nil, fmt.Errorf("不支持的消息类型: %T", v)
+	}
+	var b []byte
+	if req.pattern != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, req.pattern)
+	}
+	if req.reset {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b, nil
+}
+
+func (statsCodec) Unmarshal(data []byte, v interface{}) error {
+	resp, ok := v.(*queryStatsResponse)
+	if !ok {
+		return fmt.Errorf("不支持的消息类型: %T", v)
+	}
+	resp.stats = make(map[string]int64)
+	return walkFields(data, func(num protowire.Number, typ protowire.Type, value []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var name string
+		var count int64
+		err := walkFields(value, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				name = string(value)
+			case num == 2 && typ == protowire.VarintType:
+				count = int64(varint)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		resp.stats[name] += count
+		return nil
+	})
+}
+
+// 遍历protobuf消息的字段
+func walkFields(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var value []byte
+		var varint uint64
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, typ, value, varint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package xray
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestStatsCodecMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		req  queryStatsRequest
+	}{
+		{"空请求", queryStatsRequest{}},
+		{"只有pattern", queryStatsRequest{pattern: "user>>>"}},
+		{"pattern和reset", queryStatsRequest{pattern: "inbound>>>", reset: true}},
+		{"只有reset", queryStatsRequest{reset: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := statsCodec{}.Marshal(&tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 按protobuf字段解析回请求
+			var got queryStatsRequest
+			err = walkFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					got.pattern = string(value)
+				case num == 2 && typ == protowire.VarintType:
+					got.reset = varint != 0
+				default:
+					t.Errorf("多余的字段 %d", num)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.req {
+				t.Errorf("解析结果 = %+v, 期望 %+v", got, tt.req)
+			}
+		})
+	}
+}
+
+// 按 QueryStatsResponse 的格式编码统计项
+func encodeStats(stats ...interface{}) []byte {
+	var b []byte
+	for i := 0; i < len(stats); i += 2 {
+		var stat []byte
+		stat = protowire.AppendTag(stat, 1, protowire.BytesType)
+		stat = protowire.AppendString(stat, stats[i].(string))
+		stat = protowire.AppendTag(stat, 2, protowire.VarintType)
+		stat = protowire.AppendVarint(stat, uint64(stats[i+1].(int64)))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, stat)
+	}
+	return b
+}
+
+func TestStatsCodecUnmarshal(t *testing.T) {
+	// 未知字段应被忽略（新版Xray可能增加字段）
+	unknown := protowire.AppendTag(nil, 9, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 42)
+	unknown = protowire.AppendTag(unknown, 10, protowire.Fixed64Type)
+	unknown = protowire.AppendFixed64(unknown, 7)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    map[string]int64
+		wantErr bool
+	}{
+		{"空响应", nil, map[string]int64{}, false},
+		{
+			name: "多个统计项",
+			data: encodeStats("inbound>>>in-1>>>traffic>>>uplink", int64(100), "user>>>a@b>>>traffic>>>downlink", int64(1<<40)),
+			want: map[string]int64{"inbound>>>in-1>>>traffic>>>uplink": 100, "user>>>a@b>>>traffic>>>downlink": 1 << 40},
+		},
+		{
+			name: "同名统计项累加",
+			data: encodeStats("outbound>>>direct>>>traffic>>>uplink", int64(1), "outbound>>>direct>>>traffic>>>uplink", int64(2)),
+			want: map[string]int64{"outbound>>>direct>>>traffic>>>uplink": 3},
+		},
+		{
+			name: "忽略未知字段",
+			data: append(unknown, encodeStats("inbound>>>in-1>>>traffic>>>uplink", int64(5))...),
+			want: map[string]int64{"inbound>>>in-1>>>traffic>>>uplink": 5},
+		},
+		{"数据被截断", encodeStats("inbound>>>in-1>>>traffic>>>uplink", int64(5))[:10], nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp queryStatsResponse
+			err := statsCodec{}.Unmarshal(tt.data, &resp)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("期望解析失败")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.stats, tt.want) {
+				t.Errorf("统计 = %v, 期望 %v", resp.stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsCodecRejectsOtherMessages(t *testing.T) {
+	if _, err := (statsCodec{}).Marshal(&queryStatsResponse{}); err == nil {
+		t.Error("Marshal 应拒绝响应消息")
+	}
+	if err := (statsCodec{}).Unmarshal(nil, &queryStatsRequest{}); err == nil {
+		t.Error("Unmarshal 应拒绝请求消息")
+	}
+}
@@ -77,6 +77,14 @@ export const servicesAPI = {
   downloadUserHistory: (serviceId, email) => api.get(`/db/download/user-history/${serviceId}/${email}`, { responseType: 'blob' })
 }
 
+export const hy2API = {
+  // 获取hy2配置（含同步状态）
+  getConfigs: () => api.get('/hy2-configs'),
+
+  // 批量保存hy2配置
+  saveConfigs: (configs) => api.post('/hy2-configs', configs)
+}
+
 export const authAPI = {
   // 登录
   login: (password) => api.post('/auth/login', { password }),